@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"license_keys_shop/internal/mail"
+	"license_keys_shop/internal/models"
+	"license_keys_shop/internal/rbac"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// orderKeyStatus is a delivered key as staff see it: where it is, not
+// what it is.
+type orderKeyStatus struct {
+	ProductID  int        `json:"product_id"`
+	Title      string     `json:"title"`
+	Status     string     `json:"status"`
+	RevealedAt *time.Time `json:"revealed_at,omitempty"`
+}
+
+// AdminGetOrder shows staff an order ({orderId}, the internal id) with its
+// buyer, lines, refunds and the state of its keys.
+func (h *OrderHandler) AdminGetOrder(w http.ResponseWriter, r *http.Request) {
+	staff, ok := currentUser(r)
+	if !ok || !can(h.db, staff, rbac.PermOrdersView) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	orderID, err := strconv.Atoi(mux.Vars(r)["orderId"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	var order models.OrderDetails
+	var currency, charged, username, email string
+	err = h.db.QueryRow(`
+		SELECT o.id, o.public_id, o.user_id, COALESCE(o.subtotal_amount, o.total_amount), o.discount_amount,
+		       o.total_amount, o.refunded_amount, COALESCE(o.promo_code, ''), o.currency,
+		       COALESCE(o.charged_amount, o.total_amount), o.exchange_rate, o.payment_method,
+		       o.payment_status, o.transaction_id, o.created_at, u.username, u.email
+		FROM orders o
+		JOIN users u ON o.user_id = u.id
+		WHERE o.id = $1`, orderID).Scan(
+		&order.ID, &order.Reference, &order.UserID, &order.SubtotalAmount, &order.DiscountAmount,
+		&order.TotalAmount, &order.RefundedAmount, &order.PromoCode, &currency, &charged, &order.ExchangeRate,
+		&order.PaymentMethod, &order.PaymentStatus, &order.TransactionID,
+		&order.CreatedAt, &username, &email)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	order.Charged = models.NewPrice(scanCharged(charged, currency))
+	order.Items = h.getOrderItems(order.ID)
+	order.Refunds = getOrderRefunds(h.db, order.ID)
+
+	keys, err := h.orderKeyStatuses(order.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"order": order,
+		"buyer": map[string]interface{}{
+			"id":       order.UserID,
+			"username": username,
+			"email":    email,
+		},
+		"keys": keys,
+	})
+}
+
+func (h *OrderHandler) orderKeyStatuses(orderID int) ([]orderKeyStatus, error) {
+	rows, err := h.db.Query(`
+		SELECT k.product_id, p.title, k.status, k.revealed_at
+		FROM order_items oi
+		JOIN order_item_keys k ON k.order_item_id = oi.id
+		JOIN products p ON k.product_id = p.id
+		WHERE oi.order_id = $1
+		ORDER BY oi.id, k.id`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []orderKeyStatus{}
+	for rows.Next() {
+		var k orderKeyStatus
+		var revealedAt sql.NullTime
+		if err := rows.Scan(&k.ProductID, &k.Title, &k.Status, &revealedAt); err != nil {
+			return nil, err
+		}
+		if revealedAt.Valid {
+			k.RevealedAt = &revealedAt.Time
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// ResendOrderKeys emails the keys of a paid order ({orderId}) to its buyer
+// again, e.g. when the first email went to spam. The keys count as
+// revealed from then on. Staff never see the keys themselves.
+func (h *OrderHandler) ResendOrderKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	staff, ok := currentUser(r)
+	if !ok || !can(h.db, staff, rbac.PermKeysResend) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	orderID, err := strconv.Atoi(mux.Vars(r)["orderId"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	var reference, status, username, email string
+	err = h.db.QueryRow(`
+		SELECT o.public_id, o.payment_status, u.username, u.email
+		FROM orders o
+		JOIN users u ON o.user_id = u.id
+		WHERE o.id = $1`, orderID).Scan(&reference, &status, &username, &email)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if status != "completed" && status != "partially_refunded" {
+		http.Error(w, "Only paid orders have keys to resend", http.StatusConflict)
+		return
+	}
+
+	keys := h.getOrderLicenseKeys(orderID)
+	if len(keys) == 0 {
+		http.Error(w, "Order has no delivered keys", http.StatusConflict)
+		return
+	}
+
+	var lines []string
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("%s: %s", k["title"], k["license_key"]))
+	}
+	err = h.mailer.Send(r.Context(), mail.Message{
+		To:      email,
+		Subject: "Ключи по заказу " + reference,
+		Body: fmt.Sprintf("Здравствуйте, %s!\n\n"+
+			"По вашей просьбе повторно отправляем ключи по заказу %s:\n\n%s\n\n"+
+			"Заказ также доступен в личном кабинете: %s/payment/%s",
+			username, reference, strings.Join(lines, "\n"), appURL(), reference),
+	})
+	if err != nil {
+		log.Printf("resending keys of order %d: %v", orderID, err)
+		http.Error(w, "Failed to send email", http.StatusBadGateway)
+		return
+	}
+	log.Printf("user %d resent %d keys of order %d to its buyer", staff.ID, len(keys), orderID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"order_id": orderID,
+		"sent_to":  email,
+		"keys":     len(keys),
+	})
+}
@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"license_keys_shop/internal/apitoken"
+	"license_keys_shop/internal/rbac"
+	"license_keys_shop/internal/session"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RequireScope lets API tokens with scope act for their owner on a route.
+// It goes after SessionMiddleware and authenticates the request as the
+// token's owner; requests without an API token pass through untouched.
+// Routes without it don't accept API tokens at all.
+func (h *AuthHandler) RequireScope(scope apitoken.Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			secret := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !strings.HasPrefix(secret, apitoken.Prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, usage, err := h.apiTokens.Authenticate(secret, clientIP(r))
+			if errors.Is(err, apitoken.ErrInvalidToken) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				log.Printf("checking API token: %v", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(usage.Limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(usage.Remaining))
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(usage.ResetAt.Unix(), 10))
+			if usage.Exceeded {
+				wait := int(time.Until(usage.ResetAt).Seconds()) + 1
+				w.Header().Set("Retry-After", strconv.Itoa(wait))
+				http.Error(w, "API token rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+			if !token.Has(scope) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+string(scope)+`"`)
+				http.Error(w, "API token lacks the "+string(scope)+" scope", http.StatusForbidden)
+				return
+			}
+
+			claims := &session.Claims{TokenID: token.ID}
+			err = h.db.QueryRow(`
+				SELECT id, username, email, is_admin FROM users WHERE id = $1`,
+				token.UserID).Scan(&claims.UserID, &claims.Username, &claims.Email, &claims.IsAdmin)
+			if err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(session.NewContext(r.Context(), claims)))
+		})
+	}
+}
+
+// ListAPITokens lists the current user's API tokens.
+func (h *AuthHandler) ListAPITokens(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	h.writeAPITokens(w, user.ID)
+}
+
+// CreateAPIToken issues an API token for the current user. The secret is
+// in this response only.
+func (h *AuthHandler) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		RateLimit     int      `json:"rate_limit"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		http.Error(w, "Name is required and must be at most 100 characters", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	var scopes []apitoken.Scope
+	for _, name := range req.Scopes {
+		scope, known := apitoken.ParseScope(name)
+		if !known {
+			http.Error(w, "Unknown scope: "+name, http.StatusBadRequest)
+			return
+		}
+		// A token can't do more than its owner
+		if scope == apitoken.ScopeProductsWrite && !can(h.db, user, rbac.PermProductsManage) {
+			http.Error(w, "You can't manage products, so neither can your tokens", http.StatusForbidden)
+			return
+		}
+		scopes = append(scopes, scope)
+	}
+	// An omitted or zero rate_limit gets the default
+	if req.RateLimit < 0 || req.RateLimit > apitoken.MaxRateLimit {
+		http.Error(w, "Rate limit must be between 1 and "+strconv.Itoa(apitoken.MaxRateLimit)+
+			" requests per minute, or 0 for the default of "+strconv.Itoa(apitoken.DefaultRateLimit), http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresInDays < 0 {
+		http.Error(w, "Invalid expiry", http.StatusBadRequest)
+		return
+	}
+
+	newToken := apitoken.NewRequest{
+		UserID:    user.ID,
+		Name:      req.Name,
+		Scopes:    scopes,
+		RateLimit: req.RateLimit,
+	}
+	if req.ExpiresInDays > 0 {
+		expires := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		newToken.ExpiresAt = &expires
+	}
+
+	token, secret, err := h.apiTokens.Create(newToken)
+	if errors.Is(err, apitoken.ErrTooMany) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("user %d created API token %s with scopes %v", user.ID, token.ID, token.Scopes)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":  token,
+		"secret": secret,
+	})
+}
+
+// RevokeAPIToken revokes one of the current user's tokens ({tokenId}).
+func (h *AuthHandler) RevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	h.revokeAPIToken(w, user.ID, mux.Vars(r)["tokenId"])
+}
+
+// ListUserAPITokens lists any user's tokens ({userId}) for admins.
+func (h *AuthHandler) ListUserAPITokens(w http.ResponseWriter, r *http.Request) {
+	admin, ok := currentUser(r)
+	if !ok || !can(h.db, admin, rbac.PermUsersManage) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	userID, err := strconv.Atoi(mux.Vars(r)["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	h.writeAPITokens(w, userID)
+}
+
+// RevokeUserAPIToken lets admins revoke any user's token ({userId},
+// {tokenId}).
+func (h *AuthHandler) RevokeUserAPIToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	admin, ok := currentUser(r)
+	if !ok || !can(h.db, admin, rbac.PermUsersManage) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	vars := mux.Vars(r)
+	userID, err := strconv.Atoi(vars["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	h.revokeAPIToken(w, userID, vars["tokenId"])
+}
+
+func (h *AuthHandler) revokeAPIToken(w http.ResponseWriter, userID int, tokenID string) {
+	err := h.apiTokens.Revoke(userID, tokenID)
+	if errors.Is(err, apitoken.ErrNotFound) {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"revoked": tokenID,
+	})
+}
+
+func (h *AuthHandler) writeAPITokens(w http.ResponseWriter, userID int) {
+	tokens, err := h.apiTokens.List(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tokens": tokens,
+		"scopes": apitoken.Scopes(),
+	})
+}
@@ -4,30 +4,103 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"html/template"
+	"license_keys_shop/internal/apitoken"
 	"license_keys_shop/internal/database"
+	"license_keys_shop/internal/mail"
 	"license_keys_shop/internal/models"
+	"license_keys_shop/internal/oauth"
+	"license_keys_shop/internal/password"
+	"license_keys_shop/internal/rbac"
+	"license_keys_shop/internal/session"
+	"license_keys_shop/internal/totp"
+	"license_keys_shop/internal/validation"
+	"license_keys_shop/internal/verification"
+	"log"
 	"net/http"
-	"time"
+	"strconv"
 
-	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/mux"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type AuthHandler struct {
-	db        *database.DB
-	jwtSecret string
-	templates *template.Template
+	db              *database.DB
+	jwtSecret       string
+	sessions        *session.Manager
+	roles           *rbac.Store
+	apiTokens       *apitoken.Store
+	oauth           map[string]oauth.Provider
+	mailer          mail.Mailer
+	verifier        *verification.Signer
+	totpSealer      *totp.Sealer
+	requireAdmin2FA bool
+	templates       *template.Template
 }
 
 func NewAuthHandler(db *database.DB, jwtSecret string, templates *template.Template) *AuthHandler {
 	return &AuthHandler{
-		db:        db,
-		jwtSecret: jwtSecret,
-		templates: templates,
+		db:              db,
+		jwtSecret:       jwtSecret,
+		sessions:        session.NewManager(db, jwtSecret),
+		roles:           rbac.NewStore(db),
+		apiTokens:       apitoken.NewStore(db),
+		oauth:           oauth.FromEnv(appURL()),
+		mailer:          defaultMailer(),
+		verifier:        verification.NewSigner(jwtSecret),
+		totpSealer:      defaultTOTPSealer(),
+		requireAdmin2FA: requireAdminTwoFactor(),
+		templates:       templates,
 	}
 }
 
+// defaultTOTPSealer exits without a TOTP encryption key: second factors
+// are sealed with their own key, not one derived from the JWT secret.
+func defaultTOTPSealer() *totp.Sealer {
+	sealer, err := totp.SealerFromEnv()
+	if err != nil {
+		log.Fatalf("totp: %v", err)
+	}
+	return sealer
+}
+
+// defaultMailer is the mailer configured by the environment, or the log
+// when that configuration is broken.
+func defaultMailer() mail.Mailer {
+	mailer, err := mail.FromEnv()
+	if err != nil {
+		log.Printf("mail: %v; logging messages instead", err)
+		return mail.LogMailer{}
+	}
+	return mailer
+}
+
+// SessionMiddleware authenticates requests with the session's access
+// token, verified against the signing key set, and renews expired access
+// tokens from the refresh cookie. Handlers read the user with currentUser.
+func (h *AuthHandler) SessionMiddleware(next http.Handler) http.Handler {
+	return h.sessions.Middleware(next)
+}
+
+// currentUser is the user SessionMiddleware or RequireScope authenticated
+// the request as.
+func currentUser(r *http.Request) (*models.User, bool) {
+	u, ok := session.UserFromContext(r.Context())
+	if !ok {
+		return nil, false
+	}
+	return &models.User{ID: u.ID, Username: u.Username, Email: u.Email, IsAdmin: u.IsAdmin}, true
+}
+
+// JWKS serves the public keys of access tokens, for other services that
+// verify them (/.well-known/jwks.json).
+func (h *AuthHandler) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(h.sessions.JWKS())
+}
+
 func (h *AuthHandler) ShowLogin(w http.ResponseWriter, r *http.Request) {
 	data := map[string]interface{}{
 		"Title": "Вход в систему",
@@ -60,55 +133,96 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var user models.User
+	var totpEnabled bool
 	err := h.db.QueryRow(`
-		SELECT id, username, email, password_hash, is_admin, created_at, updated_at 
-		FROM users WHERE username = $1 OR email = $1`,
+		SELECT id, username, email, password_hash, is_admin, totp_enabled, created_at, updated_at 
+		FROM users WHERE LOWER(username) = LOWER($1) OR LOWER(email) = LOWER($1)`,
 		req.Username).Scan(
 		&user.ID, &user.Username, &user.Email, &user.PasswordHash,
-		&user.IsAdmin, &user.CreatedAt, &user.UpdatedAt)
+		&user.IsAdmin, &totpEnabled, &user.CreatedAt, &user.UpdatedAt)
 
-	if err == sql.ErrNoRows {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
-	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+
+	// Unknown accounts go through the same throttling and the same bcrypt
+	// work, so neither the answer nor its timing tells them apart
+	if !h.checkLoginThrottle(w, r, user.ID, req.Username) {
+		return
+	}
+	if err == sql.ErrNoRows {
+		spendPasswordCheck(req.Password)
+		h.loginFailed(r, 0, req.Username)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+		h.loginFailed(r, user.ID, req.Username)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id":   user.ID,
-		"username":  user.Username,
-		"email":     user.Email,
-		"is_admin":  user.IsAdmin,
-		"exp":       time.Now().Add(time.Hour * 24).Unix(),
-	})
+	if h.requireSecondFactor(w, r, user, totpEnabled) {
+		return
+	}
+	h.clearLoginFailures(user.ID)
+
+	tokens, ok := h.startSession(w, r, user)
+	if !ok {
+		return
+	}
+	writeLoginResponse(w, r, user, tokens)
+}
+
+// requireSecondFactor starts the second login step when the first one
+// isn't enough: a second factor is set up or, for staff, required. It
+// reports whether it did, which includes failing to find out.
+// Failures are forgotten after the second factor.
+func (h *AuthHandler) requireSecondFactor(w http.ResponseWriter, r *http.Request, user models.User, totpEnabled bool) bool {
+	if totpEnabled {
+		h.startChallenge(w, r, user.ID, challengeVerify)
+		return true
+	}
+	required, err := h.twoFactorRequired(user)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return true
+	}
+	if required {
+		h.startChallenge(w, r, user.ID, challengeEnroll)
+		return true
+	}
+	return false
+}
 
-	tokenString, err := token.SignedString([]byte(h.jwtSecret))
+// startSession logs user in: a new session and its cookies.
+func (h *AuthHandler) startSession(w http.ResponseWriter, r *http.Request, user models.User) (session.Tokens, bool) {
+	tokens, err := h.sessions.Login(session.User{
+		ID:       user.ID,
+		Username: user.Username,
+		Email:    user.Email,
+		IsAdmin:  user.IsAdmin,
+	}, session.ClientOf(r))
 	if err != nil {
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
-		return
+		return session.Tokens{}, false
 	}
 
-	// Set cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "auth_token",
-		Value:    tokenString,
-		Expires:  time.Now().Add(time.Hour * 24),
-		HttpOnly: true,
-		Path:     "/",
-	})
+	session.SetCookies(w, tokens)
+	return tokens, true
+}
 
+func writeLoginResponse(w http.ResponseWriter, r *http.Request, user models.User, tokens session.Tokens) {
 	if r.Header.Get("Content-Type") == "application/json" {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"token": tokenString,
-			"user":  user,
+			"token":              tokens.AccessToken,
+			"expires_at":         tokens.AccessExpiresAt,
+			"refresh_token":      tokens.RefreshToken,
+			"refresh_expires_at": tokens.RefreshExpiresAt,
+			"user":               user,
 		})
 	} else {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -133,35 +247,60 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 		req.Password = r.FormValue("password")
 	}
 
-	// Validate input
-	if req.Username == "" || req.Email == "" || req.Password == "" {
-		http.Error(w, "All fields are required", http.StatusBadRequest)
+	fields := make(validation.Errors)
+	username, err := validation.Username(req.Username)
+	fields.Add("username", err)
+	email, err := validation.Email(req.Email)
+	fields.Add("email", err)
+	if req.Password == "" {
+		fields.Add("password", validation.ErrRequired)
+	} else {
+		fields.Add("password", password.Validate(req.Password, username, email))
+	}
+	if len(fields) > 0 {
+		h.writeRegisterErrors(w, r, req, http.StatusUnprocessableEntity, fields)
 		return
 	}
 
-	// Hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if taken, err := h.takenAccountFields(username, email); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	} else if len(taken) > 0 {
+		h.writeRegisterErrors(w, r, req, http.StatusConflict, taken)
+		return
+	}
+
+	hashedPassword, err := password.Hash(req.Password)
 	if err != nil {
 		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
 		return
 	}
 
-	// Insert user
 	var userID int
 	err = h.db.QueryRow(`
 		INSERT INTO users (username, email, password_hash) 
 		VALUES ($1, $2, $3) RETURNING id`,
-		req.Username, req.Email, string(hashedPassword)).Scan(&userID)
-
+		username, email, hashedPassword).Scan(&userID)
 	if err != nil {
-		http.Error(w, "Username or email already exists", http.StatusConflict)
+		// Most likely someone took the name or address in the meantime
+		if taken, terr := h.takenAccountFields(username, email); terr == nil && len(taken) > 0 {
+			h.writeRegisterErrors(w, r, req, http.StatusConflict, taken)
+			return
+		}
+		log.Printf("registering %q: %v", username, err)
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
 		return
 	}
+	go func() {
+		if err := h.sendVerification(userID, username, email); err != nil {
+			log.Printf("sending verification to user %d: %v", userID, err)
+		}
+	}()
 
 	if r.Header.Get("Content-Type") == "application/json" {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"message": "User created successfully",
+			"message": "User created successfully. Check your email to verify the address.",
 			"user_id": userID,
 		})
 	} else {
@@ -169,14 +308,231 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// takenAccountFields reports which of username and email another account
+// already uses. Both compare without regard to case.
+func (h *AuthHandler) takenAccountFields(username, email string) (validation.Errors, error) {
+	var sameName, sameEmail bool
+	err := h.db.QueryRow(`
+		SELECT COALESCE(BOOL_OR(LOWER(username) = LOWER($1)), FALSE),
+		       COALESCE(BOOL_OR(LOWER(email) = LOWER($2)), FALSE)
+		FROM users
+		WHERE LOWER(username) = LOWER($1) OR LOWER(email) = LOWER($2)`,
+		username, email).Scan(&sameName, &sameEmail)
+	if err != nil {
+		return nil, err
+	}
+
+	taken := make(validation.Errors)
+	if sameName {
+		taken["username"] = "this username is already taken"
+	}
+	if sameEmail {
+		taken["email"] = "an account with this email already exists"
+	}
+	return taken, nil
+}
+
+// writeRegisterErrors answers a rejected registration with the error for
+// each field, or the form again with the errors next to the fields.
+func (h *AuthHandler) writeRegisterErrors(w http.ResponseWriter, r *http.Request, req models.RegisterRequest, status int, fields validation.Errors) {
+	if r.Header.Get("Content-Type") == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  "Validation failed",
+			"fields": fields,
+		})
+		return
+	}
+
+	data := map[string]interface{}{
+		"Title":    "Регистрация",
+		"Errors":   fields,
+		"Username": req.Username,
+		"Email":    req.Email,
+	}
+	w.WriteHeader(status)
+	h.templates.ExecuteTemplate(w, "register.html", data)
+}
+
+// Logout ends the current session on the server as well, so its tokens
+// stop working even if they were copied.
 func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     "auth_token",
-		Value:    "",
-		Expires:  time.Now().Add(-time.Hour),
-		HttpOnly: true,
-		Path:     "/",
-	})
+	if claims, ok := session.ClaimsFromContext(r.Context()); ok {
+		h.sessions.Revoke(claims.UserID, claims.SessionID, session.ReasonLogout)
+	} else if c, err := r.Cookie(session.RefreshCookie); err == nil {
+		// The access token already expired; go by the refresh token
+		h.sessions.RevokeToken(c.Value, session.ReasonLogout)
+	}
+
+	session.ClearCookies(w)
 
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
+
+// Refresh trades a refresh token, from the JSON body or the cookie, for a
+// new token pair. Reusing a refresh token revokes its whole session.
+func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if r.Header.Get("Content-Type") == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.RefreshToken == "" {
+		if c, err := r.Cookie(session.RefreshCookie); err == nil {
+			req.RefreshToken = c.Value
+		}
+	}
+	if req.RefreshToken == "" {
+		http.Error(w, "Refresh token is required", http.StatusUnauthorized)
+		return
+	}
+
+	tokens, err := h.sessions.Refresh(req.RefreshToken, session.ClientOf(r))
+	switch {
+	case errors.Is(err, session.ErrConcurrentRefresh):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, session.ErrInvalidToken), errors.Is(err, session.ErrSessionRevoked),
+		errors.Is(err, session.ErrTokenReused):
+		session.ClearCookies(w)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case err != nil:
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	session.SetCookies(w, tokens)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":              tokens.AccessToken,
+		"expires_at":         tokens.AccessExpiresAt,
+		"refresh_token":      tokens.RefreshToken,
+		"refresh_expires_at": tokens.RefreshExpiresAt,
+	})
+}
+
+// LogoutEverywhere ends all of the user's sessions, this one included.
+func (h *AuthHandler) LogoutEverywhere(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	n, err := h.sessions.RevokeAll(user.ID, "", session.ReasonLogoutEverywhere)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	session.ClearCookies(w)
+
+	if r.Header.Get("Accept") == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"revoked": n,
+		})
+		return
+	}
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// ListSessions lists the user's active sessions, marking the current one.
+func (h *AuthHandler) ListSessions(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	sessions, err := h.sessions.List(user.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if claims, ok := session.ClaimsFromContext(r.Context()); ok {
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == claims.SessionID
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sessions": sessions,
+	})
+}
+
+// RevokeSession ends one of the user's own sessions, e.g. a lost phone.
+func (h *AuthHandler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	err := h.sessions.Revoke(user.ID, mux.Vars(r)["sessionId"], session.ReasonLogout)
+	if errors.Is(err, session.ErrSessionNotFound) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeUserSessions lets an admin end every session of a user.
+func (h *AuthHandler) RevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	admin, ok := currentUser(r)
+	if !ok || !can(h.db, admin, rbac.PermUsersManage) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	userID, err := strconv.Atoi(mux.Vars(r)["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	n, err := h.sessions.RevokeAll(userID, "", session.ReasonAdmin)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id": userID,
+		"revoked": n,
+	})
+}
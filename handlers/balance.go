@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"license_keys_shop/internal/database"
+	"license_keys_shop/internal/ids"
+	"license_keys_shop/internal/ledger"
+	"license_keys_shop/internal/money"
+	"license_keys_shop/internal/rbac"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// maxTopUp caps a single top-up.
+var maxTopUp = money.MustParse("100000", money.Base)
+
+type BalanceHandler struct {
+	db        *database.DB
+	templates *template.Template
+}
+
+func NewBalanceHandler(db *database.DB, templates *template.Template) *BalanceHandler {
+	return &BalanceHandler{
+		db:        db,
+		templates: templates,
+	}
+}
+
+// ShowBalance shows the wallet balance and its latest movements.
+func (h *BalanceHandler) ShowBalance(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	balance, err := ledger.UserBalance(h.db, user.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Header.Get("Accept") == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"balance":  balance,
+			"currency": money.Base,
+		})
+		return
+	}
+
+	history, err := ledger.History(h.db, user.ID, 20, 0)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Title":    "Баланс",
+		"User":     user,
+		"Balance":  balance,
+		"Currency": money.Base,
+		"History":  history,
+	}
+
+	h.templates.ExecuteTemplate(w, "balance.html", data)
+}
+
+// topUpMethods are the gateways a wallet can be topped up from. SBP and
+// Bitcoin payments are bound to an order, and the wallet can't pay itself.
+var topUpMethods = map[string]bool{"card": true, "mir": true}
+
+// TopUp records a pending top-up and charges it through the gateway. The
+// wallet is credited by settleTopUp once the payment succeeds.
+func (h *BalanceHandler) TopUp(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	amount, err := money.Parse(r.FormValue("amount"), money.Base)
+	if err != nil || !amount.IsPositive() || maxTopUp.LessThan(amount) {
+		http.Error(w, fmt.Sprintf("Amount must be between 0.01 and %s", maxTopUp.Format()), http.StatusBadRequest)
+		return
+	}
+
+	paymentMethod := r.FormValue("payment_method")
+	if paymentMethod == "" {
+		paymentMethod = "mir" // default
+	}
+	if !topUpMethods[paymentMethod] {
+		http.Error(w, "Top-ups are paid by card or MIR", http.StatusUnprocessableEntity)
+		return
+	}
+	reference := ids.WithPrefix("topup")
+
+	var topUpID int
+	err = h.db.QueryRow(`
+		INSERT INTO balance_topups (reference, user_id, amount, payment_method)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, reference, user.ID, amount, paymentMethod).Scan(&topUpID)
+	if err != nil {
+		http.Error(w, "Failed to start top-up", http.StatusInternalServerError)
+		return
+	}
+
+	go processTopUp(h.db, topUpID)
+
+	if r.Header.Get("Accept") == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"reference": reference,
+			"amount":    amount,
+			"currency":  money.Base,
+			"status":    "pending",
+		})
+		return
+	}
+
+	http.Redirect(w, r, "/balance", http.StatusSeeOther)
+}
+
+// processTopUp charges a pending top-up through the gateway and settles or
+// fails it. OrderExpirer.Reconcile calls it again for top-ups a restart
+// left pending.
+func processTopUp(db *database.DB, topUpID int) {
+	if !simulateGateway() {
+		if _, err := db.Exec(`
+			UPDATE balance_topups SET status = 'failed', completed_at = CURRENT_TIMESTAMP
+			WHERE id = $1 AND status = 'pending'
+		`, topUpID); err != nil {
+			log.Printf("top-up %d: marking failed: %v", topUpID, err)
+		}
+		return
+	}
+
+	if err := settleTopUp(db, topUpID); err != nil {
+		log.Printf("top-up %d: %v", topUpID, err)
+	}
+}
+
+// settleTopUp credits a paid top-up. Only a pending top-up is credited, so
+// settling twice books the deposit once.
+func settleTopUp(db *database.DB, topUpID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var amount money.Money
+	var method, reference string
+	err = tx.QueryRow(`
+		UPDATE balance_topups SET status = 'completed', completed_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = 'pending'
+		RETURNING user_id, amount, payment_method, reference
+	`, topUpID).Scan(&userID, &amount, &method, &reference)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	txID, err := ledger.TopUp(tx, userID, amount, "Top-up via "+method, reference)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE balance_topups SET ledger_transaction_id = $1 WHERE id = $2", txID, topUpID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetTopUp reports a top-up's status by its reference.
+func (h *BalanceHandler) GetTopUp(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	reference := mux.Vars(r)["reference"]
+
+	var amount money.Money
+	var method, status string
+	err := h.db.QueryRow(`
+		SELECT amount, payment_method, status FROM balance_topups
+		WHERE reference = $1 AND user_id = $2
+	`, reference, user.ID).Scan(&amount, &method, &status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Top-up not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"reference":      reference,
+		"amount":         amount,
+		"currency":       money.Base,
+		"payment_method": method,
+		"status":         status,
+	})
+}
+
+// GetHistory lists wallet movements, newest first, 50 per page.
+func (h *BalanceHandler) GetHistory(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	const perPage = 50
+	page := 1
+	if p, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && p > 0 {
+		page = p
+	}
+
+	history, err := ledger.History(h.db, user.ID, perPage, (page-1)*perPage)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"page":    page,
+		"history": history,
+	})
+}
+
+// VerifyLedger runs the ledger invariants for admins.
+func (h *BalanceHandler) VerifyLedger(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok || !can(h.db, user, rbac.PermFinanceReconcile) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	violations, err := ledger.Verify(h.db)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(violations) > 0 {
+		w.WriteHeader(http.StatusConflict)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ok":         len(violations) == 0,
+		"violations": violations,
+	})
+}
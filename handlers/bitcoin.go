@@ -0,0 +1,817 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"license_keys_shop/internal/bitcoin"
+	"license_keys_shop/internal/database"
+	"license_keys_shop/internal/ledger"
+	"license_keys_shop/internal/money"
+	"license_keys_shop/internal/rbac"
+	"license_keys_shop/internal/settlement"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// bitcoinPaymentMethod pays to a deposit address derived for the order.
+const bitcoinPaymentMethod = "bitcoin"
+
+const (
+	bitcoinPollInterval         = 30 * time.Second
+	defaultBitcoinConfirmations = 2
+)
+
+// devXPub is BIP32 test vector 1 (m/0'), only ever paired with the fake chain.
+const devXPub = "xpub68Gmy5EdvgibQVfPdqkBBCHxA5htiqg55crXYuXoQRKfDBFA1WEjWgP6LHhwBZeNK1VTsfTFUHCdrfp1bgwQ9xv5ski8PX9rL2dZXvgGDnw"
+
+// Statuses of a bitcoin_payments row; a paid or expired one takes no
+// further transactions.
+const (
+	btcAwaitingPayment = "awaiting_payment"
+	btcUnderpaid       = "underpaid"
+	btcConfirming      = "confirming"
+	btcPaid            = "paid"
+	btcExpired         = "expired"
+)
+
+var (
+	errBitcoinTxUsed      = errors.New("transaction already used for another order")
+	errBitcoinPaymentSeen = errors.New("a bitcoin payment for the order has been seen")
+	errOrderClosed        = errors.New("order is no longer awaiting payment")
+	errTopUpClosed        = errors.New("top-up window for the order has closed")
+)
+
+// bitcoinProvider gives every order its own deposit address, derived from
+// the merchant's account xpub, and checks the transactions the buyer
+// reports on chain instead of trusting them. The derivation index and
+// every reported txid are kept in the database.
+type bitcoinProvider struct {
+	db            *database.DB
+	addresses     bitcoin.AddressDeriver
+	chain         bitcoin.ChainVerifier
+	confirmations int
+	// topUpWindow is how long an underpaid order stays open for the rest.
+	topUpWindow time.Duration
+}
+
+// newBitcoinProvider reads the BTC_* settings: addresses come from BTC_XPUB
+// on BTC_NETWORK and payments are looked up through the Esplora API at
+// BTC_ESPLORA_URL. BTC_FAKE_CHAIN=1 swaps the chain for an in-memory one,
+// fed through SimulateBitcoinPayment, and is the only way to run without a
+// real xpub. BTC_CONFIRMATIONS and PAYMENT_TOPUP_WINDOW tune settlement.
+// It returns nil when no BTC_* setting is present at all.
+func newBitcoinProvider(db *database.DB) (*bitcoinProvider, error) {
+	xpub := os.Getenv("BTC_XPUB")
+	esplora := os.Getenv("BTC_ESPLORA_URL")
+	if xpub == "" && esplora == "" && os.Getenv("BTC_FAKE_CHAIN") == "" {
+		return nil, nil
+	}
+	fake, _ := strconv.ParseBool(os.Getenv("BTC_FAKE_CHAIN"))
+
+	network, err := bitcoin.ParseNetwork(os.Getenv("BTC_NETWORK"))
+	if err != nil {
+		return nil, err
+	}
+
+	b := &bitcoinProvider{
+		db:            db,
+		confirmations: defaultBitcoinConfirmations,
+		topUpWindow:   settlement.DefaultTopUpWindow,
+	}
+	if n := os.Getenv("BTC_CONFIRMATIONS"); n != "" {
+		b.confirmations, err = strconv.Atoi(n)
+		if err != nil || b.confirmations < 1 {
+			return nil, fmt.Errorf("invalid BTC_CONFIRMATIONS %q", n)
+		}
+	}
+	if d := os.Getenv("PAYMENT_TOPUP_WINDOW"); d != "" {
+		b.topUpWindow, err = time.ParseDuration(d)
+		if err != nil || b.topUpWindow <= 0 {
+			return nil, fmt.Errorf("invalid PAYMENT_TOPUP_WINDOW %q", d)
+		}
+	}
+
+	switch {
+	case fake && esplora != "":
+		return nil, errors.New("BTC_FAKE_CHAIN and BTC_ESPLORA_URL are mutually exclusive")
+	case fake:
+		log.Print("bitcoin: BTC_FAKE_CHAIN set, verifying payments against an in-memory fake chain")
+		b.chain = bitcoin.NewFakeChain()
+		if xpub == "" {
+			xpub = devXPub
+		}
+	case xpub == "" || esplora == "":
+		return nil, errors.New("BTC_XPUB and BTC_ESPLORA_URL are both required unless BTC_FAKE_CHAIN=1")
+	default:
+		b.chain = bitcoin.NewEsploraVerifier(esplora)
+	}
+
+	b.addresses, err = bitcoin.NewXPubDeriver(xpub, network)
+	if err != nil {
+		return nil, fmt.Errorf("BTC_XPUB: %w", err)
+	}
+	return b, nil
+}
+
+// Charge hands out the next deposit address for the BTC amount the order
+// was priced at.
+func (b *bitcoinProvider) Charge(tx *sql.Tx, p PaymentIntent) (bool, error) {
+	if p.Amount.IsZero() {
+		// Fully discounted; there is nothing to send
+		return true, nil
+	}
+
+	var charged, currency string
+	err := tx.QueryRow("SELECT charged_amount, currency FROM orders WHERE id = $1", p.OrderID).Scan(&charged, &currency)
+	if err != nil {
+		return false, err
+	}
+	due := scanCharged(charged, currency)
+	if due.Currency() != money.BTC || !due.IsPositive() {
+		return false, fmt.Errorf("order %d is not priced in BTC", p.OrderID)
+	}
+
+	var index int64
+	if err := tx.QueryRow("SELECT nextval('bitcoin_address_index')").Scan(&index); err != nil {
+		return false, err
+	}
+	address, err := b.addresses.Address(uint32(index))
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO bitcoin_payments (order_id, address_index, address, amount_due)
+		VALUES ($1, $2, $3, $4)`, p.OrderID, index, address, due.Minor())
+	if err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// Refund credits the wallet: coins can't be sent back without an address
+// of the buyer's.
+func (b *bitcoinProvider) Refund(tx *sql.Tx, r RefundIntent) (string, error) {
+	return refundToBalance(tx, r)
+}
+
+// Await polls the chain until the order is paid in full with enough
+// confirmations, or the order stops being pending.
+func (b *bitcoinProvider) Await(orderID int) (bool, error) {
+	ticker := time.NewTicker(bitcoinPollInterval)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		var orderStatus, status string
+		err := b.db.QueryRow(`
+			SELECT o.payment_status, bp.status
+			FROM bitcoin_payments bp
+			JOIN orders o ON bp.order_id = o.id
+			WHERE bp.order_id = $1`, orderID).Scan(&orderStatus, &status)
+		if err != nil {
+			return false, err
+		}
+		if orderStatus != "pending" || status == btcExpired {
+			return false, nil
+		}
+		if status == btcPaid {
+			return true, nil
+		}
+
+		if status, err = b.refresh(context.Background(), orderID); err != nil {
+			// The chain backend may be briefly unreachable; ask again next tick
+			log.Printf("checking bitcoin payment for order %d: %v", orderID, err)
+			continue
+		}
+		if status == btcPaid {
+			return true, nil
+		}
+	}
+}
+
+// Cancel closes the deposit address of an order being expired, failing if
+// a transaction to it has been reported: that order is settled by Await.
+func (b *bitcoinProvider) Cancel(tx *sql.Tx, orderID int) error {
+	var status string
+	err := tx.QueryRow("SELECT status FROM bitcoin_payments WHERE order_id = $1 FOR UPDATE", orderID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if status != btcAwaitingPayment {
+		return errBitcoinPaymentSeen
+	}
+
+	_, err = tx.Exec(`
+		UPDATE bitcoin_payments SET status = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE order_id = $2`, btcExpired, orderID)
+	return err
+}
+
+// refresh asks the chain about the order's unconfirmed transactions and
+// settles it with what it learns.
+func (b *bitcoinProvider) refresh(ctx context.Context, orderID int) (string, error) {
+	var address string
+	err := b.db.QueryRow("SELECT address FROM bitcoin_payments WHERE order_id = $1", orderID).Scan(&address)
+	if err != nil {
+		return "", err
+	}
+
+	rows, err := b.db.Query(`
+		SELECT txid FROM bitcoin_transactions
+		WHERE order_id = $1 AND confirmations < $2`, orderID, b.confirmations)
+	if err != nil {
+		return "", err
+	}
+	var txids []string
+	for rows.Next() {
+		var txid string
+		if err := rows.Scan(&txid); err != nil {
+			rows.Close()
+			return "", err
+		}
+		txids = append(txids, txid)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	var updates []bitcoin.Payment
+	for _, txid := range txids {
+		p, err := b.chain.PaymentTo(ctx, txid, address)
+		if err != nil {
+			return "", err
+		}
+		updates = append(updates, p)
+	}
+
+	tx, err := b.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// Lock first, so the updates and settle see the same transactions
+	if _, err := lockBitcoinPayment(tx, orderID); err != nil {
+		return "", err
+	}
+	for _, p := range updates {
+		var before int
+		err := tx.QueryRow(`
+			UPDATE bitcoin_transactions t SET confirmations = $1, updated_at = CURRENT_TIMESTAMP
+			FROM bitcoin_transactions old
+			WHERE t.txid = $2 AND old.txid = t.txid
+			RETURNING old.confirmations`, p.Confirmations, p.TxID).Scan(&before)
+		if err != nil {
+			return "", err
+		}
+		if before < b.confirmations && p.Confirmed(b.confirmations) {
+			err := addOrderEvent(tx, orderID, "payment_confirmed", &p.Amount, p.TxID,
+				fmt.Sprintf("%d confirmations", p.Confirmations))
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	status, err := b.settle(tx, orderID, time.Now())
+	if err != nil {
+		return "", err
+	}
+	return status, tx.Commit()
+}
+
+// bitcoinPaymentRow is the locked state of an order's deposit address.
+type bitcoinPaymentRow struct {
+	userID      int
+	address     string
+	due         money.Money
+	status      string
+	orderStatus string
+	rate        string
+	topUpBy     sql.NullTime
+}
+
+// lockBitcoinPayment locks the order's bitcoin_payments row, so reported
+// transactions, settlement and expiry of one order happen one at a time.
+func lockBitcoinPayment(tx *sql.Tx, orderID int) (bitcoinPaymentRow, error) {
+	var p bitcoinPaymentRow
+	var due int64
+	err := tx.QueryRow(`
+		SELECT o.user_id, bp.address, bp.amount_due, bp.status, o.payment_status, o.exchange_rate, bp.top_up_by
+		FROM bitcoin_payments bp
+		JOIN orders o ON bp.order_id = o.id
+		WHERE bp.order_id = $1
+		FOR UPDATE OF bp`, orderID).Scan(
+		&p.userID, &p.address, &due, &p.status, &p.orderStatus, &p.rate, &p.topUpBy)
+	p.due = money.New(due, money.BTC)
+	return p, err
+}
+
+// bitcoinReceived sums the order's transactions and reports whether all of
+// them are confirmed.
+func bitcoinReceived(q queryer, orderID, required int) (money.Money, bool, error) {
+	var received int64
+	var unconfirmed int
+	err := q.QueryRow(`
+		SELECT COALESCE(SUM(amount), 0), COUNT(*) FILTER (WHERE confirmations < $2)
+		FROM bitcoin_transactions WHERE order_id = $1`, orderID, required).Scan(&received, &unconfirmed)
+	return money.New(received, money.BTC), unconfirmed == 0, err
+}
+
+// settle moves the order's payment along once the amounts and
+// confirmations allow: a short payment opens a top-up window, a full one
+// completes the payment and any excess goes to the buyer's wallet. An
+// order still short when its window closes is expired and what did arrive
+// is credited. Callers hold the row lock of lockBitcoinPayment.
+func (b *bitcoinProvider) settle(tx *sql.Tx, orderID int, now time.Time) (string, error) {
+	p, err := lockBitcoinPayment(tx, orderID)
+	if err != nil {
+		return "", err
+	}
+	if p.status == btcPaid || p.status == btcExpired {
+		return p.status, nil
+	}
+
+	received, confirmed, err := bitcoinReceived(tx, orderID, b.confirmations)
+	if err != nil {
+		return "", err
+	}
+
+	s := settlement.Evaluate(p.due, received)
+	status := btcPaid
+	switch {
+	case s.Outcome == settlement.Unpaid:
+		status = btcAwaitingPayment
+	case !s.Settled():
+		status = btcUnderpaid
+	case !confirmed:
+		status = btcConfirming
+	}
+
+	switch {
+	case status == btcUnderpaid && !p.topUpBy.Valid:
+		deadline := now.Add(b.topUpWindow)
+		_, err = tx.Exec("UPDATE bitcoin_payments SET top_up_by = $1 WHERE order_id = $2", deadline, orderID)
+		if err != nil {
+			return "", err
+		}
+		err = addOrderEvent(tx, orderID, "underpaid", &s.Shortfall, "",
+			fmt.Sprintf("received %s of %s, %s more due by %s",
+				s.Received.Format(), s.Due.Format(), s.Shortfall.Format(), deadline.Format(time.RFC3339)))
+		if err != nil {
+			return "", err
+		}
+
+	case status == btcUnderpaid && now.After(p.topUpBy.Time) && confirmed:
+		// Only confirmed coins are credited back, so wait for all of them
+		status = btcExpired
+		err = addOrderEvent(tx, orderID, "expired", &s.Shortfall, "", "top-up window closed, order cancelled")
+		if err != nil {
+			return "", err
+		}
+		if _, err := b.credit(tx, orderID, p, s.Received, "Bitcoin payment for cancelled order"); err != nil {
+			return "", err
+		}
+		_, err = tx.Exec(`
+			UPDATE orders SET payment_status = 'expired', expired_at = CURRENT_TIMESTAMP
+			WHERE id = $1 AND payment_status = 'pending'`, orderID)
+		if err != nil {
+			return "", err
+		}
+		if err := releaseOrderReservations(tx, orderID); err != nil {
+			return "", err
+		}
+
+	case status == btcPaid:
+		if err := addOrderEvent(tx, orderID, "paid", &s.Received, "", "order paid in full"); err != nil {
+			return "", err
+		}
+		if s.Outcome == settlement.Overpaid {
+			err = addOrderEvent(tx, orderID, "overpaid", &s.Excess, "",
+				fmt.Sprintf("received %s, %s more than due", s.Received.Format(), s.Excess.Format()))
+			if err != nil {
+				return "", err
+			}
+			if _, err := b.credit(tx, orderID, p, s.Excess, "Bitcoin overpayment"); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if status != p.status {
+		_, err = tx.Exec(`
+			UPDATE bitcoin_payments SET status = $1, updated_at = CURRENT_TIMESTAMP
+			WHERE order_id = $2`, status, orderID)
+		if err != nil {
+			return "", err
+		}
+	}
+	return status, nil
+}
+
+// credit converts amount back to money.Base at the order's own rate and
+// posts it to the buyer's wallet through the ledger.
+func (b *bitcoinProvider) credit(tx *sql.Tx, orderID int, p bitcoinPaymentRow, amount money.Money, what string) (money.Money, error) {
+	rate, ok := new(big.Rat).SetString(p.rate)
+	if !ok || rate.Sign() <= 0 {
+		return money.Money{}, fmt.Errorf("order %d has invalid exchange rate %q", orderID, p.rate)
+	}
+	credited := amount.Convert(money.Base, new(big.Rat).Inv(rate))
+	if !credited.IsPositive() {
+		// Less than a kopeck; nothing the wallet can hold
+		return credited, nil
+	}
+
+	_, err := ledger.TopUp(tx, p.userID, credited,
+		fmt.Sprintf("%s #%d", what, orderID), fmt.Sprintf("bitcoin:order:%d", orderID))
+	if err != nil {
+		return money.Money{}, err
+	}
+	// An overpayment may be credited before the rest of the payment is
+	_, err = tx.Exec(`
+		UPDATE bitcoin_payments SET credited = COALESCE(credited, 0) + $1
+		WHERE order_id = $2`, credited, orderID)
+	if err != nil {
+		return money.Money{}, err
+	}
+	err = addOrderEvent(tx, orderID, "balance_credited", &credited, "",
+		fmt.Sprintf("%s credited to balance as %s", amount.Format(), credited.Format()))
+	return credited, err
+}
+
+// returnPayment credits the buyer's wallet with what a paid order cost when
+// its keys went to another order before the coins confirmed. An
+// overpayment was credited when the order was paid, so only what was due
+// is left.
+func (b *bitcoinProvider) returnPayment(tx *sql.Tx, orderID int) (money.Money, error) {
+	p, err := lockBitcoinPayment(tx, orderID)
+	if err != nil {
+		return money.Money{}, err
+	}
+	if p.status != btcPaid {
+		return money.Money{}, fmt.Errorf("order %d is %s, not paid", orderID, p.status)
+	}
+	return b.credit(tx, orderID, p, p.due, "Bitcoin payment for unfulfilled order")
+}
+
+// BitcoinPayment is what the payment page and the API show for an order
+// paid in BTC. Settlement amounts are in BTC, Credited in money.Base.
+type BitcoinPayment struct {
+	Address               string            `json:"bitcoin_address"`
+	Status                string            `json:"status"`
+	Message               string            `json:"message"`
+	Settlement            settlement.Result `json:"settlement"`
+	RequiredConfirmations int               `json:"required_confirmations"`
+	Transactions          []bitcoin.Payment `json:"transactions"`
+	TopUpBy               *time.Time        `json:"top_up_by,omitempty"`
+	Credited              *money.Money      `json:"credited,omitempty"`
+	Timeline              []OrderEvent      `json:"timeline"`
+}
+
+func (b *bitcoinProvider) payment(q queryer, orderID int) (*BitcoinPayment, error) {
+	var p BitcoinPayment
+	var due int64
+	var topUpBy sql.NullTime
+	var credited money.NullMoney
+	err := q.QueryRow(`
+		SELECT address, amount_due, status, top_up_by, credited FROM bitcoin_payments WHERE order_id = $1`,
+		orderID).Scan(&p.Address, &due, &p.Status, &topUpBy, &credited)
+	if err != nil {
+		return nil, err
+	}
+	p.RequiredConfirmations = b.confirmations
+	if topUpBy.Valid {
+		p.TopUpBy = &topUpBy.Time
+	}
+	if credited.Valid {
+		p.Credited = &credited.Money
+	}
+
+	rows, err := q.Query(`
+		SELECT txid, amount, confirmations FROM bitcoin_transactions
+		WHERE order_id = $1
+		ORDER BY created_at, txid`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	received := money.Zero(money.BTC)
+	for rows.Next() {
+		var t bitcoin.Payment
+		var amount int64
+		if err := rows.Scan(&t.TxID, &amount, &t.Confirmations); err != nil {
+			return nil, err
+		}
+		t.Address = p.Address
+		t.Amount = money.New(amount, money.BTC)
+		received = received.Add(t.Amount)
+		p.Transactions = append(p.Transactions, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	p.Settlement = settlement.Evaluate(money.New(due, money.BTC), received)
+	p.Message = p.message()
+
+	p.Timeline, err = getOrderEvents(q, orderID)
+	return &p, err
+}
+
+// message tells the buyer where the payment stands, with exact amounts.
+func (p *BitcoinPayment) message() string {
+	s := p.Settlement
+	switch p.Status {
+	case btcUnderpaid:
+		return fmt.Sprintf("received %s of %s; send the remaining %s to %s by %s",
+			s.Received.Format(), s.Due.Format(), s.Shortfall.Format(), p.Address, p.TopUpBy.Format(time.RFC3339))
+	case btcConfirming:
+		return fmt.Sprintf("payment seen, waiting for %d confirmations", p.RequiredConfirmations)
+	case btcPaid:
+		if s.Outcome == settlement.Overpaid && p.Credited != nil {
+			return fmt.Sprintf("payment confirmed; overpayment of %s credited to balance as %s",
+				s.Excess.Format(), p.Credited.Format())
+		}
+		return "payment confirmed"
+	case btcExpired:
+		if p.Credited != nil {
+			return fmt.Sprintf("top-up window closed; %s credited to balance as %s",
+				s.Received.Format(), p.Credited.Format())
+		}
+		return "order expired unpaid"
+	}
+	return fmt.Sprintf("send %s to %s", s.Due.Format(), p.Address)
+}
+
+func (h *OrderHandler) bitcoin() (*bitcoinProvider, bool) {
+	b, ok := h.providers[bitcoinPaymentMethod].(*bitcoinProvider)
+	return b, ok
+}
+
+// validTxID accepts the 64 hex digits of a transaction ID.
+func validTxID(txid string) bool {
+	if len(txid) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(txid)
+	return err == nil
+}
+
+// SubmitBitcoinPayment attaches a transaction to the user's order. The
+// amount and the number of confirmations come from the chain; the order
+// stays pending until its transactions are buried deep enough and
+// together cover the amount due. JSON body: {"txid": "..."}.
+func (h *OrderHandler) SubmitBitcoinPayment(w http.ResponseWriter, r *http.Request) {
+	h.idempotent(w, r, h.submitBitcoinPayment)
+}
+
+func (h *OrderHandler) submitBitcoinPayment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	b, ok := h.bitcoin()
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		TxID string `json:"txid"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	txid := strings.ToLower(strings.TrimSpace(req.TxID))
+	if !validTxID(txid) {
+		http.Error(w, "Invalid transaction ID", http.StatusBadRequest)
+		return
+	}
+
+	var orderID int
+	var address string
+	err := h.db.QueryRow(`
+		SELECT o.id, bp.address
+		FROM orders o
+		JOIN bitcoin_payments bp ON bp.order_id = o.id
+		WHERE o.public_id = $1 AND o.user_id = $2`, mux.Vars(r)["orderId"], user.ID).Scan(&orderID, &address)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	payment, err := b.chain.PaymentTo(r.Context(), txid, address)
+	switch {
+	case errors.Is(err, bitcoin.ErrTxNotFound):
+		http.Error(w, "Transaction not found", http.StatusNotFound)
+		return
+	case errors.Is(err, bitcoin.ErrNoOutput):
+		http.Error(w, "Transaction does not pay the order's deposit address", http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		log.Printf("verifying tx %s for order %d: %v", txid, orderID, err)
+		http.Error(w, "Payment verification unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	status, err := b.record(orderID, payment)
+	switch {
+	case errors.Is(err, errBitcoinTxUsed):
+		http.Error(w, "Transaction already used for another order", http.StatusConflict)
+		return
+	case errors.Is(err, errOrderClosed):
+		http.Error(w, "Order is no longer awaiting payment", http.StatusConflict)
+		return
+	case errors.Is(err, errTopUpClosed):
+		http.Error(w, "Top-up window for this order has closed", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Failed to record payment", http.StatusInternalServerError)
+		return
+	}
+
+	view, err := b.payment(h.db, orderID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	code := http.StatusAccepted
+	if status == btcPaid {
+		code = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(view)
+}
+
+// record stores a verified transaction for the order and settles it. A
+// txid reported for another order before is refused.
+func (b *bitcoinProvider) record(orderID int, p bitcoin.Payment) (string, error) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	row, err := lockBitcoinPayment(tx, orderID)
+	if err != nil {
+		return "", err
+	}
+
+	if row.orderStatus != "pending" || row.status == btcPaid || row.status == btcExpired {
+		return row.status, errOrderClosed
+	}
+
+	now := time.Now()
+	var owner, before int
+	err = tx.QueryRow("SELECT order_id, confirmations FROM bitcoin_transactions WHERE txid = $1", p.TxID).Scan(&owner, &before)
+	switch {
+	case err == sql.ErrNoRows:
+		if row.topUpBy.Valid && now.After(row.topUpBy.Time) {
+			return row.status, errTopUpClosed
+		}
+		res, err := tx.Exec(`
+			INSERT INTO bitcoin_transactions (txid, order_id, amount, confirmations)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (txid) DO NOTHING`, p.TxID, orderID, p.Amount.Minor(), p.Confirmations)
+		if err != nil {
+			return "", err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			// Reported for another order at the same moment
+			return "", errBitcoinTxUsed
+		}
+		err = addOrderEvent(tx, orderID, "payment_seen", &p.Amount, p.TxID, fmt.Sprintf("%d confirmations", p.Confirmations))
+		if err != nil {
+			return "", err
+		}
+	case err != nil:
+		return "", err
+	case owner != orderID:
+		return "", errBitcoinTxUsed
+	default:
+		_, err = tx.Exec(`
+			UPDATE bitcoin_transactions SET confirmations = $1, updated_at = CURRENT_TIMESTAMP
+			WHERE txid = $2`, p.Confirmations, p.TxID)
+		if err != nil {
+			return "", err
+		}
+	}
+	if before < b.confirmations && p.Confirmed(b.confirmations) {
+		err = addOrderEvent(tx, orderID, "payment_confirmed", &p.Amount, p.TxID, fmt.Sprintf("%d confirmations", p.Confirmations))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	status, err := b.settle(tx, orderID, now)
+	if err != nil {
+		return "", err
+	}
+	return status, tx.Commit()
+}
+
+// SimulateBitcoinPayment drives the fake chain, for admins testing the
+// flow. It is only there when BTC_FAKE_CHAIN=1. JSON body:
+// {"amount": "0.00123"} sends a transaction to the order's deposit address
+// and {"blocks": 2} mines blocks; both may be combined.
+func (h *OrderHandler) SimulateBitcoinPayment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	admin, ok := currentUser(r)
+	if !ok || !can(h.db, admin, rbac.PermPaymentsSimulate) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	b, ok := h.bitcoin()
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	chain, ok := b.chain.(*bitcoin.FakeChain)
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Amount json.Number `json:"amount"`
+		Blocks int         `json:"blocks"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Blocks < 0 {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	var address string
+	err := h.db.QueryRow(`
+		SELECT bp.address
+		FROM bitcoin_payments bp
+		JOIN orders o ON bp.order_id = o.id
+		WHERE o.public_id = $1`, mux.Vars(r)["orderId"]).Scan(&address)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{"bitcoin_address": address}
+	if req.Amount != "" {
+		amount, err := money.Parse(req.Amount.String(), money.BTC)
+		if err != nil || !amount.IsPositive() {
+			http.Error(w, "Invalid amount", http.StatusBadRequest)
+			return
+		}
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			http.Error(w, "Failed to create transaction", http.StatusInternalServerError)
+			return
+		}
+		txid := hex.EncodeToString(b)
+		chain.Send(txid, address, amount)
+		resp["txid"] = txid
+		resp["amount"] = amount
+	}
+	if req.Blocks > 0 {
+		chain.Mine(req.Blocks)
+		resp["blocks"] = req.Blocks
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
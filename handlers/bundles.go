@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"license_keys_shop/internal/models"
+	"license_keys_shop/internal/rbac"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// soldExpr is true for products p that can't be bought: sold themselves or,
+// for a bundle, with at least one sold component.
+const soldExpr = `(p.is_sold OR EXISTS (
+		SELECT 1 FROM bundle_components bc
+		JOIN products cp ON bc.component_id = cp.id
+		WHERE bc.bundle_id = p.id AND cp.is_sold))`
+
+var errKeyUnavailable = errors.New("license key is no longer available")
+
+func getBundleComponents(q queryer, bundleID int) []models.CatalogProduct {
+	rows, err := q.Query(`
+		SELECT p.id, p.title, p.description, p.price, p.image_url, p.is_sold
+		FROM bundle_components bc
+		JOIN products p ON bc.component_id = p.id
+		WHERE bc.bundle_id = $1
+		ORDER BY bc.position, p.id`, bundleID)
+	if err != nil {
+		return []models.CatalogProduct{}
+	}
+	defer rows.Close()
+
+	var components []models.CatalogProduct
+	for rows.Next() {
+		var p models.CatalogProduct
+		if err := rows.Scan(&p.ID, &p.Title, &p.Description, &p.Price, &p.ImageURL, &p.IsSold); err != nil {
+			continue
+		}
+		components = append(components, p)
+	}
+	return components
+}
+
+// assignOrderKeys delivers one key per order line, or one key per component
+// for bundle lines, marking every source product sold. It runs inside the
+// caller's transaction so an order gets all of its keys or none of them.
+func assignOrderKeys(tx *sql.Tx, orderID int) error {
+	rows, err := tx.Query(`
+		SELECT oi.id, oi.product_id, p.is_bundle
+		FROM order_items oi
+		JOIN products p ON oi.product_id = p.id
+		WHERE oi.order_id = $1
+		ORDER BY oi.id`, orderID)
+	if err != nil {
+		return err
+	}
+
+	type line struct {
+		itemID    int
+		productID int
+		isBundle  bool
+	}
+	var lines []line
+	for rows.Next() {
+		var l line
+		if err := rows.Scan(&l.itemID, &l.productID, &l.isBundle); err != nil {
+			rows.Close()
+			return err
+		}
+		lines = append(lines, l)
+	}
+	rows.Close()
+
+	for _, l := range lines {
+		sources := []int{l.productID}
+		if l.isBundle {
+			sources = sources[:0]
+			for _, c := range getBundleComponents(tx, l.productID) {
+				sources = append(sources, c.ID)
+			}
+			if len(sources) == 0 {
+				return errKeyUnavailable
+			}
+		}
+		// Lock in id order so concurrent orders sharing products can't deadlock
+		sort.Ints(sources)
+
+		for _, productID := range sources {
+			var licenseKey sql.NullString
+			var isSold bool
+			err := tx.QueryRow(`
+				SELECT license_key, is_sold FROM products WHERE id = $1 FOR UPDATE`,
+				productID).Scan(&licenseKey, &isSold)
+			if err != nil {
+				return err
+			}
+			if isSold || !licenseKey.Valid || licenseKey.String == "" {
+				return errKeyUnavailable
+			}
+
+			if _, err := tx.Exec("UPDATE products SET is_sold = TRUE WHERE id = $1", productID); err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(`
+				INSERT INTO order_item_keys (order_item_id, product_id, license_key)
+				VALUES ($1, $2, $3)`, l.itemID, productID, licenseKey.String)
+			if err != nil {
+				return err
+			}
+		}
+
+		if l.isBundle {
+			if _, err := tx.Exec("UPDATE products SET is_sold = TRUE WHERE id = $1", l.productID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SetBundleComponents turns a product into a bundle of the given products,
+// or back into a regular product when the list is empty.
+func (h *ProductHandler) SetBundleComponents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok || !can(h.db, user, rbac.PermProductsManage) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	vars := mux.Vars(r)
+	bundleID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		ComponentIDs []int `json:"component_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var usedAsComponent bool
+	err = tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM bundle_components WHERE component_id = $1)
+		FROM products WHERE id = $1`, bundleID).Scan(&usedAsComponent)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if usedAsComponent && len(req.ComponentIDs) > 0 {
+		http.Error(w, "Product is a component of another bundle", http.StatusConflict)
+		return
+	}
+
+	seen := make(map[int]bool)
+	for _, componentID := range req.ComponentIDs {
+		if componentID == bundleID || seen[componentID] {
+			http.Error(w, "Invalid component list", http.StatusBadRequest)
+			return
+		}
+		seen[componentID] = true
+
+		// Bundles can't be nested: a component must hold its own key
+		var isBundle bool
+		err := tx.QueryRow("SELECT is_bundle FROM products WHERE id = $1", componentID).Scan(&isBundle)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Component product not found", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if isBundle {
+			http.Error(w, "A bundle can't contain another bundle", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM bundle_components WHERE bundle_id = $1", bundleID); err != nil {
+		http.Error(w, "Failed to update bundle", http.StatusInternalServerError)
+		return
+	}
+
+	for i, componentID := range req.ComponentIDs {
+		_, err := tx.Exec(`
+			INSERT INTO bundle_components (bundle_id, component_id, position)
+			VALUES ($1, $2, $3)`, bundleID, componentID, i)
+		if err != nil {
+			http.Error(w, "Failed to update bundle", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE products SET is_bundle = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2`, len(req.ComponentIDs) > 0, bundleID)
+	if err != nil {
+		http.Error(w, "Failed to update bundle", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update bundle", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":         bundleID,
+		"is_bundle":  len(req.ComponentIDs) > 0,
+		"components": getBundleComponents(h.db, bundleID),
+	})
+}
@@ -0,0 +1,369 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"license_keys_shop/internal/idempotency"
+	"license_keys_shop/internal/ids"
+	"license_keys_shop/internal/models"
+	"license_keys_shop/internal/money"
+	"license_keys_shop/internal/promo"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// AddToCart puts a product into the user's cart. cart_items is the shop's
+// only cart and Checkout turns it into one order. Every product row is a
+// single license key, so a product is in the cart at most once and adding
+// it again changes nothing.
+func (h *OrderHandler) AddToCart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	productID, err := strconv.Atoi(vars["productId"])
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	if q := r.FormValue("quantity"); q != "" && q != "1" {
+		http.Error(w, "Quantity must be 1: each product is a single license key", http.StatusBadRequest)
+		return
+	}
+
+	var isSold bool
+	err = h.db.QueryRow("SELECT "+soldExpr+" FROM products p WHERE p.id = $1", productID).Scan(&isSold)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if isSold {
+		http.Error(w, "Product already sold", http.StatusConflict)
+		return
+	}
+
+	_, err = h.db.Exec(`
+		INSERT INTO cart_items (user_id, product_id, quantity)
+		VALUES ($1, $2, 1)
+		ON CONFLICT (user_id, product_id) DO NOTHING`,
+		user.ID, productID)
+	if err != nil {
+		http.Error(w, "Failed to add item to cart", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Header.Get("Accept") == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.getCartItems(user.ID))
+		return
+	}
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+func (h *OrderHandler) RemoveFromCart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	productID, err := strconv.Atoi(vars["productId"])
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	_, err = h.db.Exec("DELETE FROM cart_items WHERE user_id = $1 AND product_id = $2", user.ID, productID)
+	if err != nil {
+		http.Error(w, "Failed to remove item from cart", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Header.Get("Accept") == "application/json" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+// Checkout converts the user's whole cart into a single order with one
+// line item per cart entry and starts a single payment for it. Retries
+// with the same Idempotency-Key get the first order back.
+func (h *OrderHandler) Checkout(w http.ResponseWriter, r *http.Request) {
+	h.idempotent(w, r, h.checkout)
+}
+
+func (h *OrderHandler) checkout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !h.verifiedBuyer(w, user.ID) {
+		return
+	}
+
+	paymentMethod := r.FormValue("payment_method")
+	if paymentMethod == "" {
+		paymentMethod = "mir" // default
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the products so two checkouts can't sell the same key
+	rows, err := tx.Query(`
+		SELECT ci.product_id, ci.quantity, p.title, `+effectivePrice+`, p.price, p.category_id, `+soldExpr+`
+		FROM cart_items ci
+		JOIN products p ON ci.product_id = p.id`+activeSaleJoin+`
+		WHERE ci.user_id = $1
+		ORDER BY ci.id
+		FOR UPDATE OF p`, user.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	var items []models.OrderItem
+	var listPrices []money.Money
+	var lines []promo.Line
+	for rows.Next() {
+		var item models.OrderItem
+		var product models.CatalogProduct
+		var listPrice money.Money
+		var categoryID sql.NullInt64
+		if err := rows.Scan(&item.ProductID, &item.Quantity, &product.Title,
+			&item.UnitPrice, &listPrice, &categoryID, &product.IsSold); err != nil {
+			rows.Close()
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		product.ID = item.ProductID
+		product.Price = item.UnitPrice
+		item.Product = &product
+		items = append(items, item)
+		listPrices = append(listPrices, listPrice)
+		lines = append(lines, promoLine(item.ProductID, categoryID, item.UnitPrice, item.Quantity))
+	}
+	rows.Close()
+
+	if len(items) == 0 {
+		http.Error(w, "Cart is empty", http.StatusBadRequest)
+		return
+	}
+
+	for _, item := range items {
+		if item.Product.IsSold {
+			http.Error(w, fmt.Sprintf("Product %q already sold", item.Product.Title), http.StatusConflict)
+			return
+		}
+		// Each product row holds exactly one license key
+		if item.Quantity > 1 {
+			http.Error(w, fmt.Sprintf("Only one key available for %q", item.Product.Title), http.StatusConflict)
+			return
+		}
+	}
+
+	codes, err := loadCartPromoCodes(tx, user.ID, true)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	breakdown, err := priceWithPromoCodes(tx, user.ID, lines, codes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	currency, ok := orderCurrency(r, tx)
+	if !ok {
+		http.Error(w, "Unsupported currency", http.StatusBadRequest)
+		return
+	}
+	if c, ok := fixedCurrency(paymentMethod); ok {
+		currency = c
+	}
+
+	charged, rate, err := chargeAmount(h.rates, breakdown.Total, currency)
+	if err != nil {
+		http.Error(w, "Exchange rate unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	transactionID := ids.WithPrefix("txn")
+	publicID := ids.New()
+
+	var promoCode sql.NullString
+	if len(codes) > 0 {
+		promoCode = sql.NullString{String: promoCodeList(codes), Valid: true}
+	}
+
+	var orderID int
+	err = tx.QueryRow(`
+		INSERT INTO orders (user_id, subtotal_amount, discount_amount, total_amount, promo_code,
+		                    currency, charged_amount, exchange_rate,
+		                    payment_method, transaction_id, public_id, payment_status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, 'pending') RETURNING id`,
+		user.ID, breakdown.Subtotal, breakdown.Discount, breakdown.Total, promoCode,
+		string(currency), charged, rate.String(),
+		paymentMethod, transactionID, publicID).Scan(&orderID)
+	if err != nil {
+		http.Error(w, "Failed to create order", http.StatusInternalServerError)
+		return
+	}
+
+	for i, item := range items {
+		_, err = tx.Exec(`
+			INSERT INTO order_items (order_id, product_id, unit_price, list_price, quantity)
+			VALUES ($1, $2, $3, $4, $5)`,
+			orderID, item.ProductID, item.UnitPrice, listPrices[i], item.Quantity)
+		if err != nil {
+			http.Error(w, "Failed to create order", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	for i, c := range codes {
+		_, err = tx.Exec(`
+			INSERT INTO promo_redemptions (promo_code_id, user_id, order_id, discount_amount)
+			VALUES ($1, $2, $3, $4)`,
+			c.ID, user.ID, orderID, breakdown.Discounts[i].Amount)
+		if err != nil {
+			http.Error(w, "Failed to create order", http.StatusInternalServerError)
+			return
+		}
+
+		_, err = tx.Exec("UPDATE promo_codes SET used_count = used_count + 1 WHERE id = $1", c.ID)
+		if err != nil {
+			http.Error(w, "Failed to create order", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if _, err = tx.Exec("DELETE FROM cart_items WHERE user_id = $1", user.ID); err != nil {
+		http.Error(w, "Failed to create order", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err = tx.Exec("DELETE FROM cart_promo_codes WHERE user_id = $1", user.ID); err != nil {
+		http.Error(w, "Failed to create order", http.StatusInternalServerError)
+		return
+	}
+
+	settled, err := h.chargeOrder(tx, paymentMethod, PaymentIntent{OrderID: orderID, UserID: user.ID, Amount: breakdown.Total})
+	if err != nil {
+		writeChargeError(w, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to create order", http.StatusInternalServerError)
+		return
+	}
+
+	status, message := "completed", "Order paid from balance"
+	if !settled {
+		go h.processPayment(orderID, paymentMethod)
+		status, message = "pending", "Order created, processing payment..."
+	}
+
+	if r.Header.Get("Accept") == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"order_id":       orderID,
+			"order_ref":      publicID,
+			"transaction_id": transactionID,
+			"subtotal":       breakdown.Subtotal,
+			"discounts":      breakdown.Discounts,
+			"total_amount":   breakdown.Total,
+			"currency":       currency,
+			"charged_amount": charged,
+			"exchange_rate":  rate.String(),
+			"promo_code":     promoCode.String,
+			"items":          items,
+			"status":         status,
+			"message":        message,
+		})
+		return
+	}
+
+	http.Redirect(w, r, "/payment/"+publicID, http.StatusSeeOther)
+}
+
+// idempotent runs next once per user and Idempotency-Key and replays its
+// response to retries, so a double click or a client retry can't create
+// or pay for a second order.
+func (h *OrderHandler) idempotent(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	user, ok := currentUser(r)
+	if !ok {
+		next(w, r)
+		return
+	}
+	idempotency.Handle(h.idempotency, fmt.Sprintf("user:%d", user.ID), w, r, next)
+}
+
+func (h *OrderHandler) getCartItems(userID int) []models.CartItem {
+	rows, err := h.db.Query(`
+		SELECT ci.id, ci.user_id, ci.product_id, ci.quantity, ci.created_at,
+		       p.title, p.description, `+effectivePrice+`, COALESCE(p.category_id, 0), p.image_url, `+soldExpr+`
+		FROM cart_items ci
+		JOIN products p ON ci.product_id = p.id`+activeSaleJoin+`
+		WHERE ci.user_id = $1
+		ORDER BY ci.id`, userID)
+	if err != nil {
+		return []models.CartItem{}
+	}
+	defer rows.Close()
+
+	var items []models.CartItem
+	for rows.Next() {
+		var item models.CartItem
+		var product models.CatalogProduct
+		err := rows.Scan(&item.ID, &item.UserID, &item.ProductID, &item.Quantity, &item.CreatedAt,
+			&product.Title, &product.Description, &item.UnitPrice, &product.CategoryID,
+			&product.ImageURL, &product.IsSold)
+		if err != nil {
+			continue
+		}
+		product.ID = item.ProductID
+		product.Price = item.UnitPrice
+		item.Product = &product
+		items = append(items, item)
+	}
+	return items
+}
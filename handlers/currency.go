@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"license_keys_shop/internal/models"
+	"license_keys_shop/internal/money"
+	"license_keys_shop/internal/rates"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const currencyCookie = "currency"
+
+// requestCurrency picks the display currency: ?currency= first, then the
+// currency cookie, then the logged-in user's preference, then money.Base.
+func requestCurrency(r *http.Request, q queryer) money.Currency {
+	if c, ok := money.ParseCurrency(r.URL.Query().Get("currency")); ok {
+		return c
+	}
+
+	if cookie, err := r.Cookie(currencyCookie); err == nil {
+		if c, ok := money.ParseCurrency(cookie.Value); ok {
+			return c
+		}
+	}
+
+	if user, ok := currentUser(r); ok {
+		var preferred sql.NullString
+		err := q.QueryRow("SELECT preferred_currency FROM users WHERE id = $1", user.ID).Scan(&preferred)
+		if err == nil && preferred.Valid {
+			if c, ok := money.ParseCurrency(preferred.String); ok {
+				return c
+			}
+		}
+	}
+
+	return money.Base
+}
+
+// displayPrice converts a base price for display. It returns nil when no
+// conversion is needed or no rate is available, so the base price is shown.
+func displayPrice(provider rates.ExchangeRateProvider, m money.Money, to money.Currency) *models.Price {
+	if provider == nil || to == m.Currency() {
+		return nil
+	}
+	rate, err := provider.Rate(m.Currency(), to)
+	if err != nil {
+		return nil
+	}
+	return models.NewPrice(rate.Convert(m))
+}
+
+func setCatalogCurrency(provider rates.ExchangeRateProvider, p *models.CatalogProduct, to money.Currency) {
+	p.Currency = money.Base
+	p.DisplayPrice = displayPrice(provider, p.Price, to)
+}
+
+// orderCurrency is the currency the buyer pays an order in: the
+// payment_currency form value if given, otherwise the display currency.
+func orderCurrency(r *http.Request, q queryer) (money.Currency, bool) {
+	if code := r.FormValue("payment_currency"); code != "" {
+		return money.ParseCurrency(code)
+	}
+	return requestCurrency(r, q), true
+}
+
+// chargeAmount converts a base-currency total into the payment currency and
+// returns the rate used, which the order stores next to both amounts.
+func chargeAmount(provider rates.ExchangeRateProvider, total money.Money, currency money.Currency) (money.Money, rates.Rate, error) {
+	rate, err := provider.Rate(total.Currency(), currency)
+	if err != nil {
+		return money.Money{}, rates.Rate{}, err
+	}
+	return rate.Convert(total), rate, nil
+}
+
+// scanCharged rebuilds an order's charged amount from its stored decimal
+// and currency; Money.Scan alone would assume money.Base precision.
+func scanCharged(amount, currency string) money.Money {
+	c, ok := money.ParseCurrency(currency)
+	if !ok {
+		c = money.Base
+	}
+	m, err := money.Parse(amount, c)
+	if err != nil {
+		return money.Zero(c)
+	}
+	return m
+}
+
+// SetCurrency stores the display currency in a cookie and, for logged-in
+// users, as their preference.
+func (h *HomeHandler) SetCurrency(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	currency, ok := money.ParseCurrency(r.FormValue("currency"))
+	if !ok {
+		http.Error(w, "Unsupported currency", http.StatusBadRequest)
+		return
+	}
+
+	if currency != money.Base {
+		if _, err := h.rates.Rate(money.Base, currency); err != nil {
+			http.Error(w, "No exchange rate for currency", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:    currencyCookie,
+		Value:   string(currency),
+		Expires: time.Now().Add(365 * 24 * time.Hour),
+		Path:    "/",
+	})
+
+	if user, ok := currentUser(r); ok {
+		_, err := h.db.Exec("UPDATE users SET preferred_currency = $1 WHERE id = $2", string(currency), user.ID)
+		if err != nil {
+			http.Error(w, "Failed to save currency", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if r.Header.Get("Accept") == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"currency": currency,
+		})
+		return
+	}
+
+	// Only go back to a page on this site
+	redirect := "/"
+	if ref, err := url.Parse(r.Referer()); err == nil && ref.Path != "" {
+		redirect = localPath(ref.RequestURI())
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
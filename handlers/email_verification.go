@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"license_keys_shop/internal/mail"
+	"license_keys_shop/internal/verification"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	verificationTTL = 48 * time.Hour
+	// verificationResendInterval is how often a user may ask for the
+	// email again.
+	verificationResendInterval = 2 * time.Minute
+)
+
+// requireVerifiedEmail reads REQUIRE_VERIFIED_EMAIL; buying keys needs a
+// verified address unless it is set to false.
+func requireVerifiedEmail() bool {
+	if v, err := strconv.ParseBool(os.Getenv("REQUIRE_VERIFIED_EMAIL")); err == nil {
+		return v
+	}
+	return true
+}
+
+// sendVerification emails userID a link to confirm email.
+func (h *AuthHandler) sendVerification(userID int, username, email string) error {
+	token := h.verifier.Token(userID, email, time.Now().Add(verificationTTL))
+	link := appURL() + "/verify-email?token=" + url.QueryEscape(token)
+
+	_, err := h.db.Exec(
+		"UPDATE users SET verification_sent_at = CURRENT_TIMESTAMP WHERE id = $1", userID)
+	if err != nil {
+		return err
+	}
+
+	return h.mailer.Send(context.Background(), mail.Message{
+		To:      email,
+		Subject: "Подтвердите email",
+		Body: fmt.Sprintf("Здравствуйте, %s!\n\n"+
+			"Подтвердите адрес, чтобы покупать ключи:\n%s\n\n"+
+			"Ссылка действует %d часов.",
+			username, link, int(verificationTTL.Hours())),
+	})
+}
+
+// VerifyEmail confirms the address a link from sendVerification was sent
+// to. Opening the link again does no harm.
+func (h *AuthHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = r.FormValue("token")
+	}
+
+	userID, err := h.verifier.UserID(token)
+	if err == nil {
+		var email string
+		err = h.db.QueryRow("SELECT email FROM users WHERE id = $1", userID).Scan(&email)
+		if err == sql.ErrNoRows {
+			err = verification.ErrInvalidToken
+		}
+		if err == nil {
+			_, err = h.verifier.Verify(token, email, time.Now())
+		}
+	}
+
+	status, message := http.StatusOK, "Email verified"
+	switch {
+	case errors.Is(err, verification.ErrExpiredToken):
+		status, message = http.StatusGone, "Verification link expired, request a new one"
+	case errors.Is(err, verification.ErrInvalidToken):
+		status, message = http.StatusBadRequest, "Invalid verification link"
+	case err != nil:
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	default:
+		_, err = h.db.Exec(`
+			UPDATE users SET is_verified = TRUE, verified_at = COALESCE(verified_at, CURRENT_TIMESTAMP)
+			WHERE id = $1`, userID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if r.Header.Get("Accept") == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"verified": status == http.StatusOK,
+			"message":  message,
+		})
+		return
+	}
+
+	w.WriteHeader(status)
+	data := map[string]interface{}{
+		"Title":    "Подтверждение email",
+		"Verified": status == http.StatusOK,
+		"Message":  message,
+	}
+	h.templates.ExecuteTemplate(w, "verify_email.html", data)
+}
+
+// ResendVerification sends the verification email again, at most once per
+// verificationResendInterval.
+func (h *AuthHandler) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Claim the send slot atomically so parallel requests can't both send
+	var username, email string
+	err := h.db.QueryRow(`
+		UPDATE users SET verification_sent_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND NOT is_verified
+		  AND (verification_sent_at IS NULL
+		       OR verification_sent_at < CURRENT_TIMESTAMP - $2 * INTERVAL '1 second')
+		RETURNING username, email`,
+		user.ID, int(verificationResendInterval.Seconds())).Scan(&username, &email)
+	if err == sql.ErrNoRows {
+		var verified bool
+		if err := h.db.QueryRow("SELECT is_verified FROM users WHERE id = $1", user.ID).Scan(&verified); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if verified {
+			http.Error(w, "Email is already verified", http.StatusConflict)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(verificationResendInterval.Seconds())))
+		http.Error(w, "Verification email was sent recently, try again later", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.sendVerification(user.ID, username, email); err != nil {
+		log.Printf("sending verification to user %d: %v", user.ID, err)
+		http.Error(w, "Failed to send email", http.StatusBadGateway)
+		return
+	}
+
+	if r.Header.Get("Accept") == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Verification email sent",
+		})
+		return
+	}
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
+
+// verifiedBuyer answers 403 and returns false when purchases need a
+// verified email and userID's isn't.
+func (h *OrderHandler) verifiedBuyer(w http.ResponseWriter, userID int) bool {
+	if !h.requireVerified {
+		return true
+	}
+	var verified bool
+	if err := h.db.QueryRow("SELECT is_verified FROM users WHERE id = $1", userID).Scan(&verified); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	if !verified {
+		http.Error(w, "Verify your email address before buying", http.StatusForbidden)
+		return false
+	}
+	return true
+}
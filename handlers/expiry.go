@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"license_keys_shop/internal/mail"
+	"license_keys_shop/internal/money"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	defaultPendingOrderTimeout = 30 * time.Minute
+	defaultExpiryInterval      = time.Minute
+	expiryBatchSize            = 100
+)
+
+// OrderExpirer cancels orders that stay pending for longer than the
+// timeout, e.g. because the process paying them died, and gives back
+// what they held.
+type OrderExpirer struct {
+	orders   *OrderHandler
+	mailer   mail.Mailer
+	timeout  time.Duration
+	interval time.Duration
+}
+
+// NewOrderExpirer reads ORDER_PENDING_TIMEOUT and ORDER_EXPIRY_INTERVAL
+// (Go durations such as "30m"), defaulting to 30 minutes and 1 minute.
+func NewOrderExpirer(orders *OrderHandler, mailer mail.Mailer) *OrderExpirer {
+	e := &OrderExpirer{
+		orders:   orders,
+		mailer:   mailer,
+		timeout:  pendingOrderTimeout(),
+		interval: defaultExpiryInterval,
+	}
+	if d, err := time.ParseDuration(os.Getenv("ORDER_EXPIRY_INTERVAL")); err == nil && d > 0 {
+		e.interval = d
+	}
+	return e
+}
+
+// pendingOrderTimeout is how long an order may stay unpaid; payment
+// providers use it for the lifetime of what they hand to the buyer.
+func pendingOrderTimeout() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("ORDER_PENDING_TIMEOUT")); err == nil && d > 0 {
+		return d
+	}
+	return defaultPendingOrderTimeout
+}
+
+// Run reconciles orders left pending by a previous process, then expires
+// overdue orders every interval until ctx is cancelled.
+func (e *OrderExpirer) Run(ctx context.Context) {
+	if err := e.Reconcile(); err != nil {
+		log.Printf("reconciling pending orders: %v", err)
+	}
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := e.ExpireDue(); err != nil {
+				log.Printf("expiring pending orders: %v", err)
+			}
+		}
+	}
+}
+
+// Reconcile runs at startup, when no payment is in flight in this process:
+// overdue orders are expired and the rest go back to processPayment.
+// Wallet top-ups get the same treatment.
+func (e *OrderExpirer) Reconcile() error {
+	if _, err := e.ExpireDue(); err != nil {
+		return err
+	}
+	if err := e.reconcileTopUps(); err != nil {
+		return err
+	}
+
+	rows, err := e.orders.db.Query(`
+		SELECT id, payment_method FROM orders
+		WHERE payment_status = 'pending'
+		ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	resumed := 0
+	for rows.Next() {
+		var orderID int
+		var paymentMethod string
+		if err := rows.Scan(&orderID, &paymentMethod); err != nil {
+			return err
+		}
+		go e.orders.processPayment(orderID, paymentMethod)
+		resumed++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if resumed > 0 {
+		log.Printf("resumed payment of %d pending orders", resumed)
+	}
+	return nil
+}
+
+// reconcileTopUps fails top-ups left pending for longer than the order
+// timeout and charges the rest again.
+func (e *OrderExpirer) reconcileTopUps() error {
+	res, err := e.orders.db.Exec(`
+		UPDATE balance_topups SET status = 'failed', completed_at = CURRENT_TIMESTAMP
+		WHERE status = 'pending'
+		  AND created_at < CURRENT_TIMESTAMP - $1 * INTERVAL '1 second'`, int(e.timeout.Seconds()))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("failed %d top-ups left pending by a restart", n)
+	}
+
+	rows, err := e.orders.db.Query(`
+		SELECT id FROM balance_topups WHERE status = 'pending' ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	resumed := 0
+	for rows.Next() {
+		var topUpID int
+		if err := rows.Scan(&topUpID); err != nil {
+			return err
+		}
+		go processTopUp(e.orders.db, topUpID)
+		resumed++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if resumed > 0 {
+		log.Printf("resumed %d pending top-ups", resumed)
+	}
+	return nil
+}
+
+// ExpireDue expires every order pending for longer than the timeout and
+// returns how many it expired. Orders it can't expire, like Bitcoin orders
+// with a payment on the way, are skipped: each batch starts after the
+// last one, so the run ends even when a whole batch stays pending.
+func (e *OrderExpirer) ExpireDue() (int, error) {
+	expired, after := 0, 0
+	for {
+		ids, err := e.overdueOrders(after)
+		if err != nil {
+			return expired, err
+		}
+
+		for _, orderID := range ids {
+			ok, err := e.expireOrder(orderID)
+			if err != nil {
+				return expired, err
+			}
+			if ok {
+				expired++
+			}
+		}
+
+		if len(ids) < expiryBatchSize {
+			return expired, nil
+		}
+		after = ids[len(ids)-1]
+	}
+}
+
+// overdueOrders returns the next batch of overdue orders with IDs above after.
+func (e *OrderExpirer) overdueOrders(after int) ([]int, error) {
+	rows, err := e.orders.db.Query(`
+		SELECT id FROM orders
+		WHERE payment_status = 'pending'
+		  AND created_at < CURRENT_TIMESTAMP - $1 * INTERVAL '1 second'
+		  AND id > $2
+		ORDER BY id
+		LIMIT $3`, int(e.timeout.Seconds()), after, expiryBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// expireOrder expires one order unless it was paid in the meantime.
+func (e *OrderExpirer) expireOrder(orderID int) (bool, error) {
+	tx, err := e.orders.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var email, reference, paymentMethod string
+	var total money.Money
+	err = tx.QueryRow(`
+		SELECT u.email, o.public_id, o.total_amount, o.payment_method
+		FROM orders o
+		JOIN users u ON o.user_id = u.id
+		WHERE o.id = $1 AND o.payment_status = 'pending'
+		FOR UPDATE OF o`, orderID).Scan(&email, &reference, &total, &paymentMethod)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if c, ok := e.orders.provider(paymentMethod).(paymentCanceller); ok {
+		if err := c.Cancel(tx, orderID); err != nil {
+			// Most likely paid at the last moment; its watcher completes it
+			log.Printf("cancelling payment of order %d: %v", orderID, err)
+			return false, nil
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE orders SET payment_status = 'expired', expired_at = CURRENT_TIMESTAMP
+		WHERE id = $1`, orderID)
+	if err != nil {
+		return false, err
+	}
+
+	if err := releaseOrderReservations(tx, orderID); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	// The order is expired either way; a lost notice is only logged
+	err = e.mailer.Send(context.Background(), mail.Message{
+		To:      email,
+		Subject: fmt.Sprintf("Заказ %s отменён", reference),
+		Body: fmt.Sprintf("Заказ %s на сумму %s не был оплачен в течение %s и отменён.\n"+
+			"Товары вернулись в продажу, промокоды можно использовать снова.",
+			reference, total.Format(), e.timeout),
+	})
+	if err != nil {
+		log.Printf("notifying about expired order %d: %v", orderID, err)
+	}
+	return true, nil
+}
+
+// releaseOrderReservations gives back what an unpaid order held: the uses
+// of its promo codes. Keys are only taken once an order is paid.
+func releaseOrderReservations(tx *sql.Tx, orderID int) error {
+	_, err := tx.Exec(`
+		UPDATE promo_codes pc
+		SET used_count = GREATEST(pc.used_count - r.uses, 0)
+		FROM (
+			SELECT promo_code_id, COUNT(*) AS uses
+			FROM promo_redemptions
+			WHERE order_id = $1
+			GROUP BY promo_code_id
+		) r
+		WHERE pc.id = r.promo_code_id`, orderID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM promo_redemptions WHERE order_id = $1", orderID)
+	return err
+}
@@ -5,19 +5,21 @@ import (
         "database/sql"
         "html/template"
         "license_keys_shop/internal/database"
-        "license_keys_shop/internal/middleware"
         "license_keys_shop/internal/models"
+        "license_keys_shop/internal/rates"
         "net/http"
 )
 
 type HomeHandler struct {
         db        *database.DB
+        rates     rates.ExchangeRateProvider
         templates *template.Template
 }
 
-func NewHomeHandler(db *database.DB, templates *template.Template) *HomeHandler {
+func NewHomeHandler(db *database.DB, rates rates.ExchangeRateProvider, templates *template.Template) *HomeHandler {
         return &HomeHandler{
                 db:        db,
+                rates:     rates,
                 templates: templates,
         }
 }
@@ -25,27 +27,37 @@ func NewHomeHandler(db *database.DB, templates *template.Template) *HomeHandler
 func (h *HomeHandler) ShowHome(w http.ResponseWriter, r *http.Request) {
         // Get featured products (latest 8 products)
         rows, err := h.db.Query(`
-                SELECT p.id, p.title, p.description, p.price, p.image_url, p.created_at,
-                       c.name as category_name, c.slug as category_slug
+                SELECT p.id, p.title, p.description, ` + effectivePrice + `, p.image_url, p.created_at, p.is_bundle,
+                       c.name as category_name, c.slug as category_slug, ` + saleColumns + `
                 FROM products p
-                LEFT JOIN categories c ON p.category_id = c.id
-                WHERE p.is_sold = FALSE
+                LEFT JOIN categories c ON p.category_id = c.id` + activeSaleJoin + `
+                WHERE NOT ` + soldExpr + `
                 ORDER BY p.created_at DESC
                 LIMIT 8`)
 
-        var featuredProducts []models.Product
+        currency := requestCurrency(r, h.db)
+
+        var featuredProducts []models.CatalogProduct
         if err == nil {
                 defer rows.Close()
                 for rows.Next() {
-                        var p models.Product
+                        var p models.CatalogProduct
                         var categoryName, categorySlug sql.NullString
-                        
-                        err := rows.Scan(&p.ID, &p.Title, &p.Description, &p.Price, 
-                                &p.ImageURL, &p.CreatedAt, &categoryName, &categorySlug)
+                        var sale saleScan
+
+                        err := rows.Scan(&p.ID, &p.Title, &p.Description, &p.Price,
+                                &p.ImageURL, &p.CreatedAt, &p.IsBundle, &categoryName, &categorySlug,
+                                &sale.id, &sale.oldPrice, &sale.salePrice, &sale.startsAt, &sale.endsAt)
                         if err != nil {
                                 continue
                         }
 
+                        p.Sale = sale.sale(p.ID)
+                        setCatalogCurrency(h.rates, &p, currency)
+                        if p.IsBundle {
+                                p.Components = getBundleComponents(h.db, p.ID)
+                        }
+
                         if categoryName.Valid {
                                 p.Category = &models.Category{
                                         Name: categoryName.String,
@@ -61,16 +73,14 @@ func (h *HomeHandler) ShowHome(w http.ResponseWriter, r *http.Request) {
         categories := h.getMainCategories()
 
         // Get current user if logged in
-        var currentUser *models.User
-        if user, ok := middleware.GetUserFromContext(r.Context()); ok {
-                currentUser = user
-        }
+        user, _ := currentUser(r)
 
         data := map[string]interface{}{
                 "Title":            "Магазин лицензионных ключей",
                 "FeaturedProducts": featuredProducts,
                 "Categories":       categories,
-                "User":             currentUser,
+                "User":             user,
+                "Currency":         currency,
         }
 
         err = h.templates.ExecuteTemplate(w, "base.html", data)
@@ -81,7 +91,7 @@ func (h *HomeHandler) ShowHome(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *HomeHandler) ShowProfile(w http.ResponseWriter, r *http.Request) {
-        user, ok := middleware.GetUserFromContext(r.Context())
+        user, ok := currentUser(r)
         if !ok {
                 http.Redirect(w, r, "/login", http.StatusSeeOther)
                 return
@@ -92,7 +102,11 @@ func (h *HomeHandler) ShowProfile(w http.ResponseWriter, r *http.Request) {
                 SELECT o.id, o.total_amount, o.payment_status, o.created_at,
                        p.title, p.image_url
                 FROM orders o
-                JOIN products p ON o.product_id = p.id
+                JOIN LATERAL (
+                        SELECT product_id FROM order_items
+                        WHERE order_id = o.id ORDER BY id LIMIT 1
+                ) oi ON TRUE
+                JOIN products p ON oi.product_id = p.id
                 WHERE o.user_id = $1
                 ORDER BY o.created_at DESC
                 LIMIT 5`, user.ID)
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"license_keys_shop/internal/mail"
+	"license_keys_shop/internal/session"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Failed logins are counted per client IP and per account. Past a few free
+// failures each one doubles the wait before the next attempt; an account
+// that keeps failing is locked and its owner told by email.
+const (
+	throttleScopeIP      = "ip"
+	throttleScopeAccount = "account"
+
+	accountFreeFailures = 3
+	ipFreeFailures      = 10
+	loginBackoffBase    = time.Second
+	loginBackoffMax     = 15 * time.Minute
+	lockoutThreshold    = 10
+
+	// Failures older than this are forgotten
+	loginFailureWindow = time.Hour
+)
+
+// loginLockoutDuration reads LOGIN_LOCKOUT_DURATION; 15 minutes by default.
+func loginLockoutDuration() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("LOGIN_LOCKOUT_DURATION")); err == nil && d > 0 {
+		return d
+	}
+	return 15 * time.Minute
+}
+
+// loginBackoff is how long to wait after the given number of failures.
+func loginBackoff(failures, free int) time.Duration {
+	if failures <= free {
+		return 0
+	}
+	exp := failures - free - 1
+	if exp > 30 {
+		return loginBackoffMax
+	}
+	d := loginBackoffBase * time.Duration(math.Pow(2, float64(exp)))
+	if d > loginBackoffMax {
+		return loginBackoffMax
+	}
+	return d
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// spendPasswordCheck costs as much as checking a real password, so unknown
+// accounts take as long to reject as wrong passwords.
+func spendPasswordCheck(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+// accountThrottleKey names an account for throttling: its ID when it
+// exists, the name tried otherwise.
+func accountThrottleKey(userID int, login string) string {
+	if userID != 0 {
+		return "user:" + strconv.Itoa(userID)
+	}
+	return "name:" + strings.ToLower(strings.TrimSpace(login))
+}
+
+// loginBlockedFor returns how long logins under key have to wait.
+func (h *AuthHandler) loginBlockedFor(scope, key string) (time.Duration, error) {
+	var wait sql.NullFloat64
+	err := h.db.QueryRow(`
+		SELECT EXTRACT(EPOCH FROM blocked_until - CURRENT_TIMESTAMP)
+		FROM login_throttles
+		WHERE scope = $1 AND key = $2 AND blocked_until > CURRENT_TIMESTAMP`,
+		scope, key).Scan(&wait)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(math.Ceil(wait.Float64)) * time.Second, nil
+}
+
+// recordLoginFailure counts a failure under key and blocks further attempts
+// for the backoff it earns. It returns the failure count.
+func (h *AuthHandler) recordLoginFailure(scope, key string) (int, error) {
+	var failures int
+	err := h.db.QueryRow(`
+		INSERT INTO login_throttles (scope, key, failures, last_failure_at)
+		VALUES ($1, $2, 1, CURRENT_TIMESTAMP)
+		ON CONFLICT (scope, key) DO UPDATE SET
+			failures = CASE
+				WHEN login_throttles.last_failure_at < CURRENT_TIMESTAMP - $3 * INTERVAL '1 second' THEN 1
+				ELSE login_throttles.failures + 1
+			END,
+			last_failure_at = CURRENT_TIMESTAMP
+		RETURNING failures`,
+		scope, key, int(loginFailureWindow.Seconds())).Scan(&failures)
+	if err != nil {
+		return 0, err
+	}
+
+	var wait time.Duration
+	switch {
+	case scope == throttleScopeIP:
+		wait = loginBackoff(failures, ipFreeFailures)
+	case failures >= lockoutThreshold:
+		wait = loginLockoutDuration()
+	default:
+		wait = loginBackoff(failures, accountFreeFailures)
+	}
+	if wait > 0 {
+		_, err = h.db.Exec(`
+			UPDATE login_throttles
+			SET blocked_until = CURRENT_TIMESTAMP + $3 * INTERVAL '1 second'
+			WHERE scope = $1 AND key = $2`,
+			scope, key, int(wait.Seconds()))
+	}
+	return failures, err
+}
+
+// loginFailed records a wrong password or code from r against both the
+// client and the account, and notifies a real owner when their account
+// gets locked.
+func (h *AuthHandler) loginFailed(r *http.Request, userID int, login string) {
+	if _, err := h.recordLoginFailure(throttleScopeIP, clientIP(r)); err != nil {
+		log.Printf("recording failed login from %s: %v", clientIP(r), err)
+	}
+	failures, err := h.recordLoginFailure(throttleScopeAccount, accountThrottleKey(userID, login))
+	if err != nil {
+		log.Printf("recording failed login for %q: %v", login, err)
+		return
+	}
+	if userID != 0 && failures == lockoutThreshold {
+		log.Printf("account of user %d locked after %d failed logins, last from %s", userID, failures, clientIP(r))
+		go h.sendLockoutNotice(userID, clientIP(r))
+	}
+}
+
+// clearLoginFailures forgets an account's failures once its owner proves
+// who they are. The client's count stays, so one known password can't be
+// used to keep guessing others.
+func (h *AuthHandler) clearLoginFailures(userID int) {
+	_, err := h.db.Exec(`
+		DELETE FROM login_throttles WHERE scope = $1 AND key = $2`,
+		throttleScopeAccount, accountThrottleKey(userID, ""))
+	if err != nil {
+		log.Printf("clearing failed logins of user %d: %v", userID, err)
+	}
+}
+
+// checkLoginThrottle answers 429 and returns false while r's client or the
+// account has to wait.
+func (h *AuthHandler) checkLoginThrottle(w http.ResponseWriter, r *http.Request, userID int, login string) bool {
+	wait, err := h.loginBlockedFor(throttleScopeIP, clientIP(r))
+	if err == nil && wait == 0 {
+		wait, err = h.loginBlockedFor(throttleScopeAccount, accountThrottleKey(userID, login))
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())))
+		http.Error(w, "Too many login attempts, try again later", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+func clientIP(r *http.Request) string {
+	return session.ClientOf(r).IP
+}
+
+func (h *AuthHandler) sendLockoutNotice(userID int, ip string) {
+	var username, email string
+	if err := h.db.QueryRow("SELECT username, email FROM users WHERE id = $1", userID).Scan(&username, &email); err != nil {
+		log.Printf("lockout notice for user %d: %v", userID, err)
+		return
+	}
+
+	err := h.mailer.Send(context.Background(), mail.Message{
+		To:      email,
+		Subject: "Вход в учётную запись временно заблокирован",
+		Body: fmt.Sprintf("Здравствуйте, %s!\n\n"+
+			"Мы заметили %d неудачных попыток входа в вашу учётную запись, последняя — с адреса %s.\n"+
+			"Вход заблокирован на %d минут.\n\n"+
+			"Если это были не вы, смените пароль: %s/forgot-password",
+			username, lockoutThreshold, ip, int(loginLockoutDuration().Minutes()), appURL()),
+	})
+	if err != nil {
+		log.Printf("sending lockout notice to user %d: %v", userID, err)
+	}
+}
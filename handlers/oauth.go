@@ -0,0 +1,711 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"license_keys_shop/internal/mail"
+	"license_keys_shop/internal/models"
+	"license_keys_shop/internal/oauth"
+	"license_keys_shop/internal/validation"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	oauthStateTTL      = 10 * time.Minute
+	oauthSignupTTL     = 30 * time.Minute
+	oauthStateCookie   = "oauth_state"
+	oauthSignupCookie  = "oauth_signup"
+	oauthCookiePath    = "/auth/"
+	oauthCompletePath  = "/auth/complete"
+	oauthMaxNameTrials = 5
+)
+
+var (
+	errIdentityTaken  = errors.New("this account is already linked to another user")
+	errProviderLinked = errors.New("another account of this provider is already linked")
+)
+
+// identityDB is what linking an identity needs, in or out of a transaction.
+type identityDB interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// providerTitles are provider names as users know them.
+var providerTitles = map[string]string{
+	"google": "Google",
+	"yandex": "Яндекс ID",
+	"vk":     "VK ID",
+	"steam":  "Steam",
+	"mock":   "Mock",
+}
+
+func providerTitle(name string) string {
+	if t, ok := providerTitles[name]; ok {
+		return t
+	}
+	return name
+}
+
+// localPath keeps redirects after sign-in on this site.
+func localPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") || len(next) > 255 {
+		return "/"
+	}
+	return next
+}
+
+func hashOAuthState(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(sum[:])
+}
+
+func setOAuthCookie(w http.ResponseWriter, name, value string, ttl time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Expires:  time.Now().Add(ttl),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Path:     oauthCookiePath,
+	})
+}
+
+func clearOAuthCookie(w http.ResponseWriter, name string) {
+	setOAuthCookie(w, name, "", -time.Hour)
+}
+
+// OAuthStart sends the user to a provider ({provider}) to sign in, or with
+// link=1 to link that provider to the account they are logged in to.
+// next is where to return afterwards.
+func (h *AuthHandler) OAuthStart(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	provider, ok := h.oauth[name]
+	if !ok {
+		http.Error(w, "Unknown sign-in provider", http.StatusNotFound)
+		return
+	}
+
+	var linkUserID *int
+	if r.URL.Query().Get("link") == "1" {
+		user, ok := currentUser(r)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		linkUserID = &user.ID
+	}
+
+	attempt, err := oauth.NewAttempt(appURL() + "/auth/" + name + "/callback")
+	if err != nil {
+		http.Error(w, "Failed to start sign-in", http.StatusInternalServerError)
+		return
+	}
+	_, err = h.db.Exec(`
+		INSERT INTO oauth_states (state_hash, provider, nonce, verifier, redirect_to, link_user_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, CURRENT_TIMESTAMP + $7 * INTERVAL '1 second')`,
+		hashOAuthState(attempt.State), name, attempt.Nonce, attempt.Verifier,
+		localPath(r.URL.Query().Get("next")), linkUserID, int(oauthStateTTL.Seconds()))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	setOAuthCookie(w, oauthStateCookie, attempt.State, oauthStateTTL)
+	http.Redirect(w, r, provider.AuthURL(attempt), http.StatusFound)
+}
+
+// OAuthCallback is where a provider ({provider}) sends the user back. The
+// identity it vouches for logs in its linked account, is linked to the
+// account with the same verified email, or starts a new account.
+func (h *AuthHandler) OAuthCallback(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	provider, ok := h.oauth[name]
+	if !ok {
+		http.Error(w, "Unknown sign-in provider", http.StatusNotFound)
+		return
+	}
+
+	// Only the browser that started the sign-in can finish it
+	query := r.URL.Query()
+	state := query.Get("state")
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		http.Error(w, "Sign-in expired, please try again", http.StatusBadRequest)
+		return
+	}
+	clearOAuthCookie(w, oauthStateCookie)
+
+	attempt := oauth.Attempt{State: state, RedirectURI: appURL() + "/auth/" + name + "/callback"}
+	var next string
+	var linkUserID sql.NullInt64
+	err = h.db.QueryRow(`
+		UPDATE oauth_states SET used_at = CURRENT_TIMESTAMP
+		WHERE state_hash = $1 AND provider = $2 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		RETURNING nonce, verifier, redirect_to, link_user_id`,
+		hashOAuthState(state), name).Scan(&attempt.Nonce, &attempt.Verifier, &next, &linkUserID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Sign-in expired, please try again", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	identity, err := provider.Complete(r.Context(), attempt, query)
+	if errors.Is(err, oauth.ErrDenied) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		log.Printf("sign-in with %s: %v", name, err)
+		http.Error(w, "Sign-in with "+providerTitle(name)+" failed", http.StatusBadGateway)
+		return
+	}
+
+	if linkUserID.Valid {
+		userID := int(linkUserID.Int64)
+		err := h.linkIdentity(h.db, userID, identity)
+		if errors.Is(err, errIdentityTaken) || errors.Is(err, errProviderLinked) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		go h.sendIdentityLinkedNotice(userID, identity.Provider)
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+
+	h.oauthLogin(w, r, identity, next)
+}
+
+func (h *AuthHandler) oauthLogin(w http.ResponseWriter, r *http.Request, identity oauth.Identity, next string) {
+	user, totpEnabled, err := h.identityUser(identity)
+	if err == nil {
+		h.db.Exec(`
+			UPDATE user_identities SET last_login_at = CURRENT_TIMESTAMP
+			WHERE provider = $1 AND subject = $2`, identity.Provider, identity.Subject)
+		h.oauthSignIn(w, r, user, totpEnabled, next)
+		return
+	}
+	if err != sql.ErrNoRows {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Unknown identity. A verified email links it to the account that has
+	// also verified that address; an unverified account could be someone
+	// squatting the address, so it isn't linked.
+	if identity.EmailVerified {
+		var emailVerified bool
+		err := h.db.QueryRow(`
+			SELECT u.id, u.username, u.email, u.is_admin, u.totp_enabled, u.is_verified,
+			       u.created_at, u.updated_at
+			FROM users u WHERE LOWER(u.email) = LOWER($1)`, identity.Email).Scan(
+			&user.ID, &user.Username, &user.Email, &user.IsAdmin, &totpEnabled, &emailVerified,
+			&user.CreatedAt, &user.UpdatedAt)
+		switch {
+		case err == nil && emailVerified:
+			err := h.linkIdentity(h.db, user.ID, identity)
+			if errors.Is(err, errProviderLinked) {
+				http.Error(w, "Your account is linked to another "+providerTitle(identity.Provider)+" account", http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			go h.sendIdentityLinkedNotice(user.ID, identity.Provider)
+			h.oauthSignIn(w, r, user, totpEnabled, next)
+			return
+		case err == nil:
+			http.Error(w, "An account with this email already exists. Log in with your password and link "+
+				providerTitle(identity.Provider)+" in your profile.", http.StatusConflict)
+			return
+		case err != sql.ErrNoRows:
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		if user, ok := h.createIdentityUser(identity); ok {
+			h.oauthSignIn(w, r, user, false, next)
+			return
+		}
+	}
+
+	// Without a verified email or a usable username, ask the user
+	id, err := secretToken()
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	_, err = h.db.Exec(`
+		INSERT INTO oauth_signups (id, provider, subject, email, email_verified, name, redirect_to, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, CURRENT_TIMESTAMP + $8 * INTERVAL '1 second')`,
+		id, identity.Provider, identity.Subject, identity.Email, identity.EmailVerified,
+		identity.Name, next, int(oauthSignupTTL.Seconds()))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	setOAuthCookie(w, oauthSignupCookie, id, oauthSignupTTL)
+	http.Redirect(w, r, oauthCompletePath, http.StatusSeeOther)
+}
+
+// identityUser is the account linked to identity.
+func (h *AuthHandler) identityUser(identity oauth.Identity) (models.User, bool, error) {
+	var user models.User
+	var totpEnabled bool
+	err := h.db.QueryRow(`
+		SELECT u.id, u.username, u.email, u.is_admin, u.totp_enabled, u.created_at, u.updated_at
+		FROM user_identities i
+		JOIN users u ON i.user_id = u.id
+		WHERE i.provider = $1 AND i.subject = $2`, identity.Provider, identity.Subject).Scan(
+		&user.ID, &user.Username, &user.Email, &user.IsAdmin, &totpEnabled, &user.CreatedAt, &user.UpdatedAt)
+	return user, totpEnabled, err
+}
+
+// oauthSignIn logs user in like a correct password would.
+func (h *AuthHandler) oauthSignIn(w http.ResponseWriter, r *http.Request, user models.User, totpEnabled bool, next string) {
+	if h.requireSecondFactor(w, r, user, totpEnabled) {
+		return
+	}
+	if _, ok := h.startSession(w, r, user); !ok {
+		return
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// linkIdentity links identity to userID.
+func (h *AuthHandler) linkIdentity(q identityDB, userID int, identity oauth.Identity) error {
+	var owner int
+	err := q.QueryRow(`
+		SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2`,
+		identity.Provider, identity.Subject).Scan(&owner)
+	switch {
+	case err == nil && owner == userID:
+		return nil
+	case err == nil:
+		return errIdentityTaken
+	case err != sql.ErrNoRows:
+		return err
+	}
+
+	res, err := q.Exec(`
+		INSERT INTO user_identities (user_id, provider, subject, email, last_login_at)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP)
+		ON CONFLICT DO NOTHING`, userID, identity.Provider, identity.Subject, identity.Email)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Either the user has this provider already or someone just
+		// linked the identity
+		if _, _, err := h.identityUser(identity); err == nil {
+			return errIdentityTaken
+		}
+		return errProviderLinked
+	}
+	return nil
+}
+
+// createIdentityUser signs up the owner of a verified email with a
+// username made from their name or address. It fails when no such
+// username is free.
+func (h *AuthHandler) createIdentityUser(identity oauth.Identity) (models.User, bool) {
+	email, err := validation.Email(identity.Email)
+	if err != nil {
+		return models.User{}, false
+	}
+
+	for _, username := range usernameCandidates(identity) {
+		taken, err := h.takenAccountFields(username, email)
+		if err != nil || taken["email"] != "" {
+			return models.User{}, false
+		}
+		if taken["username"] != "" {
+			continue
+		}
+
+		user, err := h.insertIdentityUser(username, email, true, identity)
+		if err != nil {
+			log.Printf("signing up %s identity %s: %v", identity.Provider, identity.Subject, err)
+			return models.User{}, false
+		}
+		return user, true
+	}
+	return models.User{}, false
+}
+
+// usernameCandidates suggests valid usernames for identity, most natural
+// first.
+func usernameCandidates(identity oauth.Identity) []string {
+	var base string
+	for _, source := range []string{identity.Name, strings.SplitN(identity.Email, "@", 2)[0]} {
+		if base = usernameFrom(source); base != "" {
+			break
+		}
+	}
+	if base == "" {
+		base = "player"
+	}
+
+	candidates := []string{base}
+	for len(candidates) < oauthMaxNameTrials {
+		candidates = append(candidates, base+strconv.Itoa(100+rand.Intn(9900)))
+	}
+
+	var valid []string
+	for _, c := range candidates {
+		if u, err := validation.Username(c); err == nil {
+			valid = append(valid, u)
+		}
+	}
+	return valid
+}
+
+// usernameFrom keeps the characters of s a username may have.
+func usernameFrom(s string) string {
+	var b strings.Builder
+	for _, r := range strings.TrimSpace(s) {
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '_' || r == '-'):
+			b.WriteRune(r)
+		case r == ' ':
+			b.WriteRune('_')
+		}
+	}
+	name := strings.TrimLeft(b.String(), "0123456789._-")
+	if len(name) > validation.UsernameMaxLength-4 {
+		name = name[:validation.UsernameMaxLength-4]
+	}
+	if len(name) < validation.UsernameMinLength {
+		return ""
+	}
+	return name
+}
+
+// insertIdentityUser creates an account without a password, linked to
+// identity.
+func (h *AuthHandler) insertIdentityUser(username, email string, verified bool, identity oauth.Identity) (models.User, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return models.User{}, err
+	}
+	defer tx.Rollback()
+
+	user := models.User{Username: username, Email: email}
+	err = tx.QueryRow(`
+		INSERT INTO users (username, email, password_hash, is_verified, verified_at)
+		VALUES ($1, $2, '', $3, CASE WHEN $3 THEN CURRENT_TIMESTAMP END)
+		RETURNING id, created_at, updated_at`,
+		username, email, verified).Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		return models.User{}, err
+	}
+	if err := h.linkIdentity(tx, user.ID, identity); err != nil {
+		return models.User{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return models.User{}, err
+	}
+
+	log.Printf("user %d signed up with %s", user.ID, identity.Provider)
+	if !verified {
+		go func() {
+			if err := h.sendVerification(user.ID, username, email); err != nil {
+				log.Printf("sending verification to user %d: %v", user.ID, err)
+			}
+		}()
+	}
+	return user, nil
+}
+
+type oauthSignup struct {
+	ID            string
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	RedirectTo    string
+}
+
+func (h *AuthHandler) pendingSignup(r *http.Request) (oauthSignup, error) {
+	var s oauthSignup
+	cookie, err := r.Cookie(oauthSignupCookie)
+	if err != nil {
+		return s, sql.ErrNoRows
+	}
+	err = h.db.QueryRow(`
+		SELECT id, provider, subject, email, email_verified, name, redirect_to
+		FROM oauth_signups
+		WHERE id = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP`, cookie.Value).Scan(
+		&s.ID, &s.Provider, &s.Subject, &s.Email, &s.EmailVerified, &s.Name, &s.RedirectTo)
+	return s, err
+}
+
+// ShowCompleteSignup asks a first-time user for what the provider didn't
+// give: a username, and an email unless a verified one came along.
+func (h *AuthHandler) ShowCompleteSignup(w http.ResponseWriter, r *http.Request) {
+	signup, err := h.pendingSignup(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	username := ""
+	if c := usernameCandidates(oauth.Identity{Name: signup.Name, Email: signup.Email}); len(c) > 0 {
+		username = c[0]
+	}
+	data := map[string]interface{}{
+		"Title":    "Завершение регистрации",
+		"Provider": providerTitle(signup.Provider),
+		"Username": username,
+		"Email":    signup.Email,
+	}
+	h.templates.ExecuteTemplate(w, "oauth_complete.html", data)
+}
+
+// CompleteSignup creates the account of a pending first sign-in. An email
+// other than the provider's verified one needs confirming as usual.
+func (h *AuthHandler) CompleteSignup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	signup, err := h.pendingSignup(r)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Sign-in expired, please try again", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	var req models.RegisterRequest
+	if r.Header.Get("Content-Type") == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.Username = r.FormValue("username")
+		req.Email = r.FormValue("email")
+	}
+
+	fields := make(validation.Errors)
+	username, err := validation.Username(req.Username)
+	fields.Add("username", err)
+	email, err := validation.Email(req.Email)
+	fields.Add("email", err)
+	if len(fields) > 0 {
+		h.writeSignupErrors(w, r, req, signup, http.StatusUnprocessableEntity, fields)
+		return
+	}
+
+	if taken, err := h.takenAccountFields(username, email); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	} else if len(taken) > 0 {
+		h.writeSignupErrors(w, r, req, signup, http.StatusConflict, taken)
+		return
+	}
+
+	// The signup is spent first, so a double submit can't make two accounts
+	res, err := h.db.Exec(`
+		UPDATE oauth_signups SET used_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND used_at IS NULL`, signup.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Sign-in expired, please try again", http.StatusBadRequest)
+		return
+	}
+
+	identity := oauth.Identity{
+		Provider:      signup.Provider,
+		Subject:       signup.Subject,
+		Email:         signup.Email,
+		EmailVerified: signup.EmailVerified,
+	}
+	verified := signup.EmailVerified && strings.EqualFold(email, signup.Email)
+	user, err := h.insertIdentityUser(username, email, verified, identity)
+	if errors.Is(err, errIdentityTaken) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
+	clearOAuthCookie(w, oauthSignupCookie)
+	h.oauthSignIn(w, r, user, false, signup.RedirectTo)
+}
+
+// writeSignupErrors is writeRegisterErrors for the signup completion form.
+func (h *AuthHandler) writeSignupErrors(w http.ResponseWriter, r *http.Request, req models.RegisterRequest, signup oauthSignup, status int, fields validation.Errors) {
+	if r.Header.Get("Content-Type") == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  "Validation failed",
+			"fields": fields,
+		})
+		return
+	}
+
+	data := map[string]interface{}{
+		"Title":    "Завершение регистрации",
+		"Provider": providerTitle(signup.Provider),
+		"Errors":   fields,
+		"Username": req.Username,
+		"Email":    req.Email,
+	}
+	w.WriteHeader(status)
+	h.templates.ExecuteTemplate(w, "oauth_complete.html", data)
+}
+
+// ListIdentities shows the current user's linked providers and which
+// others they could link.
+func (h *AuthHandler) ListIdentities(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT provider, email, created_at, last_login_at
+		FROM user_identities WHERE user_id = $1
+		ORDER BY created_at`, user.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	identities := []map[string]interface{}{}
+	for rows.Next() {
+		var provider, email string
+		var createdAt time.Time
+		var lastLoginAt sql.NullTime
+		if err := rows.Scan(&provider, &email, &createdAt, &lastLoginAt); err != nil {
+			continue
+		}
+		identity := map[string]interface{}{
+			"provider":  provider,
+			"title":     providerTitle(provider),
+			"email":     email,
+			"linked_at": createdAt,
+		}
+		if lastLoginAt.Valid {
+			identity["last_login_at"] = lastLoginAt.Time
+		}
+		identities = append(identities, identity)
+	}
+
+	var hasPassword bool
+	if err := h.db.QueryRow("SELECT password_hash <> '' FROM users WHERE id = $1", user.ID).Scan(&hasPassword); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"identities":   identities,
+		"providers":    oauth.Names(h.oauth),
+		"has_password": hasPassword,
+	})
+}
+
+// UnlinkIdentity removes a linked provider ({provider}) unless it is the
+// only way left into the account.
+func (h *AuthHandler) UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	provider := mux.Vars(r)["provider"]
+
+	res, err := h.db.Exec(`
+		DELETE FROM user_identities i
+		WHERE i.user_id = $1 AND i.provider = $2
+		  AND (EXISTS (SELECT 1 FROM users u WHERE u.id = i.user_id AND u.password_hash <> '')
+		       OR EXISTS (SELECT 1 FROM user_identities o
+		                  WHERE o.user_id = i.user_id AND o.provider <> i.provider))`,
+		user.ID, provider)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var linked bool
+		err := h.db.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM user_identities WHERE user_id = $1 AND provider = $2)`,
+			user.ID, provider).Scan(&linked)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !linked {
+			http.Error(w, "Provider is not linked", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Set a password before unlinking your only sign-in method", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"unlinked": provider,
+	})
+}
+
+func (h *AuthHandler) sendIdentityLinkedNotice(userID int, provider string) {
+	var username, email string
+	if err := h.db.QueryRow("SELECT username, email FROM users WHERE id = $1", userID).Scan(&username, &email); err != nil {
+		log.Printf("identity notice for user %d: %v", userID, err)
+		return
+	}
+
+	err := h.mailer.Send(context.Background(), mail.Message{
+		To:      email,
+		Subject: "Новый способ входа",
+		Body: fmt.Sprintf("Здравствуйте, %s!\n\n"+
+			"К вашей учётной записи привязан вход через %s.\n"+
+			"Если это были не вы, отвяжите его в профиле и смените пароль: %s/forgot-password",
+			username, providerTitle(provider), appURL()),
+	})
+	if err != nil {
+		log.Printf("sending identity notice to user %d: %v", userID, err)
+	}
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"database/sql"
+	"license_keys_shop/internal/money"
+	"time"
+)
+
+// OrderEvent is one entry of an order's timeline.
+type OrderEvent struct {
+	At      time.Time    `json:"at"`
+	Type    string       `json:"type"`
+	Amount  *money.Money `json:"amount,omitempty"`
+	TxID    string       `json:"txid,omitempty"`
+	Message string       `json:"message"`
+}
+
+func addOrderEvent(tx *sql.Tx, orderID int, typ string, amount *money.Money, txid, message string) error {
+	var value, currency, txidValue sql.NullString
+	if amount != nil {
+		value = sql.NullString{String: amount.String(), Valid: true}
+		currency = sql.NullString{String: string(amount.Currency()), Valid: true}
+	}
+	if txid != "" {
+		txidValue = sql.NullString{String: txid, Valid: true}
+	}
+	_, err := tx.Exec(`
+		INSERT INTO order_events (order_id, type, amount, currency, txid, message)
+		VALUES ($1, $2, $3, $4, $5, $6)`, orderID, typ, value, currency, txidValue, message)
+	return err
+}
+
+func getOrderEvents(q queryer, orderID int) ([]OrderEvent, error) {
+	rows, err := q.Query(`
+		SELECT created_at, type, amount, currency, COALESCE(txid, ''), message
+		FROM order_events
+		WHERE order_id = $1
+		ORDER BY id`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []OrderEvent
+	for rows.Next() {
+		var e OrderEvent
+		var amount, currency sql.NullString
+		if err := rows.Scan(&e.At, &e.Type, &amount, &currency, &e.TxID, &e.Message); err != nil {
+			return nil, err
+		}
+		if amount.Valid {
+			m := scanCharged(amount.String, currency.String)
+			e.Amount = &m
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
@@ -7,39 +7,62 @@ import (
 	"fmt"
 	"html/template"
 	"license_keys_shop/internal/database"
-	"license_keys_shop/internal/middleware"
+	"license_keys_shop/internal/idempotency"
+	"license_keys_shop/internal/ids"
+	"license_keys_shop/internal/mail"
 	"license_keys_shop/internal/models"
-	"math/rand"
+	"license_keys_shop/internal/money"
+	"license_keys_shop/internal/rates"
+	"log"
 	"net/http"
 	"strconv"
-	"time"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
 
 type OrderHandler struct {
-	db        *database.DB
-	templates *template.Template
+	db              *database.DB
+	rates           rates.ExchangeRateProvider
+	providers       map[string]PaymentProvider
+	idempotency     idempotency.Store
+	mailer          mail.Mailer
+	requireVerified bool
+	templates       *template.Template
 }
 
-func NewOrderHandler(db *database.DB, templates *template.Template) *OrderHandler {
+func NewOrderHandler(db *database.DB, rates rates.ExchangeRateProvider, templates *template.Template) *OrderHandler {
 	return &OrderHandler{
-		db:        db,
-		templates: templates,
+		db:              db,
+		rates:           rates,
+		providers:       defaultPaymentProviders(db),
+		idempotency:     idempotency.NewSQLStore(db),
+		mailer:          defaultMailer(),
+		requireVerified: requireVerifiedEmail(),
+		templates:       templates,
 	}
 }
 
+// CreateOrder buys a single product. A retry with the same Idempotency-Key
+// gets the first order back instead of a second one.
 func (h *OrderHandler) CreateOrder(w http.ResponseWriter, r *http.Request) {
+	h.idempotent(w, r, h.createOrder)
+}
+
+func (h *OrderHandler) createOrder(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	user, ok := middleware.GetUserFromContext(r.Context())
+	user, ok := currentUser(r)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+	if !h.verifiedBuyer(w, user.ID) {
+		return
+	}
 
 	vars := mux.Vars(r)
 	productID, err := strconv.Atoi(vars["productId"])
@@ -53,12 +76,14 @@ func (h *OrderHandler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 		paymentMethod = "mir" // default
 	}
 
-	// Check if product exists and is not sold
+	// Check if product exists and is not sold; Price is the sale price while one runs
 	var product models.Product
+	var price, listPrice money.Money
 	err = h.db.QueryRow(`
-		SELECT id, title, price, is_sold 
-		FROM products WHERE id = $1`, productID).Scan(
-		&product.ID, &product.Title, &product.Price, &product.IsSold)
+		SELECT p.id, p.title, `+effectivePrice+`, p.price, `+soldExpr+`
+		FROM products p`+activeSaleJoin+`
+		WHERE p.id = $1`, productID).Scan(
+		&product.ID, &product.Title, &price, &listPrice, &product.IsSold)
 
 	if err == sql.ErrNoRows {
 		http.Error(w, "Product not found", http.StatusNotFound)
@@ -74,64 +99,120 @@ func (h *OrderHandler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	currency, ok := orderCurrency(r, h.db)
+	if !ok {
+		http.Error(w, "Unsupported currency", http.StatusBadRequest)
+		return
+	}
+	if c, ok := fixedCurrency(paymentMethod); ok {
+		currency = c
+	}
+
+	charged, rate, err := chargeAmount(h.rates, price, currency)
+	if err != nil {
+		http.Error(w, "Exchange rate unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
 	// Generate transaction ID
-	transactionID := fmt.Sprintf("%s_%d_%d", paymentMethod, time.Now().Unix(), rand.Intn(10000))
+	transactionID := ids.WithPrefix("txn")
+	publicID := ids.New()
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
 
 	// Create order
 	var orderID int
-	err = h.db.QueryRow(`
-		INSERT INTO orders (user_id, product_id, total_amount, payment_method, transaction_id, payment_status)
-		VALUES ($1, $2, $3, $4, $5, 'pending') RETURNING id`,
-		user.ID, productID, product.Price, paymentMethod, transactionID).Scan(&orderID)
+	err = tx.QueryRow(`
+		INSERT INTO orders (user_id, product_id, total_amount, currency, charged_amount, exchange_rate,
+		                    payment_method, transaction_id, public_id, payment_status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, 'pending') RETURNING id`,
+		user.ID, productID, price, string(currency), charged, rate.String(),
+		paymentMethod, transactionID, publicID).Scan(&orderID)
+
+	if err != nil {
+		http.Error(w, "Failed to create order", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO order_items (order_id, product_id, unit_price, list_price, quantity)
+		VALUES ($1, $2, $3, $4, 1)`, orderID, productID, price, listPrice)
+	if err != nil {
+		http.Error(w, "Failed to create order", http.StatusInternalServerError)
+		return
+	}
 
+	settled, err := h.chargeOrder(tx, paymentMethod, PaymentIntent{OrderID: orderID, UserID: user.ID, Amount: price})
 	if err != nil {
+		writeChargeError(w, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
 		http.Error(w, "Failed to create order", http.StatusInternalServerError)
 		return
 	}
 
-	// Simulate payment processing
-	go h.processPayment(orderID, paymentMethod)
+	status, message := "completed", "Order paid from balance"
+	if !settled {
+		// Simulate payment processing
+		go h.processPayment(orderID, paymentMethod)
+		status, message = "pending", "Order created, processing payment..."
+	}
 
 	if r.Header.Get("Accept") == "application/json" {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"order_id":       orderID,
+			"order_ref":      publicID,
 			"transaction_id": transactionID,
-			"status":         "pending",
-			"message":        "Order created, processing payment...",
+			"total_amount":   price,
+			"currency":       currency,
+			"charged_amount": charged,
+			"status":         status,
+			"message":        message,
 		})
 		return
 	}
 
 	// Redirect to payment page
-	http.Redirect(w, r, fmt.Sprintf("/payment/%d", orderID), http.StatusSeeOther)
+	http.Redirect(w, r, "/payment/"+publicID, http.StatusSeeOther)
 }
 
+// ShowPayment and GetOrderStatus address orders by their public reference;
+// sequential ids never appear in URLs.
 func (h *OrderHandler) ShowPayment(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	orderID, err := strconv.Atoi(vars["orderId"])
-	if err != nil {
+	orderRef := vars["orderId"]
+	if len(orderRef) > 32 {
 		http.Error(w, "Invalid order ID", http.StatusBadRequest)
 		return
 	}
 
-	user, ok := middleware.GetUserFromContext(r.Context())
+	user, ok := currentUser(r)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	var order models.Order
-	var productTitle string
-	err = h.db.QueryRow(`
-		SELECT o.id, o.user_id, o.product_id, o.total_amount, o.payment_method,
-		       o.payment_status, o.transaction_id, o.created_at, p.title
+	var order models.OrderDetails
+	var currency, charged string
+	err := h.db.QueryRow(`
+		SELECT o.id, o.public_id, o.user_id, COALESCE(o.subtotal_amount, o.total_amount), o.discount_amount,
+		       o.total_amount, o.refunded_amount, COALESCE(o.promo_code, ''), o.currency,
+		       COALESCE(o.charged_amount, o.total_amount), o.exchange_rate, o.payment_method,
+		       o.payment_status, o.transaction_id, o.created_at
 		FROM orders o
-		JOIN products p ON o.product_id = p.id
-		WHERE o.id = $1 AND o.user_id = $2`, orderID, user.ID).Scan(
-		&order.ID, &order.UserID, &order.ProductID, &order.TotalAmount,
+		WHERE o.public_id = $1 AND o.user_id = $2`, orderRef, user.ID).Scan(
+		&order.ID, &order.Reference, &order.UserID, &order.SubtotalAmount, &order.DiscountAmount,
+		&order.TotalAmount, &order.RefundedAmount, &order.PromoCode, &currency, &charged, &order.ExchangeRate,
 		&order.PaymentMethod, &order.PaymentStatus, &order.TransactionID,
-		&order.CreatedAt, &productTitle)
+		&order.CreatedAt)
 
 	if err == sql.ErrNoRows {
 		http.Error(w, "Order not found", http.StatusNotFound)
@@ -142,38 +223,60 @@ func (h *OrderHandler) ShowPayment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	order.Charged = models.NewPrice(scanCharged(charged, currency))
+	order.Items = h.getOrderItems(order.ID)
+	order.Refunds = getOrderRefunds(h.db, order.ID)
+
+	titles := make([]string, 0, len(order.Items))
+	for _, item := range order.Items {
+		titles = append(titles, item.Product.Title)
+	}
+	if len(order.Items) > 0 {
+		order.ProductID = order.Items[0].ProductID
+		order.Product = &order.Items[0].Product.Product
+	}
+
 	data := map[string]interface{}{
 		"Title":        "Оплата заказа",
 		"Order":        order,
-		"ProductTitle": productTitle,
+		"Items":        order.Items,
+		"ProductTitle": strings.Join(titles, ", "),
 		"User":         user,
 	}
+	if order.PaymentMethod == sbpPaymentMethod && order.PaymentStatus == "pending" {
+		if p, err := getSBPPayment(h.db, order.ID, order.Reference); err == nil {
+			data["SBP"] = p
+		}
+	}
+	if b, ok := h.bitcoin(); ok && order.PaymentMethod == bitcoinPaymentMethod {
+		if p, err := b.payment(h.db, order.ID); err == nil {
+			data["Bitcoin"] = p
+		}
+	}
 
 	h.templates.ExecuteTemplate(w, "payment.html", data)
 }
 
 func (h *OrderHandler) GetOrderStatus(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	orderID, err := strconv.Atoi(vars["orderId"])
-	if err != nil {
+	orderRef := vars["orderId"]
+	if len(orderRef) > 32 {
 		http.Error(w, "Invalid order ID", http.StatusBadRequest)
 		return
 	}
 
-	user, ok := middleware.GetUserFromContext(r.Context())
+	user, ok := currentUser(r)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	var order models.Order
-	var licenseKey sql.NullString
-	err = h.db.QueryRow(`
-		SELECT o.id, o.payment_status, o.transaction_id, p.license_key
+	err := h.db.QueryRow(`
+		SELECT o.id, o.payment_status, o.transaction_id
 		FROM orders o
-		JOIN products p ON o.product_id = p.id
-		WHERE o.id = $1 AND o.user_id = $2`, orderID, user.ID).Scan(
-		&order.ID, &order.PaymentStatus, &order.TransactionID, &licenseKey)
+		WHERE o.public_id = $1 AND o.user_id = $2`, orderRef, user.ID).Scan(
+		&order.ID, &order.PaymentStatus, &order.TransactionID)
 
 	if err == sql.ErrNoRows {
 		http.Error(w, "Order not found", http.StatusNotFound)
@@ -186,12 +289,27 @@ func (h *OrderHandler) GetOrderStatus(w http.ResponseWriter, r *http.Request) {
 
 	response := map[string]interface{}{
 		"order_id":       order.ID,
+		"order_ref":      orderRef,
 		"status":         order.PaymentStatus,
 		"transaction_id": order.TransactionID,
 	}
 
-	if order.PaymentStatus == "completed" && licenseKey.Valid {
-		response["license_key"] = licenseKey.String
+	// Polling only learns that keys are ready; they are sent, and count as
+	// seen for refunds, when the client asks with ?reveal=true.
+	if order.PaymentStatus == "completed" || order.PaymentStatus == "partially_refunded" {
+		response["keys_ready"] = true
+		if reveal, _ := strconv.ParseBool(r.URL.Query().Get("reveal")); reveal {
+			keys := h.getOrderLicenseKeys(order.ID)
+			response["license_keys"] = keys
+			// Single-product clients still read license_key.
+			if len(keys) > 0 {
+				response["license_key"] = keys[0]["license_key"]
+			}
+		}
+	}
+
+	if refunds := getOrderRefunds(h.db, order.ID); len(refunds) > 0 {
+		response["refunds"] = refunds
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -199,18 +317,18 @@ func (h *OrderHandler) GetOrderStatus(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *OrderHandler) GetUserOrders(w http.ResponseWriter, r *http.Request) {
-	user, ok := middleware.GetUserFromContext(r.Context())
+	user, ok := currentUser(r)
 	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	rows, err := h.db.Query(`
-		SELECT o.id, o.product_id, o.total_amount, o.payment_method,
-		       o.payment_status, o.transaction_id, o.created_at,
-		       p.title, p.image_url
+		SELECT o.id, o.public_id, COALESCE(o.subtotal_amount, o.total_amount), o.discount_amount,
+		       o.total_amount, o.refunded_amount, COALESCE(o.promo_code, ''), o.currency,
+		       COALESCE(o.charged_amount, o.total_amount), o.exchange_rate, o.payment_method,
+		       o.payment_status, o.transaction_id, o.created_at
 		FROM orders o
-		JOIN products p ON o.product_id = p.id
 		WHERE o.user_id = $1
 		ORDER BY o.created_at DESC`, user.ID)
 
@@ -218,24 +336,34 @@ func (h *OrderHandler) GetUserOrders(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
-	var orders []models.Order
+	var orders []models.OrderDetails
 	for rows.Next() {
-		var order models.Order
-		var product models.Product
-		
+		var order models.OrderDetails
+		var currency, charged string
+
 		err := rows.Scan(
-			&order.ID, &order.ProductID, &order.TotalAmount, &order.PaymentMethod,
-			&order.PaymentStatus, &order.TransactionID, &order.CreatedAt,
-			&product.Title, &product.ImageURL)
+			&order.ID, &order.Reference, &order.SubtotalAmount, &order.DiscountAmount,
+			&order.TotalAmount, &order.RefundedAmount, &order.PromoCode, &currency, &charged, &order.ExchangeRate,
+			&order.PaymentMethod, &order.PaymentStatus, &order.TransactionID, &order.CreatedAt)
 		if err != nil {
 			continue
 		}
 
-		order.Product = &product
+		order.Charged = models.NewPrice(scanCharged(charged, currency))
+
 		orders = append(orders, order)
 	}
+	rows.Close()
+
+	for i := range orders {
+		orders[i].Items = h.getOrderItems(orders[i].ID)
+		orders[i].Refunds = getOrderRefunds(h.db, orders[i].ID)
+		if len(orders[i].Items) > 0 {
+			orders[i].ProductID = orders[i].Items[0].ProductID
+			orders[i].Product = &orders[i].Items[0].Product.Product
+		}
+	}
 
 	if r.Header.Get("Accept") == "application/json" {
 		w.Header().Set("Content-Type", "application/json")
@@ -253,52 +381,202 @@ func (h *OrderHandler) GetUserOrders(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *OrderHandler) processPayment(orderID int, paymentMethod string) {
-	// Simulate payment processing delay
-	time.Sleep(time.Duration(rand.Intn(5)+3) * time.Second)
-
-	// Simulate payment success (90% success rate)
-	success := rand.Float32() < 0.9
+	var success bool
+	if watcher, ok := h.provider(paymentMethod).(paymentWatcher); ok {
+		paid, err := watcher.Await(orderID)
+		if err != nil {
+			// Unpaid until it expired; OrderExpirer finishes the order
+			return
+		}
+		success = paid
+	} else {
+		success = simulateGateway()
+	}
 
 	if success {
-		// Mark order as completed and product as sold
+		// Mark order as completed and deliver its keys
 		tx, err := h.db.Begin()
 		if err != nil {
 			return
 		}
 		defer tx.Rollback()
 
-		_, err = tx.Exec(`
-			UPDATE orders SET payment_status = 'completed' WHERE id = $1`, orderID)
+		res, err := tx.Exec(`
+			UPDATE orders SET payment_status = 'completed'
+			WHERE id = $1 AND payment_status = 'pending'`, orderID)
 		if err != nil {
 			return
 		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			// Expired while we were waiting on the payment
+			return
+		}
 
-		_, err = tx.Exec(`
-			UPDATE products SET is_sold = TRUE 
-			WHERE id = (SELECT product_id FROM orders WHERE id = $1)`, orderID)
-		if err != nil {
+		if err := assignOrderKeys(tx, orderID); err != nil {
+			// Someone else got one of the keys first; the order can't be
+			// fulfilled, but the buyer has paid for it
+			tx.Rollback()
+			h.refundUnfulfilled(orderID, paymentMethod)
 			return
 		}
 
 		tx.Commit()
 	} else {
-		// Mark order as failed
+		h.failOrder(orderID)
+	}
+}
+
+// refundUnfulfilled gives back the payment of an order that was paid but
+// lost its keys to another order, and marks the order refunded. An order
+// that can't be refunded is left as needs_refund for staff; it never just
+// fails with the buyer's money kept.
+func (h *OrderHandler) refundUnfulfilled(orderID int, paymentMethod string) {
+	provider := h.provider(paymentMethod)
+	err := h.returnPayment(orderID, paymentMethod, func(tx *sql.Tx, intent RefundIntent) (money.Money, string, string, error) {
+		if b, ok := provider.(*bitcoinProvider); ok {
+			credited, err := b.returnPayment(tx, orderID)
+			return credited, "balance", fmt.Sprintf("bitcoin:order:%d", orderID), err
+		}
+		// SBP and card payments go back the way they came
+		reference, err := provider.Refund(tx, intent)
+		return intent.Amount, "original", reference, err
+	})
+	if err != nil {
+		log.Printf("order %d was paid but has no keys and couldn't be refunded: %v", orderID, err)
 		h.db.Exec(`
-			UPDATE orders SET payment_status = 'failed' WHERE id = $1`, orderID)
+			UPDATE orders SET payment_status = 'needs_refund'
+			WHERE id = $1 AND payment_status = 'pending'`, orderID)
+		return
+	}
+	log.Printf("order %d was paid but has no keys; payment refunded", orderID)
+}
+
+// returnPayment refunds a pending order in full with refund, which returns
+// the amount refunded in money.Base, the refund's destination and the
+// provider's reference, and records it like a staff refund.
+func (h *OrderHandler) returnPayment(orderID int, paymentMethod string,
+	refund func(tx *sql.Tx, intent RefundIntent) (money.Money, string, string, error)) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	intent := RefundIntent{OrderID: orderID, Reason: "the license key sold out before the payment arrived"}
+	var currency, charged string
+	err = tx.QueryRow(`
+		SELECT user_id, total_amount, currency, COALESCE(charged_amount, total_amount)
+		FROM orders
+		WHERE id = $1 AND payment_status = 'pending'
+		FOR UPDATE`, orderID).Scan(&intent.UserID, &intent.Amount, &currency, &charged)
+	if err == sql.ErrNoRows {
+		// Expired or refunded meanwhile
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	intent.Charged = scanCharged(charged, currency)
+
+	amount, destination, reference, err := refund(tx, intent)
+	if err != nil {
+		return err
+	}
+
+	if amount.IsPositive() {
+		_, err = tx.Exec(`
+			INSERT INTO refunds (order_id, amount, currency, charged_amount, destination,
+			                     payment_method, provider_reference, reason)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			orderID, amount, currency, intent.Charged.String(), destination,
+			paymentMethod, reference, intent.Reason)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE orders SET payment_status = 'refunded', refunded_amount = $1
+		WHERE id = $2`, amount, orderID)
+	if err != nil {
+		return err
+	}
+	if err := releaseOrderReservations(tx, orderID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// failOrder marks a pending order as failed and gives back its promo code
+// uses, like an expired order.
+func (h *OrderHandler) failOrder(orderID int) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		log.Printf("failing order %d: %v", orderID, err)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE orders SET payment_status = 'failed'
+		WHERE id = $1 AND payment_status = 'pending'`, orderID)
+	if err != nil {
+		log.Printf("failing order %d: %v", orderID, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return
+	}
+
+	if err := releaseOrderReservations(tx, orderID); err != nil {
+		log.Printf("failing order %d: %v", orderID, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("failing order %d: %v", orderID, err)
 	}
 }
 
 func (h *OrderHandler) ShowCart(w http.ResponseWriter, r *http.Request) {
-	user, ok := middleware.GetUserFromContext(r.Context())
+	user, ok := currentUser(r)
 	if !ok {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	// For simplicity, we'll show the product to purchase from URL parameter
+	// A product in the URL is a "buy now" shortcut, otherwise show the saved cart
 	productID := r.URL.Query().Get("product")
 	if productID == "" {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		items := h.getCartItems(user.ID)
+		breakdown, promoErr := cartBreakdown(h.db, user.ID, items)
+
+		var promoError string
+		if promoErr != nil {
+			promoError = promoErr.Error()
+		}
+
+		if r.Header.Get("Accept") == "application/json" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"items":       items,
+				"subtotal":    breakdown.Subtotal,
+				"discounts":   breakdown.Discounts,
+				"total":       breakdown.Total,
+				"promo_error": promoError,
+			})
+			return
+		}
+
+		data := map[string]interface{}{
+			"Title":      "Корзина",
+			"Items":      items,
+			"Breakdown":  breakdown,
+			"Total":      breakdown.Total,
+			"PromoError": promoError,
+			"User":       user,
+		}
+
+		h.templates.ExecuteTemplate(w, "cart.html", data)
 		return
 	}
 
@@ -308,10 +586,11 @@ func (h *OrderHandler) ShowCart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var product models.Product
+	var product models.CatalogProduct
 	err = h.db.QueryRow(`
-		SELECT id, title, description, price, image_url, is_sold
-		FROM products WHERE id = $1`, id).Scan(
+		SELECT p.id, p.title, p.description, `+effectivePrice+`, p.image_url, `+soldExpr+`
+		FROM products p`+activeSaleJoin+`
+		WHERE p.id = $1`, id).Scan(
 		&product.ID, &product.Title, &product.Description, 
 		&product.Price, &product.ImageURL, &product.IsSold)
 
@@ -337,3 +616,71 @@ func (h *OrderHandler) ShowCart(w http.ResponseWriter, r *http.Request) {
 
 	h.templates.ExecuteTemplate(w, "cart.html", data)
 }
+
+func (h *OrderHandler) getOrderItems(orderID int) []models.OrderItem {
+	rows, err := h.db.Query(`
+		SELECT oi.id, oi.order_id, oi.product_id, oi.unit_price, oi.quantity,
+		       p.title, p.image_url
+		FROM order_items oi
+		JOIN products p ON oi.product_id = p.id
+		WHERE oi.order_id = $1
+		ORDER BY oi.id`, orderID)
+	if err != nil {
+		return []models.OrderItem{}
+	}
+	defer rows.Close()
+
+	var items []models.OrderItem
+	for rows.Next() {
+		var item models.OrderItem
+		var product models.CatalogProduct
+		err := rows.Scan(&item.ID, &item.OrderID, &item.ProductID, &item.UnitPrice,
+			&item.Quantity, &product.Title, &product.ImageURL)
+		if err != nil {
+			continue
+		}
+		product.ID = item.ProductID
+		item.Product = &product
+		items = append(items, item)
+	}
+	return items
+}
+
+// getOrderLicenseKeys returns the keys still held by the order and marks
+// them as seen, which keeps them from going back to inventory on refund.
+// Call it only to hand the keys to the buyer.
+func (h *OrderHandler) getOrderLicenseKeys(orderID int) []map[string]interface{} {
+	h.db.Exec(`
+		UPDATE order_item_keys k SET revealed_at = CURRENT_TIMESTAMP
+		FROM order_items oi
+		WHERE k.order_item_id = oi.id AND oi.order_id = $1
+		  AND k.status = 'delivered' AND k.revealed_at IS NULL`, orderID)
+
+	rows, err := h.db.Query(`
+		SELECT p.id, p.title, k.license_key
+		FROM order_items oi
+		JOIN order_item_keys k ON k.order_item_id = oi.id
+		JOIN products p ON k.product_id = p.id
+		WHERE oi.order_id = $1 AND k.status = 'delivered'
+		ORDER BY oi.id, k.id`, orderID)
+	if err != nil {
+		return []map[string]interface{}{}
+	}
+	defer rows.Close()
+
+	keys := []map[string]interface{}{}
+	for rows.Next() {
+		var productID int
+		var title string
+		var licenseKey sql.NullString
+		if err := rows.Scan(&productID, &title, &licenseKey); err != nil || !licenseKey.Valid {
+			continue
+		}
+		keys = append(keys, map[string]interface{}{
+			"product_id":  productID,
+			"title":       title,
+			"license_key": licenseKey.String,
+		})
+	}
+	return keys
+}
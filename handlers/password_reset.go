@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"license_keys_shop/internal/mail"
+	"license_keys_shop/internal/password"
+	"license_keys_shop/internal/session"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	passwordResetTTL = time.Hour
+	// passwordResetInterval is how often one account can be sent a link.
+	passwordResetInterval = time.Minute
+)
+
+// resetRequestedMessage is the answer to every reset request, whether or
+// not the address belongs to an account.
+const resetRequestedMessage = "If an account with that email exists, we have sent a link to reset the password."
+
+// appURL is the site's public address for links in emails. It is never
+// taken from the request, whose Host header the client controls.
+func appURL() string {
+	if u := os.Getenv("APP_URL"); u != "" {
+		return strings.TrimRight(u, "/")
+	}
+	return "http://localhost:8080"
+}
+
+func (h *AuthHandler) ShowForgotPassword(w http.ResponseWriter, r *http.Request) {
+	data := map[string]interface{}{
+		"Title": "Восстановление пароля",
+		"Sent":  r.URL.Query().Get("sent") != "",
+	}
+	h.templates.ExecuteTemplate(w, "forgot_password.html", data)
+}
+
+func (h *AuthHandler) ShowResetPassword(w http.ResponseWriter, r *http.Request) {
+	data := map[string]interface{}{
+		"Title": "Новый пароль",
+		"Token": r.URL.Query().Get("token"),
+	}
+	h.templates.ExecuteTemplate(w, "reset_password.html", data)
+}
+
+// RequestPasswordReset emails a reset link. The lookup and the email run
+// in the background and the response is always the same, so it can't be
+// used to find out which addresses have accounts.
+func (h *AuthHandler) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+	}
+	if r.Header.Get("Content-Type") == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.Email = r.FormValue("email")
+	}
+
+	if email := strings.TrimSpace(req.Email); email != "" {
+		go h.sendPasswordReset(email, session.ClientOf(r).IP)
+	}
+
+	if r.Header.Get("Content-Type") == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": resetRequestedMessage,
+		})
+		return
+	}
+	http.Redirect(w, r, "/forgot-password?sent=1", http.StatusSeeOther)
+}
+
+func (h *AuthHandler) sendPasswordReset(email, ip string) {
+	var userID int
+	var username, address string
+	err := h.db.QueryRow(`
+		SELECT id, username, email FROM users WHERE LOWER(email) = LOWER($1)`,
+		email).Scan(&userID, &username, &address)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		log.Printf("password reset for %q: %v", email, err)
+		return
+	}
+
+	var recent bool
+	err = h.db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM password_reset_tokens
+			WHERE user_id = $1 AND created_at > CURRENT_TIMESTAMP - $2 * INTERVAL '1 second'
+		)`, userID, int(passwordResetInterval.Seconds())).Scan(&recent)
+	if err != nil || recent {
+		return
+	}
+
+	token, err := secretToken()
+	if err != nil {
+		log.Printf("password reset for user %d: %v", userID, err)
+		return
+	}
+
+	_, err = h.db.Exec(`
+		INSERT INTO password_reset_tokens (user_id, token_hash, ip, expires_at)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP + $4 * INTERVAL '1 second')`,
+		userID, hashResetToken(token), ip, int(passwordResetTTL.Seconds()))
+	if err != nil {
+		log.Printf("password reset for user %d: %v", userID, err)
+		return
+	}
+
+	link := appURL() + "/reset-password?token=" + url.QueryEscape(token)
+	err = h.mailer.Send(context.Background(), mail.Message{
+		To:      address,
+		Subject: "Восстановление пароля",
+		Body: fmt.Sprintf("Здравствуйте, %s!\n\n"+
+			"Чтобы задать новый пароль, перейдите по ссылке:\n%s\n\n"+
+			"Ссылка действует %d минут и сработает один раз.\n"+
+			"Если вы не запрашивали восстановление, просто проигнорируйте это письмо.",
+			username, link, int(passwordResetTTL.Minutes())),
+	})
+	if err != nil {
+		log.Printf("sending password reset to user %d: %v", userID, err)
+	}
+}
+
+// ResetPassword sets a new password with a token from the email. All of
+// the user's sessions end, so whoever knew the old password is logged out.
+func (h *AuthHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if r.Header.Get("Content-Type") == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.Token = r.FormValue("token")
+		req.Password = r.FormValue("password")
+	}
+	if req.Token == "" {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var tokenID, userID int
+	var username, email string
+	err = tx.QueryRow(`
+		SELECT t.id, u.id, u.username, u.email
+		FROM password_reset_tokens t
+		JOIN users u ON t.user_id = u.id
+		WHERE t.token_hash = $1 AND t.used_at IS NULL AND t.expires_at > CURRENT_TIMESTAMP
+		FOR UPDATE OF t`, hashResetToken(req.Token)).Scan(&tokenID, &userID, &username, &email)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := password.Validate(req.Password, username, email); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	hash, err := password.Hash(req.Password)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE users SET password_hash = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2`, hash, userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Spend this token and any other outstanding ones
+	_, err = tx.Exec(`
+		UPDATE password_reset_tokens SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND used_at IS NULL`, userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := h.sessions.RevokeAll(userID, "", session.ReasonPasswordChange); err != nil {
+		log.Printf("revoking sessions of user %d after password reset: %v", userID, err)
+	}
+	if _, err := h.apiTokens.RevokeAll(userID); err != nil {
+		log.Printf("revoking API tokens of user %d after password reset: %v", userID, err)
+	}
+	session.ClearCookies(w)
+	// A lockout shouldn't outlast proof of owning the mailbox
+	h.clearLoginFailures(userID)
+
+	go func() {
+		err := h.mailer.Send(context.Background(), mail.Message{
+			To:      email,
+			Subject: "Пароль изменён",
+			Body: fmt.Sprintf("Здравствуйте, %s!\n\n"+
+				"Пароль вашей учётной записи был изменён, все сеансы завершены.\n"+
+				"Если это были не вы, немедленно восстановите пароль: %s/forgot-password",
+				username, appURL()),
+		})
+		if err != nil {
+			log.Printf("sending password change notice to user %d: %v", userID, err)
+		}
+	}()
+
+	if r.Header.Get("Content-Type") == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Password has been reset. Please log in again.",
+		})
+		return
+	}
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// secretToken returns 32 bytes from crypto/rand, base64url-encoded, for
+// anything whose value alone grants access: reset links, login challenges
+// and pending OAuth signups.
+func secretToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -7,8 +7,10 @@ import (
         "fmt"
         "html/template"
         "license_keys_shop/internal/database"
-        "license_keys_shop/internal/middleware"
         "license_keys_shop/internal/models"
+        "license_keys_shop/internal/money"
+        "license_keys_shop/internal/rates"
+        "license_keys_shop/internal/rbac"
         "net/http"
         "strconv"
 
@@ -17,12 +19,14 @@ import (
 
 type ProductHandler struct {
         db        *database.DB
+        rates     rates.ExchangeRateProvider
         templates *template.Template
 }
 
-func NewProductHandler(db *database.DB, templates *template.Template) *ProductHandler {
+func NewProductHandler(db *database.DB, rates rates.ExchangeRateProvider, templates *template.Template) *ProductHandler {
         return &ProductHandler{
                 db:        db,
+                rates:     rates,
                 templates: templates,
         }
 }
@@ -30,12 +34,14 @@ func NewProductHandler(db *database.DB, templates *template.Template) *ProductHa
 func (h *ProductHandler) GetProducts(w http.ResponseWriter, r *http.Request) {
         filter := h.parseFilter(r)
         
+        onSale := r.URL.Query().Get("on_sale") == "1" || r.URL.Query().Get("on_sale") == "true"
+
         query := `
-                SELECT p.id, p.title, p.description, p.price, p.category_id, p.is_sold, 
-                       p.image_url, p.created_at, p.updated_at,
-                       c.name as category_name, c.slug as category_slug
+                SELECT p.id, p.title, p.description, ` + effectivePrice + `, p.category_id, p.is_sold,
+                       p.image_url, p.created_at, p.updated_at, p.is_bundle,
+                       c.name as category_name, c.slug as category_slug, ` + saleColumns + `
                 FROM products p
-                LEFT JOIN categories c ON p.category_id = c.id
+                LEFT JOIN categories c ON p.category_id = c.id` + activeSaleJoin + `
                 WHERE 1=1`
         
         args := []interface{}{}
@@ -55,17 +61,21 @@ func (h *ProductHandler) GetProducts(w http.ResponseWriter, r *http.Request) {
 
         if filter.MinPrice != nil {
                 argCount++
-                query += fmt.Sprintf(" AND p.price >= $%d", argCount)
+                query += fmt.Sprintf(" AND "+effectivePrice+" >= $%d", argCount)
                 args = append(args, *filter.MinPrice)
         }
 
         if filter.MaxPrice != nil {
                 argCount++
-                query += fmt.Sprintf(" AND p.price <= $%d", argCount)
+                query += fmt.Sprintf(" AND "+effectivePrice+" <= $%d", argCount)
                 args = append(args, *filter.MaxPrice)
         }
 
-        query += " AND p.is_sold = FALSE ORDER BY p.created_at DESC"
+        if onSale {
+                query += " AND sale.id IS NOT NULL"
+        }
+
+        query += " AND NOT " + soldExpr + " ORDER BY p.created_at DESC"
 
         if filter.Limit > 0 {
                 argCount++
@@ -86,19 +96,26 @@ func (h *ProductHandler) GetProducts(w http.ResponseWriter, r *http.Request) {
         }
         defer rows.Close()
 
-        var products []models.Product
+        currency := requestCurrency(r, h.db)
+
+        var products []models.CatalogProduct
         for rows.Next() {
-                var p models.Product
+                var p models.CatalogProduct
                 var categoryName, categorySlug sql.NullString
-                
+                var sale saleScan
+
                 err := rows.Scan(
                         &p.ID, &p.Title, &p.Description, &p.Price, &p.CategoryID,
-                        &p.IsSold, &p.ImageURL, &p.CreatedAt, &p.UpdatedAt,
-                        &categoryName, &categorySlug)
+                        &p.IsSold, &p.ImageURL, &p.CreatedAt, &p.UpdatedAt, &p.IsBundle,
+                        &categoryName, &categorySlug,
+                        &sale.id, &sale.oldPrice, &sale.salePrice, &sale.startsAt, &sale.endsAt)
                 if err != nil {
                         continue
                 }
 
+                p.Sale = sale.sale(p.ID)
+                setCatalogCurrency(h.rates, &p, currency)
+
                 if categoryName.Valid {
                         p.Category = &models.Category{
                                 ID:   p.CategoryID,
@@ -107,8 +124,11 @@ func (h *ProductHandler) GetProducts(w http.ResponseWriter, r *http.Request) {
                         }
                 }
 
-                // Load tags for each product
+                // Load tags and bundle contents for each product
                 p.Tags = h.getProductTags(p.ID)
+                if p.IsBundle {
+                        p.Components = getBundleComponents(h.db, p.ID)
+                }
                 products = append(products, p)
         }
 
@@ -128,6 +148,8 @@ func (h *ProductHandler) GetProducts(w http.ResponseWriter, r *http.Request) {
                 "Categories": categories,
                 "Tags":       tags,
                 "Filter":     filter,
+                "OnSale":     onSale,
+                "Currency":   currency,
         }
 
         h.templates.ExecuteTemplate(w, "products.html", data)
@@ -141,19 +163,21 @@ func (h *ProductHandler) GetProduct(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
-        var p models.Product
+        var p models.CatalogProduct
         var categoryName, categorySlug sql.NullString
-        
+        var sale saleScan
+
         err = h.db.QueryRow(`
-                SELECT p.id, p.title, p.description, p.price, p.category_id, p.is_sold,
-                       p.image_url, p.created_at, p.updated_at,
-                       c.name as category_name, c.slug as category_slug
+                SELECT p.id, p.title, p.description, ` + effectivePrice + `, p.category_id, ` + soldExpr + `,
+                       p.image_url, p.created_at, p.updated_at, p.is_bundle,
+                       c.name as category_name, c.slug as category_slug, ` + saleColumns + `
                 FROM products p
-                LEFT JOIN categories c ON p.category_id = c.id
+                LEFT JOIN categories c ON p.category_id = c.id` + activeSaleJoin + `
                 WHERE p.id = $1`, id).Scan(
                 &p.ID, &p.Title, &p.Description, &p.Price, &p.CategoryID,
-                &p.IsSold, &p.ImageURL, &p.CreatedAt, &p.UpdatedAt,
-                &categoryName, &categorySlug)
+                &p.IsSold, &p.ImageURL, &p.CreatedAt, &p.UpdatedAt, &p.IsBundle,
+                &categoryName, &categorySlug,
+                &sale.id, &sale.oldPrice, &sale.salePrice, &sale.startsAt, &sale.endsAt)
 
         if err == sql.ErrNoRows {
                 http.Error(w, "Product not found", http.StatusNotFound)
@@ -172,7 +196,12 @@ func (h *ProductHandler) GetProduct(w http.ResponseWriter, r *http.Request) {
                 }
         }
 
+        p.Sale = sale.sale(p.ID)
+        setCatalogCurrency(h.rates, &p, requestCurrency(r, h.db))
         p.Tags = h.getProductTags(p.ID)
+        if p.IsBundle {
+                p.Components = getBundleComponents(h.db, p.ID)
+        }
 
         if r.Header.Get("Accept") == "application/json" {
                 w.Header().Set("Content-Type", "application/json")
@@ -194,11 +223,22 @@ func (h *ProductHandler) CreateProduct(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
-        var p models.Product
+        user, ok := currentUser(r)
+        if !ok || !can(h.db, user, rbac.PermProductsManage) {
+                http.Error(w, "Access denied", http.StatusForbidden)
+                return
+        }
+
+        var p models.CatalogProduct
         if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
                 http.Error(w, "Invalid JSON", http.StatusBadRequest)
                 return
         }
+        if p.Price.IsNegative() {
+                http.Error(w, "Price must not be negative", http.StatusBadRequest)
+                return
+        }
+        p.Currency = money.Base
 
         err := h.db.QueryRow(`
                 INSERT INTO products (title, description, price, category_id, license_key, image_url)
@@ -221,6 +261,12 @@ func (h *ProductHandler) UpdateProduct(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
+        user, ok := currentUser(r)
+        if !ok || !can(h.db, user, rbac.PermProductsManage) {
+                http.Error(w, "Access denied", http.StatusForbidden)
+                return
+        }
+
         vars := mux.Vars(r)
         id, err := strconv.Atoi(vars["id"])
         if err != nil {
@@ -228,11 +274,16 @@ func (h *ProductHandler) UpdateProduct(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
-        var p models.Product
+        var p models.CatalogProduct
         if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
                 http.Error(w, "Invalid JSON", http.StatusBadRequest)
                 return
         }
+        if p.Price.IsNegative() {
+                http.Error(w, "Price must not be negative", http.StatusBadRequest)
+                return
+        }
+        p.Currency = money.Base
 
         _, err = h.db.Exec(`
                 UPDATE products 
@@ -257,6 +308,12 @@ func (h *ProductHandler) DeleteProduct(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
+        user, ok := currentUser(r)
+        if !ok || !can(h.db, user, rbac.PermProductsManage) {
+                http.Error(w, "Access denied", http.StatusForbidden)
+                return
+        }
+
         vars := mux.Vars(r)
         id, err := strconv.Atoi(vars["id"])
         if err != nil {
@@ -380,8 +437,8 @@ func (h *ProductHandler) getTags() []models.Tag {
 }
 
 func (h *ProductHandler) ShowAdminProducts(w http.ResponseWriter, r *http.Request) {
-        user, ok := middleware.GetUserFromContext(r.Context())
-        if !ok || !user.IsAdmin {
+        user, ok := currentUser(r)
+        if !ok || !can(h.db, user, rbac.PermProductsManage) {
                 http.Error(w, "Access denied", http.StatusForbidden)
                 return
         }
@@ -400,9 +457,9 @@ func (h *ProductHandler) ShowAdminProducts(w http.ResponseWriter, r *http.Reques
         }
         defer rows.Close()
 
-        var products []models.Product
+        var products []models.CatalogProduct
         for rows.Next() {
-                var p models.Product
+                var p models.CatalogProduct
                 var categoryName sql.NullString
                 
                 rows.Scan(&p.ID, &p.Title, &p.Description, &p.Price, &p.CategoryID,
@@ -0,0 +1,412 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"license_keys_shop/internal/database"
+	"license_keys_shop/internal/models"
+	"license_keys_shop/internal/money"
+	"license_keys_shop/internal/promo"
+	"license_keys_shop/internal/rbac"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// queryer is satisfied by both *database.DB and *sql.Tx.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type PromoHandler struct {
+	db        *database.DB
+	templates *template.Template
+}
+
+func NewPromoHandler(db *database.DB, templates *template.Template) *PromoHandler {
+	return &PromoHandler{
+		db:        db,
+		templates: templates,
+	}
+}
+
+func (h *PromoHandler) CreatePromoCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok || !can(h.db, user, rbac.PermPromoManage) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	var c promo.Code
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	c.Code = promo.Normalize(c.Code)
+	if c.Code == "" {
+		http.Error(w, "Code is required", http.StatusBadRequest)
+		return
+	}
+	if c.Type != promo.Percent && c.Type != promo.Fixed {
+		http.Error(w, "Discount type must be percent or fixed", http.StatusBadRequest)
+		return
+	}
+	if !c.Value.IsPositive() || (c.Type == promo.Percent && money.MustParse("100", money.Base).LessThan(c.Value)) {
+		http.Error(w, "Invalid discount value", http.StatusBadRequest)
+		return
+	}
+	if c.StartsAt != nil && c.EndsAt != nil && !c.EndsAt.After(*c.StartsAt) {
+		http.Error(w, "ends_at must be after starts_at", http.StatusBadRequest)
+		return
+	}
+
+	productID, err := nullableID(c.ProductID)
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+	categoryID, err := nullableID(c.CategoryID)
+	if err != nil {
+		http.Error(w, "Invalid category ID", http.StatusBadRequest)
+		return
+	}
+
+	err = h.db.QueryRow(`
+		INSERT INTO promo_codes (code, discount_type, value, min_total, product_id, category_id,
+		                         max_uses, max_uses_per_user, stackable, starts_at, ends_at, is_active)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, TRUE)
+		ON CONFLICT (code) DO NOTHING
+		RETURNING id`,
+		c.Code, c.Type, c.Value, c.MinTotal, productID, categoryID,
+		c.MaxUses, c.MaxUsesPerUser, c.Stackable, c.StartsAt, c.EndsAt).Scan(&c.ID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Promo code already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("creating promo code %s: %v", c.Code, err)
+		http.Error(w, "Failed to create promo code", http.StatusInternalServerError)
+		return
+	}
+
+	c.IsActive = true
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+func (h *PromoHandler) DeactivatePromoCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok || !can(h.db, user, rbac.PermPromoManage) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid promo code ID", http.StatusBadRequest)
+		return
+	}
+
+	// Codes are deactivated rather than deleted so redemptions keep their history
+	res, err := h.db.Exec("UPDATE promo_codes SET is_active = FALSE WHERE id = $1", id)
+	if err != nil {
+		http.Error(w, "Failed to deactivate promo code", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Promo code not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ApplyPromoCode attaches a code to the user's cart after checking that it is
+// valid for the current cart and combinable with the codes already applied.
+func (h *PromoHandler) ApplyPromoCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	code := promo.Normalize(r.FormValue("code"))
+	if code == "" {
+		http.Error(w, "Code is required", http.StatusBadRequest)
+		return
+	}
+
+	c, err := findPromoCode(h.db, code)
+	if err == promo.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	applied, err := loadCartPromoCodes(h.db, user.ID, false)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	lines, err := loadCartPromoLines(h.db, user.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	codes := append(applied, c)
+	breakdown, err := priceWithPromoCodes(h.db, user.ID, lines, codes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	_, err = h.db.Exec(`
+		INSERT INTO cart_promo_codes (user_id, promo_code_id) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`, user.ID, c.ID)
+	if err != nil {
+		http.Error(w, "Failed to apply promo code", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Header.Get("Accept") == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(breakdown)
+		return
+	}
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+func (h *PromoHandler) RemovePromoCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	code := promo.Normalize(r.FormValue("code"))
+	_, err := h.db.Exec(`
+		DELETE FROM cart_promo_codes
+		WHERE user_id = $1 AND promo_code_id = (SELECT id FROM promo_codes WHERE code = $2)`,
+		user.ID, code)
+	if err != nil {
+		http.Error(w, "Failed to remove promo code", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Header.Get("Accept") == "application/json" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+const promoCodeColumns = `
+	pc.id, pc.code, pc.discount_type, pc.value, pc.min_total, pc.product_id, pc.category_id,
+	pc.max_uses, pc.max_uses_per_user, pc.used_count, pc.stackable, pc.starts_at, pc.ends_at, pc.is_active`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPromoCode(row rowScanner) (promo.Code, error) {
+	var c promo.Code
+	var productID, categoryID, maxUses, maxUsesPerUser sql.NullInt64
+	var startsAt, endsAt sql.NullTime
+
+	err := row.Scan(&c.ID, &c.Code, &c.Type, &c.Value, &c.MinTotal, &productID, &categoryID,
+		&maxUses, &maxUsesPerUser, &c.UsedCount, &c.Stackable, &startsAt, &endsAt, &c.IsActive)
+	if err != nil {
+		return c, err
+	}
+
+	if productID.Valid {
+		c.ProductID = strconv.FormatInt(productID.Int64, 10)
+	}
+	if categoryID.Valid {
+		c.CategoryID = strconv.FormatInt(categoryID.Int64, 10)
+	}
+	if maxUses.Valid {
+		n := int(maxUses.Int64)
+		c.MaxUses = &n
+	}
+	if maxUsesPerUser.Valid {
+		n := int(maxUsesPerUser.Int64)
+		c.MaxUsesPerUser = &n
+	}
+	if startsAt.Valid {
+		c.StartsAt = &startsAt.Time
+	}
+	if endsAt.Valid {
+		c.EndsAt = &endsAt.Time
+	}
+	return c, nil
+}
+
+func findPromoCode(q queryer, code string) (promo.Code, error) {
+	c, err := scanPromoCode(q.QueryRow(`
+		SELECT`+promoCodeColumns+`
+		FROM promo_codes pc WHERE pc.code = $1`, code))
+	if err == sql.ErrNoRows {
+		return c, promo.ErrNotFound
+	}
+	return c, err
+}
+
+// loadCartPromoCodes returns the codes applied to the user's cart. Checkout
+// passes lock=true so concurrent orders can't overrun a code's usage limit.
+func loadCartPromoCodes(q queryer, userID int, lock bool) ([]promo.Code, error) {
+	query := `
+		SELECT` + promoCodeColumns + `
+		FROM cart_promo_codes cpc
+		JOIN promo_codes pc ON cpc.promo_code_id = pc.id
+		WHERE cpc.user_id = $1
+		ORDER BY cpc.created_at`
+	if lock {
+		query += " FOR UPDATE OF pc"
+	}
+
+	rows, err := q.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var codes []promo.Code
+	for rows.Next() {
+		c, err := scanPromoCode(rows)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, c)
+	}
+	return codes, rows.Err()
+}
+
+func loadCartPromoLines(q queryer, userID int) ([]promo.Line, error) {
+	rows, err := q.Query(`
+		SELECT ci.product_id, p.category_id, `+effectivePrice+`, ci.quantity
+		FROM cart_items ci
+		JOIN products p ON ci.product_id = p.id`+activeSaleJoin+`
+		WHERE ci.user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []promo.Line
+	for rows.Next() {
+		var productID, quantity int
+		var categoryID sql.NullInt64
+		var price money.Money
+		if err := rows.Scan(&productID, &categoryID, &price, &quantity); err != nil {
+			return nil, err
+		}
+		lines = append(lines, promoLine(productID, categoryID, price, quantity))
+	}
+	return lines, rows.Err()
+}
+
+func promoLine(productID int, categoryID sql.NullInt64, price money.Money, quantity int) promo.Line {
+	l := promo.Line{
+		ProductID: strconv.Itoa(productID),
+		UnitPrice: price,
+		Quantity:  quantity,
+	}
+	if categoryID.Valid {
+		l.CategoryID = strconv.FormatInt(categoryID.Int64, 10)
+	}
+	return l
+}
+
+// priceWithPromoCodes validates every code for this user and cart and
+// returns the resulting breakdown.
+func priceWithPromoCodes(q queryer, userID int, lines []promo.Line, codes []promo.Code) (promo.Breakdown, error) {
+	now := time.Now()
+	for _, c := range codes {
+		var uses int
+		err := q.QueryRow(`
+			SELECT COUNT(*) FROM promo_redemptions
+			WHERE promo_code_id = $1 AND user_id = $2`, c.ID, userID).Scan(&uses)
+		if err != nil {
+			return promo.Breakdown{}, err
+		}
+		if err := promo.Validate(c, lines, uses, now); err != nil {
+			return promo.Breakdown{}, fmt.Errorf("%s: %w", c.Code, err)
+		}
+	}
+	return promo.Apply(lines, codes)
+}
+
+func promoCodeList(codes []promo.Code) string {
+	names := make([]string, 0, len(codes))
+	for _, c := range codes {
+		names = append(names, c.Code)
+	}
+	return strings.Join(names, ",")
+}
+
+func nullableID(id string) (interface{}, error) {
+	if id == "" {
+		return nil, nil
+	}
+	return strconv.Atoi(id)
+}
+
+// cartBreakdown prices the user's saved cart with its applied codes. A code
+// that stopped being valid is reported instead of failing the whole page.
+func cartBreakdown(q queryer, userID int, items []models.CartItem) (promo.Breakdown, error) {
+	lines := make([]promo.Line, 0, len(items))
+	for _, item := range items {
+		categoryID := sql.NullInt64{Int64: int64(item.Product.CategoryID), Valid: item.Product.CategoryID != 0}
+		lines = append(lines, promoLine(item.ProductID, categoryID, item.UnitPrice, item.Quantity))
+	}
+
+	codes, err := loadCartPromoCodes(q, userID, false)
+	if err != nil {
+		return promo.Apply(lines, nil)
+	}
+
+	b, err := priceWithPromoCodes(q, userID, lines, codes)
+	if err != nil {
+		plain, _ := promo.Apply(lines, nil)
+		return plain, err
+	}
+	return b, nil
+}
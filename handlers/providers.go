@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"license_keys_shop/internal/database"
+	"license_keys_shop/internal/ids"
+	"license_keys_shop/internal/ledger"
+	"license_keys_shop/internal/money"
+	"license_keys_shop/internal/sbp"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// balancePaymentMethod pays from the user's wallet.
+const balancePaymentMethod = "balance"
+
+// PaymentIntent is what a provider is asked to collect for an order.
+type PaymentIntent struct {
+	OrderID int
+	UserID  int
+	Amount  money.Money // total in money.Base
+}
+
+// RefundIntent is money to give back for an order.
+type RefundIntent struct {
+	OrderID int
+	UserID  int
+	Amount  money.Money // in money.Base
+	Charged money.Money // Amount in the currency the order was paid in
+	Reason  string
+}
+
+// PaymentProvider collects the money for an order. Providers that settle at
+// once, like the balance, do it inside the order's transaction; the others
+// only start a payment that processPayment finishes later.
+type PaymentProvider interface {
+	Charge(tx *sql.Tx, p PaymentIntent) (settled bool, err error)
+	// Refund sends money back the way it came and returns the provider's
+	// reference for the refund.
+	Refund(tx *sql.Tx, r RefundIntent) (reference string, err error)
+}
+
+// balanceProvider debits the wallet in the same transaction that creates
+// the order, so either both happen or neither does.
+type balanceProvider struct{}
+
+func (balanceProvider) Charge(tx *sql.Tx, p PaymentIntent) (bool, error) {
+	if p.Amount.IsZero() {
+		// Fully discounted; nothing to debit
+		return true, nil
+	}
+	if _, err := ledger.PayOrder(tx, p.UserID, p.OrderID, p.Amount); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (balanceProvider) Refund(tx *sql.Tx, r RefundIntent) (string, error) {
+	return refundToBalance(tx, r)
+}
+
+func refundToBalance(tx *sql.Tx, r RefundIntent) (string, error) {
+	id, err := ledger.RefundOrder(tx, r.UserID, r.OrderID, r.Amount,
+		fmt.Sprintf("Refund for order #%d: %s", r.OrderID, r.Reason))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("ledger:%d", id), nil
+}
+
+// gatewayProvider stands in for the external card, MIR and crypto gateways.
+type gatewayProvider struct{}
+
+func (gatewayProvider) Charge(tx *sql.Tx, p PaymentIntent) (bool, error) {
+	return false, nil
+}
+
+// Refund is simulated like the payment itself; a real gateway would be
+// asked to reverse Charged here.
+func (gatewayProvider) Refund(tx *sql.Tx, r RefundIntent) (string, error) {
+	return ids.WithPrefix("refund"), nil
+}
+
+// simulateGateway stands in for waiting on a card or MIR gateway: it takes
+// a few seconds and succeeds nine times out of ten.
+func simulateGateway() bool {
+	time.Sleep(time.Duration(rand.Intn(5)+3) * time.Second)
+	return rand.Float32() < 0.9
+}
+
+// paymentWatcher is implemented by providers that can tell when a started
+// payment settles; for the others processPayment simulates the gateway.
+type paymentWatcher interface {
+	Await(orderID int) (paid bool, err error)
+}
+
+// paymentCanceller is implemented by providers that must withdraw a
+// started payment when its order expires.
+type paymentCanceller interface {
+	Cancel(tx *sql.Tx, orderID int) error
+}
+
+// unavailableProvider stands for a payment method that isn't configured,
+// so picking it fails instead of falling through to gatewayProvider.
+type unavailableProvider struct{}
+
+var errMethodUnavailable = errors.New("payment method is not available")
+
+func (unavailableProvider) Charge(tx *sql.Tx, p PaymentIntent) (bool, error) {
+	return false, errMethodUnavailable
+}
+
+func (unavailableProvider) Refund(tx *sql.Tx, r RefundIntent) (string, error) {
+	return "", errMethodUnavailable
+}
+
+// defaultPaymentProviders exits when Bitcoin payments are half configured:
+// guessing what was meant could take payments nobody can verify.
+func defaultPaymentProviders(db *database.DB) map[string]PaymentProvider {
+	providers := map[string]PaymentProvider{
+		balancePaymentMethod: balanceProvider{},
+		sbpPaymentMethod:     newSBPProvider(db),
+		bitcoinPaymentMethod: unavailableProvider{},
+	}
+	btc, err := newBitcoinProvider(db)
+	switch {
+	case err != nil:
+		log.Fatalf("bitcoin: %v", err)
+	case btc == nil:
+		log.Print("bitcoin: BTC_XPUB and BTC_ESPLORA_URL not set, Bitcoin payments disabled")
+	default:
+		providers[bitcoinPaymentMethod] = btc
+	}
+	return providers
+}
+
+func (h *OrderHandler) provider(method string) PaymentProvider {
+	if p, ok := h.providers[method]; ok {
+		return p
+	}
+	return gatewayProvider{}
+}
+
+// chargeOrder hands a new order to its provider inside tx. A settled order
+// gets its keys and is completed before tx commits.
+func (h *OrderHandler) chargeOrder(tx *sql.Tx, method string, p PaymentIntent) (bool, error) {
+	settled, err := h.provider(method).Charge(tx, p)
+	if err != nil || !settled {
+		return false, err
+	}
+	if err := assignOrderKeys(tx, p.OrderID); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("UPDATE orders SET payment_status = 'completed' WHERE id = $1", p.OrderID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func writeChargeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ledger.ErrInsufficientFunds):
+		http.Error(w, "Insufficient balance", http.StatusPaymentRequired)
+	case errors.Is(err, errKeyUnavailable):
+		http.Error(w, "License key is no longer available", http.StatusConflict)
+	case errors.Is(err, errMethodUnavailable):
+		http.Error(w, "Payment method is not available", http.StatusUnprocessableEntity)
+	case errors.Is(err, sbp.ErrNotRubles):
+		http.Error(w, "SBP payments are in rubles only", http.StatusUnprocessableEntity)
+	default:
+		http.Error(w, "Payment failed", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,438 @@
+package handlers
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"license_keys_shop/internal/database"
+	"license_keys_shop/internal/rbac"
+	"license_keys_shop/internal/reconcile"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const maxStatementSize = 20 << 20
+
+var errNoPeriod = errors.New("statement period is required: pass from and to or include settled_at")
+
+type ReconciliationHandler struct {
+	db        *database.DB
+	templates *template.Template
+}
+
+func NewReconciliationHandler(db *database.DB, templates *template.Template) *ReconciliationHandler {
+	return &ReconciliationHandler{
+		db:        db,
+		templates: templates,
+	}
+}
+
+// ReconciliationSummary is a stored report without its discrepancy lists.
+type ReconciliationSummary struct {
+	ID         int       `json:"id"`
+	Provider   string    `json:"provider"`
+	SourceName string    `json:"source_name"`
+	PeriodFrom string    `json:"period_from"`
+	PeriodTo   string    `json:"period_to"`
+	Entries    int       `json:"entries"`
+	Records    int       `json:"records"`
+	Matched    int       `json:"matched"`
+	Missing    int       `json:"missing"`
+	Mismatched int       `json:"mismatched"`
+	Orphaned   int       `json:"orphaned"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// statementPeriod is the days a statement covers, to inclusive.
+type statementPeriod struct {
+	from, to time.Time
+}
+
+// UploadStatement takes a provider statement as the multipart file
+// "statement" together with the provider (the payment method it settles),
+// optionally the format and the period (from, to as YYYY-MM-DD). Without a
+// period the settled_at dates of the entries are used.
+func (h *ReconciliationHandler) UploadStatement(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	admin, ok := currentUser(r)
+	if !ok || !can(h.db, admin, rbac.PermFinanceReconcile) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxStatementSize)
+	if err := r.ParseMultipartForm(maxStatementSize); err != nil {
+		http.Error(w, "Invalid upload", http.StatusBadRequest)
+		return
+	}
+
+	provider := strings.TrimSpace(r.FormValue("provider"))
+	if provider == "" || provider == balancePaymentMethod {
+		http.Error(w, "Provider must be an external payment method", http.StatusBadRequest)
+		return
+	}
+
+	file, header, err := r.FormFile("statement")
+	if err != nil {
+		http.Error(w, "Statement file is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	entries, err := readStatement(file, header.Filename, r.FormValue("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	period, err := parsePeriod(r.FormValue("from"), r.FormValue("to"), entries)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	adminID := admin.ID
+	id, report, err := h.reconcile(provider, header.Filename, entries, period, &adminID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":          id,
+		"provider":    provider,
+		"period_from": period.from.Format("2006-01-02"),
+		"period_to":   period.to.Format("2006-01-02"),
+		"clean":       report.Clean(),
+		"report":      report,
+	})
+}
+
+// ReconcileFile reconciles a statement on disk, for scheduled jobs that
+// download statements from the provider. The period comes from the
+// entries' settled_at dates.
+func (h *ReconciliationHandler) ReconcileFile(path, provider string) (int, *reconcile.Report, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	entries, err := readStatement(f, filepath.Base(path), "")
+	if err != nil {
+		return 0, nil, err
+	}
+	period, err := parsePeriod("", "", entries)
+	if err != nil {
+		return 0, nil, err
+	}
+	return h.reconcile(provider, filepath.Base(path), entries, period, nil)
+}
+
+// ListReports lists stored reports, newest first, optionally for one
+// provider.
+func (h *ReconciliationHandler) ListReports(w http.ResponseWriter, r *http.Request) {
+	admin, ok := currentUser(r)
+	if !ok || !can(h.db, admin, rbac.PermFinanceReconcile) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	const perPage = 50
+	page := 1
+	if p, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && p > 0 {
+		page = p
+	}
+
+	rows, err := h.db.Query(`
+		SELECT id, provider, source_name, period_from, period_to, entries_count, records_count,
+		       matched_count, missing_count, mismatched_count, orphaned_count, created_at
+		FROM reconciliation_reports
+		WHERE $1 = '' OR provider = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2 OFFSET $3`, r.URL.Query().Get("provider"), perPage, (page-1)*perPage)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	reports := []ReconciliationSummary{}
+	for rows.Next() {
+		var s ReconciliationSummary
+		var from, to time.Time
+		err := rows.Scan(&s.ID, &s.Provider, &s.SourceName, &from, &to, &s.Entries, &s.Records,
+			&s.Matched, &s.Missing, &s.Mismatched, &s.Orphaned, &s.CreatedAt)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		s.PeriodFrom, s.PeriodTo = from.Format("2006-01-02"), to.Format("2006-01-02")
+		reports = append(reports, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"page":    page,
+		"reports": reports,
+	})
+}
+
+// GetReport returns one stored report with its discrepancies.
+func (h *ReconciliationHandler) GetReport(w http.ResponseWriter, r *http.Request) {
+	admin, ok := currentUser(r)
+	if !ok || !can(h.db, admin, rbac.PermFinanceReconcile) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["reportId"])
+	if err != nil {
+		http.Error(w, "Invalid report ID", http.StatusBadRequest)
+		return
+	}
+
+	var s ReconciliationSummary
+	var from, to time.Time
+	var report []byte
+	err = h.db.QueryRow(`
+		SELECT id, provider, source_name, period_from, period_to, entries_count, records_count,
+		       matched_count, missing_count, mismatched_count, orphaned_count, created_at, report
+		FROM reconciliation_reports WHERE id = $1`, id).Scan(
+		&s.ID, &s.Provider, &s.SourceName, &from, &to, &s.Entries, &s.Records,
+		&s.Matched, &s.Missing, &s.Mismatched, &s.Orphaned, &s.CreatedAt, &report)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	s.PeriodFrom, s.PeriodTo = from.Format("2006-01-02"), to.Format("2006-01-02")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"summary": s,
+		"report":  json.RawMessage(report),
+	})
+}
+
+func readStatement(r io.Reader, name, format string) ([]reconcile.Entry, error) {
+	br := bufio.NewReader(r)
+	f, ok := reconcile.ParseFormat(format)
+	if !ok {
+		if format != "" {
+			return nil, fmt.Errorf("%w: unknown format %q", reconcile.ErrInvalidStatement, format)
+		}
+		head, _ := br.Peek(64)
+		f = reconcile.DetectFormat(name, head)
+	}
+	return reconcile.Parse(br, f)
+}
+
+func parsePeriod(from, to string, entries []reconcile.Entry) (statementPeriod, error) {
+	var p statementPeriod
+	if from != "" || to != "" {
+		var err error
+		if p.from, err = time.Parse("2006-01-02", from); err != nil {
+			return p, errors.New("from must be a date as YYYY-MM-DD")
+		}
+		if p.to, err = time.Parse("2006-01-02", to); err != nil {
+			return p, errors.New("to must be a date as YYYY-MM-DD")
+		}
+		if p.to.Before(p.from) {
+			return p, errors.New("to is before from")
+		}
+		return p, nil
+	}
+
+	for _, e := range entries {
+		if e.SettledAt == nil {
+			continue
+		}
+		day := time.Date(e.SettledAt.Year(), e.SettledAt.Month(), e.SettledAt.Day(), 0, 0, 0, 0, time.UTC)
+		if p.from.IsZero() || day.Before(p.from) {
+			p.from = day
+		}
+		if day.After(p.to) {
+			p.to = day
+		}
+	}
+	if p.from.IsZero() {
+		return p, errNoPeriod
+	}
+	return p, nil
+}
+
+// reconcile matches entries against the provider's payments and refunds
+// in the period, plus any older or unpaid ones the statement names, and
+// stores the report.
+func (h *ReconciliationHandler) reconcile(provider, source string, entries []reconcile.Entry, period statementPeriod, adminID *int) (int, *reconcile.Report, error) {
+	records, err := h.periodRecords(provider, period)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	known := make(map[string]bool, len(records))
+	for _, rec := range records {
+		known[rec.TransactionID] = true
+	}
+	for _, e := range entries {
+		if known[e.TransactionID] {
+			continue
+		}
+		known[e.TransactionID] = true
+		rec, err := h.findRecord(provider, e.TransactionID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		records = append(records, rec)
+	}
+
+	report := reconcile.Reconcile(records, entries)
+	data, err := json.Marshal(report)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var id int
+	err = h.db.QueryRow(`
+		INSERT INTO reconciliation_reports (provider, source_name, period_from, period_to,
+		                                    entries_count, records_count, matched_count,
+		                                    missing_count, mismatched_count, orphaned_count,
+		                                    report, admin_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id`,
+		provider, source, period.from.Format("2006-01-02"), period.to.Format("2006-01-02"),
+		report.Entries, report.Records, report.Matched,
+		len(report.Missing), len(report.Mismatched), len(report.Orphaned),
+		string(data), adminID).Scan(&id)
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, report, nil
+}
+
+// periodRecords loads the provider's orders and refunds created in the
+// period. Refunds to the balance never reach the provider.
+func (h *ReconciliationHandler) periodRecords(provider string, period statementPeriod) ([]reconcile.Record, error) {
+	from := period.from.Format("2006-01-02")
+	to := period.to.AddDate(0, 0, 1).Format("2006-01-02")
+
+	rows, err := h.db.Query(`
+		SELECT o.id, o.public_id, o.transaction_id, COALESCE(o.charged_amount, o.total_amount),
+		       o.currency, o.payment_status
+		FROM orders o
+		WHERE o.payment_method = $1 AND o.created_at >= $2::date AND o.created_at < $3::date
+		ORDER BY o.id`, provider, from, to)
+	if err != nil {
+		return nil, err
+	}
+	records, err := scanPaymentRecords(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err = h.db.Query(`
+		SELECT r.order_id, o.public_id, r.provider_reference, r.charged_amount, r.currency
+		FROM refunds r
+		JOIN orders o ON r.order_id = o.id
+		WHERE r.payment_method = $1 AND r.destination = $2
+		  AND r.provider_reference IS NOT NULL
+		  AND r.created_at >= $3::date AND r.created_at < $4::date
+		ORDER BY r.id`, provider, refundDestOriginal, from, to)
+	if err != nil {
+		return nil, err
+	}
+	refunds, err := scanRefundRecords(rows)
+	if err != nil {
+		return nil, err
+	}
+	return append(records, refunds...), nil
+}
+
+// findRecord looks up a statement entry we don't have in the period.
+func (h *ReconciliationHandler) findRecord(provider, transactionID string) (reconcile.Record, error) {
+	rows, err := h.db.Query(`
+		SELECT o.id, o.public_id, o.transaction_id, COALESCE(o.charged_amount, o.total_amount),
+		       o.currency, o.payment_status
+		FROM orders o
+		WHERE o.payment_method = $1 AND o.transaction_id = $2`, provider, transactionID)
+	if err != nil {
+		return reconcile.Record{}, err
+	}
+	records, err := scanPaymentRecords(rows)
+	if err != nil {
+		return reconcile.Record{}, err
+	}
+	if len(records) > 0 {
+		return records[0], nil
+	}
+
+	rows, err = h.db.Query(`
+		SELECT r.order_id, o.public_id, r.provider_reference, r.charged_amount, r.currency
+		FROM refunds r
+		JOIN orders o ON r.order_id = o.id
+		WHERE r.payment_method = $1 AND r.destination = $2 AND r.provider_reference = $3`,
+		provider, refundDestOriginal, transactionID)
+	if err != nil {
+		return reconcile.Record{}, err
+	}
+	records, err = scanRefundRecords(rows)
+	if err != nil {
+		return reconcile.Record{}, err
+	}
+	if len(records) > 0 {
+		return records[0], nil
+	}
+	return reconcile.Record{}, sql.ErrNoRows
+}
+
+func scanPaymentRecords(rows *sql.Rows) ([]reconcile.Record, error) {
+	defer rows.Close()
+	var records []reconcile.Record
+	for rows.Next() {
+		rec := reconcile.Record{Kind: reconcile.Payment}
+		var amount, currency string
+		if err := rows.Scan(&rec.OrderID, &rec.Reference, &rec.TransactionID, &amount, &currency, &rec.Status); err != nil {
+			return nil, err
+		}
+		rec.Amount = scanCharged(amount, currency)
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+func scanRefundRecords(rows *sql.Rows) ([]reconcile.Record, error) {
+	defer rows.Close()
+	var records []reconcile.Record
+	for rows.Next() {
+		rec := reconcile.Record{Kind: reconcile.Refund}
+		var amount, currency string
+		if err := rows.Scan(&rec.OrderID, &rec.Reference, &rec.TransactionID, &amount, &currency); err != nil {
+			return nil, err
+		}
+		rec.Amount = scanCharged(amount, currency)
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
@@ -0,0 +1,396 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"license_keys_shop/internal/models"
+	"license_keys_shop/internal/money"
+	"license_keys_shop/internal/rbac"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Where refunded money goes.
+const (
+	refundDestOriginal = "original"
+	refundDestBalance  = "balance"
+)
+
+// RefundOrder refunds a paid order in full or in part, either through the
+// provider it was paid with or onto the buyer's balance. Keys of the
+// refunded lines are taken back: returned to inventory if the buyer never
+// saw them, revoked otherwise. Without item_ids a full refund takes back
+// every key and a partial one none.
+func (h *OrderHandler) RefundOrder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	admin, ok := currentUser(r)
+	if !ok || !can(h.db, admin, rbac.PermRefundsIssue) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	vars := mux.Vars(r)
+	orderID, err := strconv.Atoi(vars["orderId"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Amount      string `json:"amount"`
+		Destination string `json:"destination"`
+		Reason      string `json:"reason"`
+		ItemIDs     []int  `json:"item_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		http.Error(w, "Reason is required", http.StatusBadRequest)
+		return
+	}
+	if req.Destination == "" {
+		req.Destination = refundDestOriginal
+	}
+	if req.Destination != refundDestOriginal && req.Destination != refundDestBalance {
+		http.Error(w, "Destination must be original or balance", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var total, refunded money.Money
+	var currencyCode, exchangeRate, paymentMethod, status string
+	err = tx.QueryRow(`
+		SELECT user_id, total_amount, refunded_amount, currency, exchange_rate, payment_method, payment_status
+		FROM orders WHERE id = $1 FOR UPDATE`, orderID).Scan(
+		&userID, &total, &refunded, &currencyCode, &exchangeRate, &paymentMethod, &status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if status != "completed" && status != "partially_refunded" {
+		http.Error(w, "Only paid orders can be refunded", http.StatusConflict)
+		return
+	}
+
+	remaining := total.Sub(refunded)
+	if !remaining.IsPositive() {
+		http.Error(w, "Order is already fully refunded", http.StatusConflict)
+		return
+	}
+
+	// The lines being refunded and what the buyer paid for them
+	lines := make(map[int]bool)
+	itemsTotal := money.Zero(money.Base)
+	if len(req.ItemIDs) > 0 {
+		paid, err := paidPerLine(tx, orderID, total)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		for _, id := range req.ItemIDs {
+			share, ok := paid[id]
+			if ok && !lines[id] {
+				lines[id] = true
+				itemsTotal = itemsTotal.Add(share)
+			}
+		}
+		if len(lines) != len(req.ItemIDs) {
+			http.Error(w, "Invalid item list", http.StatusBadRequest)
+			return
+		}
+	}
+
+	amount := remaining
+	switch {
+	case req.Amount != "":
+		amount, err = money.Parse(req.Amount, money.Base)
+		if err != nil || !amount.IsPositive() {
+			http.Error(w, "Invalid amount", http.StatusBadRequest)
+			return
+		}
+		if remaining.LessThan(amount) {
+			http.Error(w, "Amount exceeds what is left to refund ("+remaining.Format()+")", http.StatusBadRequest)
+			return
+		}
+	case len(lines) > 0:
+		amount = money.Min(itemsTotal, remaining)
+	}
+	full := amount.Equal(remaining)
+
+	rate, ok := new(big.Rat).SetString(exchangeRate)
+	currency, known := money.ParseCurrency(currencyCode)
+	if !ok || !known {
+		http.Error(w, "Order has an invalid currency", http.StatusInternalServerError)
+		return
+	}
+	intent := RefundIntent{
+		OrderID: orderID,
+		UserID:  userID,
+		Amount:  amount,
+		Charged: amount.Convert(currency, rate),
+		Reason:  req.Reason,
+	}
+
+	// Take back keys first: if the refund fails, so does this
+	keys, err := takeBackKeys(tx, orderID, lines, full && len(lines) == 0)
+	if err != nil {
+		http.Error(w, "Failed to refund order", http.StatusInternalServerError)
+		return
+	}
+
+	var reference string
+	if req.Destination == refundDestBalance {
+		reference, err = refundToBalance(tx, intent)
+	} else {
+		reference, err = h.provider(paymentMethod).Refund(tx, intent)
+	}
+	if err != nil {
+		http.Error(w, "Refund was not accepted by the payment provider", http.StatusBadGateway)
+		return
+	}
+
+	var refund models.Refund
+	err = tx.QueryRow(`
+		INSERT INTO refunds (order_id, admin_id, amount, currency, charged_amount, destination,
+		                     payment_method, provider_reference, reason)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id, created_at`,
+		orderID, admin.ID, amount, string(currency), intent.Charged.String(), req.Destination,
+		paymentMethod, reference, req.Reason).Scan(&refund.ID, &refund.CreatedAt)
+	if err != nil {
+		http.Error(w, "Failed to refund order", http.StatusInternalServerError)
+		return
+	}
+
+	for _, k := range keys {
+		_, err := tx.Exec(`
+			INSERT INTO refund_keys (refund_id, order_item_key_id, action)
+			VALUES ($1, $2, $3)`, refund.ID, k.keyID, k.Action)
+		if err != nil {
+			http.Error(w, "Failed to refund order", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	newStatus := "partially_refunded"
+	if full {
+		newStatus = "refunded"
+	}
+	_, err = tx.Exec(`
+		UPDATE orders SET refunded_amount = refunded_amount + $1, payment_status = $2
+		WHERE id = $3`, amount, newStatus, orderID)
+	if err != nil {
+		http.Error(w, "Failed to refund order", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to refund order", http.StatusInternalServerError)
+		return
+	}
+
+	refund.OrderID = orderID
+	refund.Amount = amount
+	refund.Charged = models.NewPrice(intent.Charged)
+	refund.Destination = req.Destination
+	refund.Reference = reference
+	refund.Reason = req.Reason
+	for _, k := range keys {
+		refund.Keys = append(refund.Keys, k.RefundedKey)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"refund":          refund,
+		"order_status":    newStatus,
+		"refunded_amount": refunded.Add(amount),
+	})
+}
+
+type takenKey struct {
+	models.RefundedKey
+	keyID int
+}
+
+// paidPerLine splits what the buyer paid for an order across its lines by
+// their list prices, so promo and bundle discounts are shared out and a
+// line is never refunded for more than it cost.
+func paidPerLine(tx *sql.Tx, orderID int, total money.Money) (map[int]money.Money, error) {
+	rows, err := tx.Query(`
+		SELECT id, unit_price, quantity FROM order_items
+		WHERE order_id = $1
+		ORDER BY id`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	var weights []int64
+	for rows.Next() {
+		var id, quantity int
+		var price money.Money
+		if err := rows.Scan(&id, &price, &quantity); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+		weights = append(weights, price.Mul(int64(quantity)).Minor())
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	paid := make(map[int]money.Money, len(ids))
+	for i, share := range total.Allocate(weights) {
+		paid[ids[i]] = share
+	}
+	return paid, nil
+}
+
+// takeBackKeys returns unseen keys of the given order lines (all lines when
+// all is set) to inventory and revokes the rest.
+func takeBackKeys(tx *sql.Tx, orderID int, lines map[int]bool, all bool) ([]takenKey, error) {
+	if len(lines) == 0 && !all {
+		return nil, nil
+	}
+
+	rows, err := tx.Query(`
+		SELECT k.id, k.order_item_id, k.product_id, p.title, k.revealed_at IS NOT NULL,
+		       oi.product_id, lp.is_bundle
+		FROM order_item_keys k
+		JOIN order_items oi ON k.order_item_id = oi.id
+		JOIN products p ON k.product_id = p.id
+		JOIN products lp ON oi.product_id = lp.id
+		WHERE oi.order_id = $1 AND k.status = 'delivered'
+		ORDER BY k.product_id
+		FOR UPDATE OF k`, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []takenKey
+	var bundles []int
+	for rows.Next() {
+		var k takenKey
+		var itemID, lineProductID int
+		var revealed, isBundle bool
+		if err := rows.Scan(&k.keyID, &itemID, &k.ProductID, &k.Title, &revealed, &lineProductID, &isBundle); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if !all && !lines[itemID] {
+			continue
+		}
+		k.Action = "returned"
+		if revealed {
+			k.Action = "revoked"
+		}
+		keys = append(keys, k)
+		if isBundle {
+			bundles = append(bundles, lineProductID)
+		}
+	}
+	rows.Close()
+
+	now := time.Now()
+	for _, k := range keys {
+		_, err := tx.Exec(`
+			UPDATE order_item_keys SET status = $1, revoked_at = $2 WHERE id = $3`,
+			k.Action, now, k.keyID)
+		if err != nil {
+			return nil, err
+		}
+		if k.Action == "returned" {
+			if _, err := tx.Exec("UPDATE products SET is_sold = FALSE WHERE id = $1", k.ProductID); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// A bundle is buyable again once all of its components are (see soldExpr)
+	for _, id := range bundles {
+		if _, err := tx.Exec("UPDATE products SET is_sold = FALSE WHERE id = $1", id); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+func getOrderRefunds(q queryer, orderID int) []models.Refund {
+	rows, err := q.Query(`
+		SELECT id, amount, currency, charged_amount, destination,
+		       COALESCE(provider_reference, ''), reason, created_at
+		FROM refunds
+		WHERE order_id = $1
+		ORDER BY id`, orderID)
+	if err != nil {
+		return []models.Refund{}
+	}
+
+	refunds := []models.Refund{}
+	for rows.Next() {
+		var rf models.Refund
+		var currency, charged string
+		err := rows.Scan(&rf.ID, &rf.Amount, &currency, &charged, &rf.Destination,
+			&rf.Reference, &rf.Reason, &rf.CreatedAt)
+		if err != nil {
+			continue
+		}
+		rf.OrderID = orderID
+		rf.Charged = models.NewPrice(scanCharged(charged, currency))
+		refunds = append(refunds, rf)
+	}
+	rows.Close()
+
+	for i := range refunds {
+		refunds[i].Keys = getRefundedKeys(q, refunds[i].ID)
+	}
+	return refunds
+}
+
+func getRefundedKeys(q queryer, refundID int) []models.RefundedKey {
+	rows, err := q.Query(`
+		SELECT k.product_id, p.title, rk.action
+		FROM refund_keys rk
+		JOIN order_item_keys k ON rk.order_item_key_id = k.id
+		JOIN products p ON k.product_id = p.id
+		WHERE rk.refund_id = $1
+		ORDER BY k.id`, refundID)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var keys []models.RefundedKey
+	for rows.Next() {
+		var k models.RefundedKey
+		if err := rows.Scan(&k.ProductID, &k.Title, &k.Action); err != nil {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
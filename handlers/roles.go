@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"license_keys_shop/internal/models"
+	"license_keys_shop/internal/rbac"
+	"license_keys_shop/internal/session"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	errUserNotFound  = errors.New("user not found")
+	errLastAdmin     = errors.New("the last admin can't lose the admin role")
+	errOwnAdminRole  = errors.New("admins can't take the admin role from themselves")
+	errRoleUnchanged = errors.New("role unchanged")
+)
+
+// can reports whether user holds permission p. A failed lookup denies.
+func can(db rbac.DB, user *models.User, p rbac.Permission) bool {
+	allowed, err := rbac.NewStore(db).Can(user.ID, p)
+	if err != nil {
+		log.Printf("roles of user %d: %v", user.ID, err)
+		return false
+	}
+	return allowed
+}
+
+type roleView struct {
+	Role        rbac.Role         `json:"role"`
+	Permissions []rbac.Permission `json:"permissions"`
+}
+
+// ListRoles describes every role and what it allows.
+func (h *AuthHandler) ListRoles(w http.ResponseWriter, r *http.Request) {
+	admin, ok := currentUser(r)
+	if !ok || !can(h.db, admin, rbac.PermUsersManage) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	roles := []roleView{}
+	for _, role := range rbac.Roles() {
+		roles = append(roles, roleView{Role: role, Permissions: role.Permissions()})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"roles": roles,
+	})
+}
+
+// MyPermissions tells the current user's client what to show them.
+func (h *AuthHandler) MyPermissions(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	h.writeUserRoles(w, user.ID)
+}
+
+// GetUserRoles shows a user's roles and the permissions they add up to.
+func (h *AuthHandler) GetUserRoles(w http.ResponseWriter, r *http.Request) {
+	admin, ok := currentUser(r)
+	if !ok || !can(h.db, admin, rbac.PermUsersManage) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	userID, err := strconv.Atoi(mux.Vars(r)["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	h.writeUserRoles(w, userID)
+}
+
+func (h *AuthHandler) writeUserRoles(w http.ResponseWriter, userID int) {
+	roles, err := h.roles.Roles(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if roles == nil {
+		roles = []rbac.Role{}
+	}
+	perms := rbac.PermissionsOf(roles)
+	if perms == nil {
+		perms = []rbac.Permission{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":     userID,
+		"roles":       roles,
+		"permissions": perms,
+	})
+}
+
+// GrantRole gives a user a role ({"role": "support"}).
+func (h *AuthHandler) GrantRole(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	h.changeRole(w, r, req.Role, true)
+}
+
+// RevokeRole takes a role ({role}) away from a user.
+func (h *AuthHandler) RevokeRole(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h.changeRole(w, r, mux.Vars(r)["role"], false)
+}
+
+func (h *AuthHandler) changeRole(w http.ResponseWriter, r *http.Request, name string, grant bool) {
+	admin, ok := currentUser(r)
+	if !ok || !can(h.db, admin, rbac.PermUsersManage) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	userID, err := strconv.Atoi(mux.Vars(r)["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	role, known := rbac.ParseRole(name)
+	if !known {
+		http.Error(w, "Unknown role", http.StatusBadRequest)
+		return
+	}
+
+	err = h.setRole(userID, role, grant, admin.ID)
+	switch {
+	case errors.Is(err, errUserNotFound):
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	case errors.Is(err, errLastAdmin), errors.Is(err, errOwnAdminRole):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errRoleUnchanged):
+		// Nothing to do, and nothing to log anyone out for
+	case err != nil:
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	default:
+		// Tokens carry is_admin and the user's client caches what it may
+		// show; both are rebuilt at the next login. API tokens were made
+		// for the old roles, so they go too
+		if _, err := h.sessions.RevokeAll(userID, "", session.ReasonRoleChange); err != nil {
+			log.Printf("revoking sessions of user %d after role change: %v", userID, err)
+		}
+		if _, err := h.apiTokens.RevokeAll(userID); err != nil {
+			log.Printf("revoking API tokens of user %d after role change: %v", userID, err)
+		}
+		if grant {
+			log.Printf("user %d granted role %s to user %d", admin.ID, role, userID)
+		} else {
+			log.Printf("user %d revoked role %s from user %d", admin.ID, role, userID)
+		}
+	}
+
+	h.writeUserRoles(w, userID)
+}
+
+// setRole grants or revokes role and keeps users.is_admin in step with the
+// admin role. There is always at least one admin left.
+func (h *AuthHandler) setRole(userID int, role rbac.Role, grant bool, by int) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRow("SELECT id FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return errUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var res sql.Result
+	if grant {
+		res, err = tx.Exec(`
+			INSERT INTO user_roles (user_id, role, granted_by) VALUES ($1, $2, $3)
+			ON CONFLICT DO NOTHING`, userID, string(role), by)
+	} else {
+		if role == rbac.RoleAdmin {
+			if userID == by {
+				return errOwnAdminRole
+			}
+			if err := lockOtherAdmins(tx, userID); err != nil {
+				return err
+			}
+		}
+		res, err = tx.Exec(`
+			DELETE FROM user_roles WHERE user_id = $1 AND role = $2`, userID, string(role))
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errRoleUnchanged
+	}
+
+	if role == rbac.RoleAdmin {
+		_, err := tx.Exec(`
+			UPDATE users SET is_admin = $1, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $2`, grant, userID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// lockOtherAdmins fails unless someone besides userID holds the admin
+// role, and keeps them from losing it until tx ends.
+func lockOtherAdmins(tx *sql.Tx, userID int) error {
+	rows, err := tx.Query(`
+		SELECT user_id FROM user_roles
+		WHERE role = $1 AND user_id <> $2
+		FOR UPDATE`, string(rbac.RoleAdmin), userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	others := 0
+	for rows.Next() {
+		others++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if others == 0 {
+		return errLastAdmin
+	}
+	return nil
+}
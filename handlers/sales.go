@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"license_keys_shop/internal/models"
+	"license_keys_shop/internal/money"
+	"license_keys_shop/internal/rbac"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// activeSaleJoin attaches the currently running sale (if any) of products p
+// as "sale". Queries select effectivePrice in place of p.price.
+const activeSaleJoin = `
+	LEFT JOIN LATERAL (
+		SELECT s.id, s.old_price, s.sale_price, s.starts_at, s.ends_at
+		FROM product_sales s
+		WHERE s.product_id = p.id AND s.starts_at <= NOW() AND s.ends_at > NOW()
+		ORDER BY s.sale_price
+		LIMIT 1
+	) sale ON TRUE`
+
+const effectivePrice = "COALESCE(sale.sale_price, p.price)"
+
+const saleColumns = "sale.id, COALESCE(sale.old_price, p.price), sale.sale_price, sale.starts_at, sale.ends_at"
+
+// saleScan receives saleColumns.
+type saleScan struct {
+	id        sql.NullInt64
+	oldPrice  money.NullMoney
+	salePrice money.NullMoney
+	startsAt  sql.NullTime
+	endsAt    sql.NullTime
+}
+
+func (s *saleScan) sale(productID int) *models.ProductSale {
+	if !s.id.Valid || !s.salePrice.Valid {
+		return nil
+	}
+	return &models.ProductSale{
+		ID:              int(s.id.Int64),
+		ProductID:       productID,
+		OldPrice:        s.oldPrice.Money,
+		SalePrice:       s.salePrice.Money,
+		DiscountPercent: discountPercent(s.oldPrice.Money, s.salePrice.Money),
+		StartsAt:        s.startsAt.Time,
+		EndsAt:          s.endsAt.Time,
+	}
+}
+
+func discountPercent(oldPrice, salePrice money.Money) int {
+	if !oldPrice.IsPositive() || !salePrice.LessThan(oldPrice) {
+		return 0
+	}
+	saved := oldPrice.Sub(salePrice)
+	return int(math.Round(float64(saved.Minor()) / float64(oldPrice.Minor()) * 100))
+}
+
+func (h *ProductHandler) CreateSale(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok || !can(h.db, user, rbac.PermProductsManage) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	vars := mux.Vars(r)
+	productID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		OldPrice  *money.Money `json:"old_price"`
+		SalePrice money.Money  `json:"sale_price"`
+		StartsAt  time.Time    `json:"starts_at"`
+		EndsAt    time.Time    `json:"ends_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	var price money.Money
+	err = h.db.QueryRow("SELECT price FROM products WHERE id = $1", productID).Scan(&price)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	oldPrice := price
+	if req.OldPrice != nil {
+		oldPrice = *req.OldPrice
+	}
+
+	if !req.SalePrice.IsPositive() || !req.SalePrice.LessThan(oldPrice) {
+		http.Error(w, "Sale price must be positive and lower than the old price", http.StatusBadRequest)
+		return
+	}
+	if req.StartsAt.IsZero() {
+		req.StartsAt = time.Now()
+	}
+	if !req.EndsAt.After(req.StartsAt) {
+		http.Error(w, "ends_at must be after starts_at", http.StatusBadRequest)
+		return
+	}
+
+	sale := models.ProductSale{
+		ProductID:       productID,
+		OldPrice:        oldPrice,
+		SalePrice:       req.SalePrice,
+		DiscountPercent: discountPercent(oldPrice, req.SalePrice),
+		StartsAt:        req.StartsAt,
+		EndsAt:          req.EndsAt,
+	}
+
+	err = h.db.QueryRow(`
+		INSERT INTO product_sales (product_id, old_price, sale_price, starts_at, ends_at)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		productID, req.OldPrice, req.SalePrice, req.StartsAt, req.EndsAt).Scan(&sale.ID)
+	if err != nil {
+		http.Error(w, "Failed to create sale", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sale)
+}
+
+func (h *ProductHandler) DeleteSale(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok || !can(h.db, user, rbac.PermProductsManage) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	vars := mux.Vars(r)
+	productID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+	saleID, err := strconv.Atoi(vars["saleId"])
+	if err != nil {
+		http.Error(w, "Invalid sale ID", http.StatusBadRequest)
+		return
+	}
+
+	res, err := h.db.Exec("DELETE FROM product_sales WHERE id = $1 AND product_id = $2", saleID, productID)
+	if err != nil {
+		http.Error(w, "Failed to delete sale", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Sale not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,326 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"license_keys_shop/internal/database"
+	"license_keys_shop/internal/money"
+	"license_keys_shop/internal/qrcode"
+	"license_keys_shop/internal/rbac"
+	"license_keys_shop/internal/sbp"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// sbpPaymentMethod pays through the fast payment system (СБП) by QR code.
+const sbpPaymentMethod = "sbp"
+
+const (
+	sbpPollInterval = 3 * time.Second
+	sbpQRSize       = 320
+)
+
+var errSBPExpired = errors.New("SBP QR code expired unpaid")
+
+// sbpProvider registers a QR code with the bank for every order and
+// watches it until the buyer pays. Until the acquiring bank's API is wired
+// in, the bank is an in-memory stand-in paid through SimulateSBPPayment.
+type sbpProvider struct {
+	db   *database.DB
+	bank sbp.Bank
+	ttl  time.Duration
+}
+
+func newSBPProvider(db *database.DB) *sbpProvider {
+	return &sbpProvider{
+		db:   db,
+		bank: sbp.NewFakeBank(os.Getenv("SBP_BANK_ID")),
+		ttl:  pendingOrderTimeout(),
+	}
+}
+
+// Charge registers the QR code. It expires with the order; if tx rolls
+// back, the bank lets the orphaned code expire the same way.
+func (s *sbpProvider) Charge(tx *sql.Tx, p PaymentIntent) (bool, error) {
+	if p.Amount.IsZero() {
+		// Fully discounted; SBP can't take a zero payment
+		return true, nil
+	}
+
+	qr, err := s.bank.RegisterQR(context.Background(), sbp.QRRequest{
+		Amount:    p.Amount,
+		Purpose:   fmt.Sprintf("Оплата заказа #%d", p.OrderID),
+		ExpiresAt: time.Now().Add(s.ttl),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO sbp_payments (order_id, qrc_id, payload, amount, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		p.OrderID, qr.ID, qr.Payload, p.Amount, qr.ExpiresAt)
+	if err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+func (s *sbpProvider) Refund(tx *sql.Tx, r RefundIntent) (string, error) {
+	var qrcID string
+	err := tx.QueryRow(`
+		SELECT qrc_id FROM sbp_payments
+		WHERE order_id = $1 AND status = $2`, r.OrderID, string(sbp.Accepted)).Scan(&qrcID)
+	if err == sql.ErrNoRows {
+		return "", sbp.ErrNotPaid
+	}
+	if err != nil {
+		return "", err
+	}
+	return s.bank.Refund(context.Background(), qrcID, r.Charged)
+}
+
+// Await polls the bank until the order's QR code is paid, rejected or
+// expired, or the order stops being pending. An expired code returns
+// errSBPExpired and leaves the order to OrderExpirer.
+func (s *sbpProvider) Await(orderID int) (bool, error) {
+	ticker := time.NewTicker(sbpPollInterval)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		var qrcID, orderStatus string
+		err := s.db.QueryRow(`
+			SELECT sp.qrc_id, o.payment_status
+			FROM sbp_payments sp
+			JOIN orders o ON sp.order_id = o.id
+			WHERE sp.order_id = $1`, orderID).Scan(&qrcID, &orderStatus)
+		if err != nil {
+			return false, err
+		}
+		if orderStatus != "pending" {
+			return false, nil
+		}
+
+		st, err := s.bank.Status(context.Background(), qrcID)
+		if err != nil {
+			// The bank may be briefly unreachable; ask again next tick
+			log.Printf("checking SBP payment for order %d: %v", orderID, err)
+			continue
+		}
+		if st.Status == sbp.Pending {
+			continue
+		}
+
+		_, err = s.db.Exec(`
+			UPDATE sbp_payments
+			SET status = $1, operation_id = NULLIF($2, ''), updated_at = CURRENT_TIMESTAMP
+			WHERE order_id = $3`, string(st.Status), st.OperationID, orderID)
+		if err != nil {
+			return false, err
+		}
+
+		switch st.Status {
+		case sbp.Accepted:
+			return true, nil
+		case sbp.Expired:
+			return false, errSBPExpired
+		default:
+			return false, nil
+		}
+	}
+}
+
+// Cancel withdraws the QR code of an order being expired, failing if the
+// buyer paid in the meantime.
+func (s *sbpProvider) Cancel(tx *sql.Tx, orderID int) error {
+	var qrcID string
+	err := tx.QueryRow("SELECT qrc_id FROM sbp_payments WHERE order_id = $1", orderID).Scan(&qrcID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.bank.CancelQR(context.Background(), qrcID); err != nil && !errors.Is(err, sbp.ErrQRNotFound) {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE sbp_payments SET status = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE order_id = $2 AND status = $3`, string(sbp.Expired), orderID, string(sbp.Pending))
+	return err
+}
+
+// SBPPayment is what the payment page shows for a pending SBP order.
+type SBPPayment struct {
+	Payload   string        `json:"payload"`
+	QRCodeSVG template.HTML `json:"-"`
+	QRCodePNG string        `json:"qr_code_png"`
+	Status    string        `json:"status"`
+	ExpiresAt time.Time     `json:"expires_at"`
+}
+
+func getSBPPayment(q queryer, orderID int, orderRef string) (*SBPPayment, error) {
+	var p SBPPayment
+	err := q.QueryRow(`
+		SELECT payload, status, expires_at FROM sbp_payments WHERE order_id = $1`,
+		orderID).Scan(&p.Payload, &p.Status, &p.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	svg, err := qrcode.SVG(p.Payload)
+	if err != nil {
+		return nil, err
+	}
+	// Generated by us from a bank-issued link, not user input
+	p.QRCodeSVG = template.HTML(svg)
+	p.QRCodePNG = "/payment/" + orderRef + "/sbp-qr?format=png"
+	return &p, nil
+}
+
+// SBPQRCode serves the QR code of the user's SBP order as PNG (default) or,
+// with format=svg, SVG.
+func (h *OrderHandler) SBPQRCode(w http.ResponseWriter, r *http.Request) {
+	orderRef := mux.Vars(r)["orderId"]
+	if len(orderRef) > 32 {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var payload string
+	err := h.db.QueryRow(`
+		SELECT sp.payload
+		FROM sbp_payments sp
+		JOIN orders o ON sp.order_id = o.id
+		WHERE o.public_id = $1 AND o.user_id = $2`, orderRef, user.ID).Scan(&payload)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	switch r.URL.Query().Get("format") {
+	case "", "png":
+		png, err := qrcode.PNG(payload, sbpQRSize)
+		if err != nil {
+			http.Error(w, "Failed to render QR code", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	case "svg":
+		svg, err := qrcode.SVG(payload)
+		if err != nil {
+			http.Error(w, "Failed to render QR code", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write([]byte(svg))
+	default:
+		http.Error(w, "Format must be png or svg", http.StatusBadRequest)
+	}
+}
+
+// SimulateSBPPayment pays or rejects an order's QR code at the stand-in
+// bank, for admins testing the flow. JSON body: {"result": "accepted"} or
+// {"result": "rejected"}.
+func (h *OrderHandler) SimulateSBPPayment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	admin, ok := currentUser(r)
+	if !ok || !can(h.db, admin, rbac.PermPaymentsSimulate) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	provider, ok := h.providers[sbpPaymentMethod].(*sbpProvider)
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	bank, ok := provider.bank.(*sbp.FakeBank)
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Result string `json:"result"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	var qrcID string
+	err := h.db.QueryRow(`
+		SELECT sp.qrc_id
+		FROM sbp_payments sp
+		JOIN orders o ON sp.order_id = o.id
+		WHERE o.public_id = $1`, mux.Vars(r)["orderId"]).Scan(&qrcID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	switch sbp.Status(req.Result) {
+	case sbp.Accepted:
+		err = bank.Pay(qrcID)
+	case sbp.Rejected:
+		err = bank.Reject(qrcID)
+	default:
+		http.Error(w, "Result must be accepted or rejected", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"qrc_id": qrcID,
+		"result": req.Result,
+	})
+}
+
+// fixedCurrency is the currency a payment method can only be paid in.
+func fixedCurrency(paymentMethod string) (money.Currency, bool) {
+	switch paymentMethod {
+	case balancePaymentMethod:
+		// The wallet is kept in the base currency
+		return money.Base, true
+	case sbpPaymentMethod:
+		return money.RUB, true
+	case bitcoinPaymentMethod:
+		return money.BTC, true
+	}
+	return "", false
+}
@@ -0,0 +1,657 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"license_keys_shop/internal/models"
+	"license_keys_shop/internal/qrcode"
+	"license_keys_shop/internal/session"
+	"license_keys_shop/internal/totp"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// What a login challenge is for: entering a code, or setting up the second
+// factor staff must have before logging in.
+const (
+	challengeVerify = "verify"
+	challengeEnroll = "enroll"
+)
+
+const (
+	challengeTTL         = 5 * time.Minute
+	maxChallengeAttempts = 5
+	challengeCookie      = "login_challenge"
+	totpIssuer           = "KeyShop"
+)
+
+var (
+	errNoChallenge  = errors.New("login challenge expired, log in again")
+	errInvalidCode  = errors.New("invalid code")
+	errNotConfirmed = errors.New("two-factor setup was not started")
+)
+
+// requireAdminTwoFactor reads REQUIRE_ADMIN_2FA; admins and every user
+// holding a role must use a second factor unless it is set to false.
+func requireAdminTwoFactor() bool {
+	if v, err := strconv.ParseBool(os.Getenv("REQUIRE_ADMIN_2FA")); err == nil {
+		return v
+	}
+	return true
+}
+
+// twoFactorRequired reports whether user must have a second factor: admins
+// and anyone holding a role do, since a role grants access to other
+// people's orders and money.
+func (h *AuthHandler) twoFactorRequired(user models.User) (bool, error) {
+	if !h.requireAdmin2FA {
+		return false, nil
+	}
+	if user.IsAdmin {
+		return true, nil
+	}
+	roles, err := h.roles.Roles(user.ID)
+	if err != nil {
+		return false, err
+	}
+	return len(roles) > 0, nil
+}
+
+type twoFactorRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+	Password  string `json:"password"`
+}
+
+func readTwoFactorRequest(r *http.Request) (twoFactorRequest, error) {
+	var req twoFactorRequest
+	if r.Header.Get("Content-Type") == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return req, err
+		}
+	} else {
+		req.Challenge = r.FormValue("challenge")
+		req.Code = r.FormValue("code")
+		req.Password = r.FormValue("password")
+	}
+	if req.Challenge == "" {
+		if c, err := r.Cookie(challengeCookie); err == nil {
+			req.Challenge = c.Value
+		}
+	}
+	return req, nil
+}
+
+// startChallenge answers a correct password with a challenge for the
+// second step instead of a session.
+func (h *AuthHandler) startChallenge(w http.ResponseWriter, r *http.Request, userID int, purpose string) {
+	id, err := secretToken()
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	expires := time.Now().Add(challengeTTL)
+	_, err = h.db.Exec(`
+		INSERT INTO login_challenges (id, user_id, purpose, expires_at)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP + $4 * INTERVAL '1 second')`,
+		id, userID, purpose, int(challengeTTL.Seconds()))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     challengeCookie,
+		Value:    id,
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+	})
+
+	if r.Header.Get("Content-Type") == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"two_factor_required":       purpose == challengeVerify,
+			"two_factor_setup_required": purpose == challengeEnroll,
+			"challenge":                 id,
+			"expires_at":                expires,
+		})
+		return
+	}
+	if purpose == challengeEnroll {
+		http.Redirect(w, r, "/login/2fa/setup", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+}
+
+// attemptChallenge counts an attempt on a live challenge and returns its
+// user, failing once the challenge is used, expired or out of attempts.
+func (h *AuthHandler) attemptChallenge(id, purpose string) (int, error) {
+	var userID int
+	err := h.db.QueryRow(`
+		UPDATE login_challenges SET attempts = attempts + 1
+		WHERE id = $1 AND purpose = $2 AND used_at IS NULL
+		  AND expires_at > CURRENT_TIMESTAMP AND attempts < $3
+		RETURNING user_id`, id, purpose, maxChallengeAttempts).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, errNoChallenge
+	}
+	return userID, err
+}
+
+// finishChallenge spends a challenge and logs its user in. Only one
+// request can spend it.
+func (h *AuthHandler) finishChallenge(w http.ResponseWriter, r *http.Request, id string) (models.User, session.Tokens, bool) {
+	var user models.User
+	err := h.db.QueryRow(`
+		UPDATE login_challenges c SET used_at = CURRENT_TIMESTAMP
+		FROM users u
+		WHERE c.id = $1 AND c.used_at IS NULL AND u.id = c.user_id
+		RETURNING u.id, u.username, u.email, u.is_admin, u.created_at, u.updated_at`, id).Scan(
+		&user.ID, &user.Username, &user.Email, &user.IsAdmin, &user.CreatedAt, &user.UpdatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, errNoChallenge.Error(), http.StatusUnauthorized)
+		return user, session.Tokens{}, false
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return user, session.Tokens{}, false
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     challengeCookie,
+		Value:    "",
+		Expires:  time.Now().Add(-time.Hour),
+		HttpOnly: true,
+		Path:     "/",
+	})
+
+	tokens, ok := h.startSession(w, r, user)
+	return user, tokens, ok
+}
+
+// checkSecondFactor accepts a current TOTP code or an unused backup code,
+// and spends it.
+func (h *AuthHandler) checkSecondFactor(userID int, code string) error {
+	var sealed sql.NullString
+	var lastStep int64
+	err := h.db.QueryRow(`
+		SELECT totp_secret, totp_last_step FROM users
+		WHERE id = $1 AND totp_enabled`, userID).Scan(&sealed, &lastStep)
+	if err == sql.ErrNoRows {
+		return errInvalidCode
+	}
+	if err != nil {
+		return err
+	}
+
+	secret, err := h.totpSealer.Open(sealed.String)
+	if err != nil {
+		return err
+	}
+	if step, ok := totp.Validate(secret, code, time.Now(), lastStep); ok {
+		// Only one request can use a step, even when racing
+		res, err := h.db.Exec(`
+			UPDATE users SET totp_last_step = $1
+			WHERE id = $2 AND totp_last_step < $1`, step, userID)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 1 {
+			return nil
+		}
+		return errInvalidCode
+	}
+
+	backup := totp.NormalizeBackupCode(code)
+	if backup == "" {
+		return errInvalidCode
+	}
+	rows, err := h.db.Query(`
+		SELECT id, code_hash FROM user_backup_codes
+		WHERE user_id = $1 AND used_at IS NULL`, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	matched := 0
+	for rows.Next() {
+		var id int
+		var hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			return err
+		}
+		if totp.MatchBackupCode(hash, backup) {
+			matched = id
+			break
+		}
+	}
+	rows.Close()
+	if matched == 0 {
+		return errInvalidCode
+	}
+
+	res, err := h.db.Exec(`
+		UPDATE user_backup_codes SET used_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND used_at IS NULL`, matched)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return nil
+	}
+	return errInvalidCode
+}
+
+func (h *AuthHandler) ShowTwoFactor(w http.ResponseWriter, r *http.Request) {
+	data := map[string]interface{}{
+		"Title": "Двухфакторная аутентификация",
+	}
+	h.templates.ExecuteTemplate(w, "login_2fa.html", data)
+}
+
+func (h *AuthHandler) ShowTwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	data := map[string]interface{}{
+		"Title": "Настройка двухфакторной аутентификации",
+	}
+	h.templates.ExecuteTemplate(w, "two_factor_setup.html", data)
+}
+
+// VerifyTwoFactor is the second login step: the challenge from Login and
+// a TOTP or backup code.
+func (h *AuthHandler) VerifyTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, err := readTwoFactorRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := h.attemptChallenge(req.Challenge, challengeVerify)
+	if errors.Is(err, errNoChallenge) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Wrong codes count against the account like wrong passwords, so new
+	// challenges don't buy more guesses
+	if !h.checkLoginThrottle(w, r, userID, "") {
+		return
+	}
+	if err := h.checkSecondFactor(userID, req.Code); err != nil {
+		if errors.Is(err, errInvalidCode) {
+			h.loginFailed(r, userID, "")
+			http.Error(w, "Invalid code", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	user, tokens, ok := h.finishChallenge(w, r, req.Challenge)
+	if !ok {
+		return
+	}
+	h.clearLoginFailures(userID)
+	writeLoginResponse(w, r, user, tokens)
+}
+
+// twoFactorSubject is the user setting up two-factor authentication:
+// the logged-in user, or the staff member holding an enrollment challenge.
+func (h *AuthHandler) twoFactorSubject(r *http.Request, req twoFactorRequest) (userID int, challenge string, err error) {
+	if user, ok := currentUser(r); ok {
+		return user.ID, "", nil
+	}
+	userID, err = h.attemptChallenge(req.Challenge, challengeEnroll)
+	return userID, req.Challenge, err
+}
+
+// SetupTwoFactor creates a new TOTP secret and returns it with its
+// provisioning URI and QR code. It takes effect once EnableTwoFactor
+// confirms a code from it.
+func (h *AuthHandler) SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, err := readTwoFactorRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	userID, _, err := h.twoFactorSubject(r, req)
+	if errors.Is(err, errNoChallenge) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+	sealed, err := h.totpSealer.Seal(secret)
+	if err != nil {
+		http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+
+	var email string
+	err = h.db.QueryRow(`
+		UPDATE users SET totp_secret = $1, totp_last_step = 0
+		WHERE id = $2 AND NOT totp_enabled
+		RETURNING email`, sealed, userID).Scan(&email)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	uri := totp.ProvisioningURI(secret, totpIssuer, email)
+	svg, err := qrcode.SVG(uri)
+	if err != nil {
+		http.Error(w, "Failed to render QR code", http.StatusInternalServerError)
+		return
+	}
+	png, err := qrcode.PNG(uri, 256)
+	if err != nil {
+		http.Error(w, "Failed to render QR code", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"secret":      secret,
+		"otpauth_uri": uri,
+		"qr_code_svg": svg,
+		"qr_code_png": "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+// EnableTwoFactor confirms the secret from SetupTwoFactor with a code and
+// returns the backup codes, which are shown only this once. Other sessions
+// end; a staff member enrolling during login is logged in.
+func (h *AuthHandler) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, err := readTwoFactorRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	userID, challenge, err := h.twoFactorSubject(r, req)
+	if errors.Is(err, errNoChallenge) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	codes, err := h.enableTwoFactor(userID, req.Code)
+	switch {
+	case errors.Is(err, errInvalidCode):
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	case errors.Is(err, errNotConfirmed):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	keep := ""
+	if claims, ok := session.ClaimsFromContext(r.Context()); ok {
+		keep = claims.SessionID
+	}
+	h.sessions.RevokeAll(userID, keep, session.ReasonTwoFactorChange)
+
+	response := map[string]interface{}{
+		"enabled":      true,
+		"backup_codes": codes,
+	}
+	if challenge != "" {
+		_, tokens, ok := h.finishChallenge(w, r, challenge)
+		if !ok {
+			return
+		}
+		h.clearLoginFailures(userID)
+		response["token"] = tokens.AccessToken
+		response["expires_at"] = tokens.AccessExpiresAt
+		response["refresh_token"] = tokens.RefreshToken
+		response["refresh_expires_at"] = tokens.RefreshExpiresAt
+	}
+
+	if r.Header.Get("Content-Type") == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Title":       "Резервные коды",
+		"BackupCodes": codes,
+	}
+	h.templates.ExecuteTemplate(w, "two_factor_backup_codes.html", data)
+}
+
+func (h *AuthHandler) enableTwoFactor(userID int, code string) ([]string, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var sealed sql.NullString
+	err = tx.QueryRow(`
+		SELECT totp_secret FROM users
+		WHERE id = $1 AND NOT totp_enabled
+		FOR UPDATE`, userID).Scan(&sealed)
+	if err == sql.ErrNoRows || (err == nil && !sealed.Valid) {
+		return nil, errNotConfirmed
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := h.totpSealer.Open(sealed.String)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := totp.Validate(secret, code, time.Now(), 0)
+	if !ok {
+		return nil, errInvalidCode
+	}
+
+	_, err = tx.Exec(`
+		UPDATE users SET totp_enabled = TRUE, totp_enabled_at = CURRENT_TIMESTAMP, totp_last_step = $1
+		WHERE id = $2`, step, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	codes, err := replaceBackupCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+func replaceBackupCodes(tx *sql.Tx, userID int) ([]string, error) {
+	codes, hashes, err := totp.GenerateBackupCodes()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM user_backup_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+	for _, hash := range hashes {
+		_, err := tx.Exec(`
+			INSERT INTO user_backup_codes (user_id, code_hash) VALUES ($1, $2)`, userID, hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// DisableTwoFactor turns the second factor off after checking the password
+// and a code. Staff can't while it is required for them.
+func (h *AuthHandler) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	required, err := h.twoFactorRequired(*user)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if required {
+		http.Error(w, "Two-factor authentication is required for staff", http.StatusForbidden)
+		return
+	}
+
+	req, err := readTwoFactorRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	var passwordHash string
+	if err := h.db.QueryRow("SELECT password_hash FROM users WHERE id = $1", user.ID).Scan(&passwordHash); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.Password)) != nil {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if err := h.checkSecondFactor(user.ID, req.Code); err != nil {
+		if errors.Is(err, errInvalidCode) {
+			http.Error(w, "Invalid code", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE users SET totp_enabled = FALSE, totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0
+		WHERE id = $1`, user.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM user_backup_codes WHERE user_id = $1", user.ID); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled": false,
+	})
+}
+
+// RegenerateBackupCodes replaces all backup codes after checking a code.
+func (h *AuthHandler) RegenerateBackupCodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	req, err := readTwoFactorRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := h.checkSecondFactor(user.ID, req.Code); err != nil {
+		if errors.Is(err, errInvalidCode) {
+			http.Error(w, "Invalid code", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceBackupCodes(tx, user.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"backup_codes": codes,
+	})
+}
@@ -0,0 +1,321 @@
+// Package apitoken issues long-lived personal API tokens for scripts. A
+// token acts for its owner but only within its scopes, and each token has
+// its own per-minute request limit.
+package apitoken
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"license_keys_shop/internal/ids"
+)
+
+// Prefix starts every token, so leaked ones are easy to find in code and
+// logs, and so they can't be mistaken for access JWTs.
+const Prefix = "lks_"
+
+type Scope string
+
+const (
+	ScopeCatalogRead   Scope = "catalog:read"
+	ScopeProductsWrite Scope = "products:write"
+	ScopeOrdersRead    Scope = "orders:read"
+)
+
+// Scopes lists every scope.
+func Scopes() []Scope {
+	return []Scope{ScopeCatalogRead, ScopeProductsWrite, ScopeOrdersRead}
+}
+
+// ParseScope accepts the name of a known scope.
+func ParseScope(name string) (Scope, bool) {
+	for _, s := range Scopes() {
+		if string(s) == name {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+const (
+	DefaultRateLimit = 60
+	MaxRateLimit     = 600
+	// MaxPerUser bounds the live tokens of one user.
+	MaxPerUser = 20
+
+	rateWindow = time.Minute
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid, expired or revoked API token")
+	ErrTooMany      = errors.New("too many API tokens, revoke one first")
+	ErrNotFound     = errors.New("API token not found")
+)
+
+// Token describes a token without its secret.
+type Token struct {
+	ID         string     `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Hint       string     `json:"hint"`
+	Scopes     []Scope    `json:"scopes"`
+	RateLimit  int        `json:"rate_limit"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Has reports whether the token was given scope s.
+func (t Token) Has(s Scope) bool {
+	for _, have := range t.Scopes {
+		if have == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Usage is a token's place in its current rate-limit window.
+type Usage struct {
+	Limit     int
+	Used      int
+	Remaining int
+	ResetAt   time.Time
+	Exceeded  bool
+}
+
+// DB is what Store needs from the database handle.
+type DB interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type Store struct {
+	db DB
+}
+
+func NewStore(db DB) *Store {
+	return &Store{db: db}
+}
+
+// NewRequest is what a new token should allow.
+type NewRequest struct {
+	UserID    int
+	Name      string
+	Scopes    []Scope
+	RateLimit int
+	ExpiresAt *time.Time
+}
+
+// Create issues a token and returns it with its secret, which is not
+// stored and can't be shown again.
+func (s *Store) Create(req NewRequest) (Token, string, error) {
+	var live int
+	err := s.db.QueryRow(`
+		SELECT COUNT(*) FROM api_tokens
+		WHERE user_id = $1 AND revoked_at IS NULL
+		  AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)`, req.UserID).Scan(&live)
+	if err != nil {
+		return Token{}, "", err
+	}
+	if live >= MaxPerUser {
+		return Token{}, "", ErrTooMany
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return Token{}, "", err
+	}
+	secret := Prefix + base64.RawURLEncoding.EncodeToString(b)
+
+	t := Token{
+		ID:        ids.New(),
+		UserID:    req.UserID,
+		Name:      req.Name,
+		Hint:      secret[:len(Prefix)+6],
+		Scopes:    normalizeScopes(req.Scopes),
+		RateLimit: req.RateLimit,
+		ExpiresAt: req.ExpiresAt,
+	}
+	if t.RateLimit <= 0 {
+		t.RateLimit = DefaultRateLimit
+	}
+	if t.RateLimit > MaxRateLimit {
+		t.RateLimit = MaxRateLimit
+	}
+
+	err = s.db.QueryRow(`
+		INSERT INTO api_tokens (id, user_id, name, token_hash, hint, scopes, rate_limit, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING created_at`,
+		t.ID, t.UserID, t.Name, hashToken(secret), t.Hint, joinScopes(t.Scopes),
+		t.RateLimit, t.ExpiresAt).Scan(&t.CreatedAt)
+	if err != nil {
+		return Token{}, "", err
+	}
+	return t, secret, nil
+}
+
+// Authenticate looks up a token, records its use from ip and counts the
+// request against its rate limit. A request over the limit still returns
+// the token, with Usage.Exceeded set.
+func (s *Store) Authenticate(secret, ip string) (Token, Usage, error) {
+	if !strings.HasPrefix(secret, Prefix) {
+		return Token{}, Usage{}, ErrInvalidToken
+	}
+
+	var t Token
+	var scopes string
+	var expiresAt sql.NullTime
+	var windowStart time.Time
+	var used int
+	err := s.db.QueryRow(`
+		UPDATE api_tokens SET
+			last_used_at = CURRENT_TIMESTAMP,
+			last_used_ip = $2,
+			window_count = CASE WHEN window_start > CURRENT_TIMESTAMP - $3 * INTERVAL '1 second'
+			                    THEN window_count + 1 ELSE 1 END,
+			window_start = CASE WHEN window_start > CURRENT_TIMESTAMP - $3 * INTERVAL '1 second'
+			                    THEN window_start ELSE CURRENT_TIMESTAMP END
+		WHERE token_hash = $1 AND revoked_at IS NULL
+		  AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)
+		RETURNING id, user_id, name, hint, scopes, rate_limit, created_at, expires_at,
+		          window_start, window_count`,
+		hashToken(secret), ip, int(rateWindow.Seconds())).Scan(
+		&t.ID, &t.UserID, &t.Name, &t.Hint, &scopes, &t.RateLimit, &t.CreatedAt, &expiresAt,
+		&windowStart, &used)
+	if err == sql.ErrNoRows {
+		return Token{}, Usage{}, ErrInvalidToken
+	}
+	if err != nil {
+		return Token{}, Usage{}, err
+	}
+	t.Scopes = splitScopes(scopes)
+	if expiresAt.Valid {
+		t.ExpiresAt = &expiresAt.Time
+	}
+
+	u := Usage{
+		Limit:    t.RateLimit,
+		Used:     used,
+		ResetAt:  windowStart.Add(rateWindow),
+		Exceeded: used > t.RateLimit,
+	}
+	if u.Remaining = t.RateLimit - used; u.Remaining < 0 {
+		u.Remaining = 0
+	}
+	return t, u, nil
+}
+
+// List returns a user's tokens, newest first, revoked ones included.
+func (s *Store) List(userID int) ([]Token, error) {
+	rows, err := s.db.Query(`
+		SELECT id, user_id, name, hint, scopes, rate_limit, created_at, expires_at,
+		       last_used_at, COALESCE(last_used_ip, ''), revoked_at
+		FROM api_tokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []Token{}
+	for rows.Next() {
+		var t Token
+		var scopes string
+		var expiresAt, lastUsedAt, revokedAt sql.NullTime
+		err := rows.Scan(&t.ID, &t.UserID, &t.Name, &t.Hint, &scopes, &t.RateLimit, &t.CreatedAt,
+			&expiresAt, &lastUsedAt, &t.LastUsedIP, &revokedAt)
+		if err != nil {
+			return nil, err
+		}
+		t.Scopes = splitScopes(scopes)
+		t.ExpiresAt = timePtr(expiresAt)
+		t.LastUsedAt = timePtr(lastUsedAt)
+		t.RevokedAt = timePtr(revokedAt)
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// Revoke ends a token of userID at once.
+func (s *Store) Revoke(userID int, tokenID string) error {
+	res, err := s.db.Exec(`
+		UPDATE api_tokens SET revoked_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`, tokenID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RevokeAll ends every token of userID at once and returns how many it
+// ended.
+func (s *Store) RevokeAll(userID int) (int, error) {
+	res, err := s.db.Exec(`
+		UPDATE api_tokens SET revoked_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND revoked_at IS NULL`, userID)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+func normalizeScopes(scopes []Scope) []Scope {
+	seen := make(map[Scope]bool)
+	var out []Scope
+	for _, s := range scopes {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+func joinScopes(scopes []Scope) string {
+	names := make([]string, len(scopes))
+	for i, s := range scopes {
+		names[i] = string(s)
+	}
+	return strings.Join(names, " ")
+}
+
+// splitScopes reads stored scopes, skipping ones no longer known.
+func splitScopes(stored string) []Scope {
+	scopes := []Scope{}
+	for _, name := range strings.Fields(stored) {
+		if s, ok := ParseScope(name); ok {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func timePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
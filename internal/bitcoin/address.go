@@ -0,0 +1,159 @@
+package bitcoin
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ripemd160"
+)
+
+// Network selects the bech32 prefix of derived addresses.
+type Network struct {
+	Name string
+	HRP  string
+}
+
+var (
+	MainNet = Network{Name: "mainnet", HRP: "bc"}
+	TestNet = Network{Name: "testnet", HRP: "tb"}
+	RegTest = Network{Name: "regtest", HRP: "bcrt"}
+)
+
+func ParseNetwork(name string) (Network, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "mainnet", "main":
+		return MainNet, nil
+	case "testnet", "test", "signet":
+		return TestNet, nil
+	case "regtest":
+		return RegTest, nil
+	}
+	return Network{}, fmt.Errorf("unknown bitcoin network %q", name)
+}
+
+// AddressDeriver hands out a deposit address per order index.
+type AddressDeriver interface {
+	Address(index uint32) (string, error)
+}
+
+// XPubDeriver derives native segwit (P2WPKH) receive addresses
+// <xpub>/0/index, the external chain of a BIP84 account, so payments show
+// up in the merchant's own wallet without the shop holding any secrets.
+type XPubDeriver struct {
+	network Network
+
+	mu       sync.Mutex
+	external *ExtendedKey
+}
+
+func NewXPubDeriver(xpub string, network Network) (*XPubDeriver, error) {
+	account, err := ParseExtendedKey(xpub)
+	if err != nil {
+		return nil, err
+	}
+	external, err := account.Child(0)
+	if err != nil {
+		return nil, err
+	}
+	return &XPubDeriver{network: network, external: external}, nil
+}
+
+func (d *XPubDeriver) Address(index uint32) (string, error) {
+	d.mu.Lock()
+	key, err := d.external.Child(index)
+	d.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	return SegwitAddress(d.network, key.PublicKey())
+}
+
+// SegwitAddress is the version 0 witness address of a compressed public key.
+func SegwitAddress(network Network, pubKey []byte) (string, error) {
+	if len(pubKey) != 33 {
+		return "", errInvalidPoint
+	}
+	program, err := convertBits(hash160(pubKey), 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	return bech32Encode(network.HRP, append([]byte{0}, program...)), nil
+}
+
+func hash160(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	h := ripemd160.New()
+	h.Write(sum[:])
+	return h.Sum(nil)
+}
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+func bech32Polymod(values []byte) uint32 {
+	generator := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HRPExpand(hrp string) []byte {
+	out := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		out = append(out, hrp[i]>>5)
+	}
+	out = append(out, 0)
+	for i := 0; i < len(hrp); i++ {
+		out = append(out, hrp[i]&31)
+	}
+	return out
+}
+
+// bech32Encode uses the original bech32 checksum, which is the one
+// version 0 witness programs are defined with (BIP173).
+func bech32Encode(hrp string, data []byte) string {
+	values := append(bech32HRPExpand(hrp), data...)
+	polymod := bech32Polymod(append(values, 0, 0, 0, 0, 0, 0)) ^ 1
+
+	var sb strings.Builder
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+	for _, d := range data {
+		sb.WriteByte(bech32Charset[d])
+	}
+	for i := 0; i < 6; i++ {
+		sb.WriteByte(bech32Charset[(polymod>>uint(5*(5-i)))&31])
+	}
+	return sb.String()
+}
+
+func convertBits(data []byte, from, to uint, pad bool) ([]byte, error) {
+	var acc, bits uint
+	maxv := uint(1)<<to - 1
+	var out []byte
+	for _, b := range data {
+		acc = acc<<from | uint(b)
+		bits += from
+		for bits >= to {
+			bits -= to
+			out = append(out, byte(acc>>bits&maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			out = append(out, byte(acc<<(to-bits)&maxv))
+		}
+	} else if bits >= from || acc<<(to-bits)&maxv != 0 {
+		return nil, fmt.Errorf("invalid bit padding")
+	}
+	return out, nil
+}
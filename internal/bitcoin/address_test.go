@@ -0,0 +1,65 @@
+package bitcoin
+
+import "testing"
+
+// BIP84 test vector: account 0 of the mnemonic "abandon abandon ... about".
+const bip84AccountZPub = "zpub6rFR7y4Q2AijBEqTUquhVz398htDFrtymD9xYYfG1m4wAcvPhXNfE3EfH1r1ADqtfSdVCToUG868RvUUkgDKf31mGDtKsAYz2oz2AGutZYs"
+
+func TestXPubDeriverBIP84(t *testing.T) {
+	d, err := NewXPubDeriver(bip84AccountZPub, MainNet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		index uint32
+		want  string
+	}{
+		{0, "bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu"},
+		{1, "bc1qnjg0jd8228aq7egyzacy8cys3knf9xvrerkf9g"},
+	}
+	for _, tt := range tests {
+		got, err := d.Address(tt.index)
+		if err != nil {
+			t.Fatalf("Address(%d): %v", tt.index, err)
+		}
+		if got != tt.want {
+			t.Errorf("Address(%d) = %s, want %s", tt.index, got, tt.want)
+		}
+	}
+}
+
+// The change chain isn't used for deposits, but checks SegwitAddress on its
+// own: m/84'/0'/0'/1/0 of the same vector.
+func TestSegwitAddressBIP84Change(t *testing.T) {
+	account, err := ParseExtendedKey(bip84AccountZPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	change, err := account.Child(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := change.Child(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := SegwitAddress(MainNet, key.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "bc1q8c6fshw2dlwun7ekn9qwf37cu2rn755upcp6el"; got != want {
+		t.Errorf("m/84'/0'/0'/1/0 = %s, want %s", got, want)
+	}
+}
+
+func TestParseNetwork(t *testing.T) {
+	for name, want := range map[string]Network{"": MainNet, "testnet": TestNet, "signet": TestNet, "RegTest": RegTest} {
+		got, err := ParseNetwork(name)
+		if err != nil || got != want {
+			t.Errorf("ParseNetwork(%q) = %v, %v; want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParseNetwork("litecoin"); err == nil {
+		t.Error("ParseNetwork(litecoin) succeeded")
+	}
+}
@@ -0,0 +1,104 @@
+package bitcoin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"license_keys_shop/internal/money"
+)
+
+// EsploraVerifier checks payments against an Esplora REST API, e.g.
+// https://blockstream.info/api or a self-hosted electrs instance.
+type EsploraVerifier struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewEsploraVerifier(baseURL string) *EsploraVerifier {
+	return &EsploraVerifier{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type esploraTx struct {
+	TxID string `json:"txid"`
+	Vout []struct {
+		Address string `json:"scriptpubkey_address"`
+		Value   int64  `json:"value"`
+	} `json:"vout"`
+	Status struct {
+		Confirmed   bool `json:"confirmed"`
+		BlockHeight int  `json:"block_height"`
+	} `json:"status"`
+}
+
+func (v *EsploraVerifier) PaymentTo(ctx context.Context, txid, address string) (Payment, error) {
+	var tx esploraTx
+	body, err := v.get(ctx, "/tx/"+url.PathEscape(txid))
+	if err != nil {
+		return Payment{}, err
+	}
+	if err := json.Unmarshal(body, &tx); err != nil {
+		return Payment{}, fmt.Errorf("esplora: tx %s: %w", txid, err)
+	}
+
+	var sats int64
+	found := false
+	for _, out := range tx.Vout {
+		if out.Address == address {
+			sats += out.Value
+			found = true
+		}
+	}
+	if !found {
+		return Payment{}, ErrNoOutput
+	}
+
+	p := Payment{TxID: txid, Address: address, Amount: money.New(sats, money.BTC)}
+	if tx.Status.Confirmed {
+		body, err := v.get(ctx, "/blocks/tip/height")
+		if err != nil {
+			return Payment{}, err
+		}
+		tip, err := strconv.Atoi(strings.TrimSpace(string(body)))
+		if err != nil {
+			return Payment{}, fmt.Errorf("esplora: tip height: %w", err)
+		}
+		p.Confirmations = tip - tx.Status.BlockHeight + 1
+	}
+	return p, nil
+}
+
+func (v *EsploraVerifier) get(ctx context.Context, path string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("esplora: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("esplora: %w", err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound,
+		// Esplora answers 400 for malformed txids
+		resp.StatusCode == http.StatusBadRequest:
+		return nil, ErrTxNotFound
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("esplora: %s: %s", path, resp.Status)
+	}
+	return body, nil
+}
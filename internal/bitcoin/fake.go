@@ -0,0 +1,71 @@
+package bitcoin
+
+import (
+	"context"
+	"sync"
+
+	"license_keys_shop/internal/money"
+)
+
+// FakeChain is an in-memory ChainVerifier for tests and local development:
+// transactions are added with Send and gain confirmations with Mine.
+type FakeChain struct {
+	mu     sync.Mutex
+	height int
+	txs    map[string]*fakeTx
+}
+
+type fakeTx struct {
+	outputs map[string]money.Money
+	// minedAt is the block height of the transaction, 0 while in the mempool.
+	minedAt int
+}
+
+func NewFakeChain() *FakeChain {
+	return &FakeChain{txs: make(map[string]*fakeTx)}
+}
+
+// Send broadcasts an unconfirmed transaction paying amount to address.
+// Sending to several addresses under one txid adds outputs to it.
+func (c *FakeChain) Send(txid, address string, amount money.Money) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tx, ok := c.txs[txid]
+	if !ok {
+		tx = &fakeTx{outputs: make(map[string]money.Money)}
+		c.txs[txid] = tx
+	}
+	tx.outputs[address] = tx.outputs[address].Add(amount)
+}
+
+// Mine adds blocks, the first of which includes every mempool transaction.
+func (c *FakeChain) Mine(blocks int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := 0; i < blocks; i++ {
+		c.height++
+		for _, tx := range c.txs {
+			if tx.minedAt == 0 {
+				tx.minedAt = c.height
+			}
+		}
+	}
+}
+
+func (c *FakeChain) PaymentTo(ctx context.Context, txid, address string) (Payment, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tx, ok := c.txs[txid]
+	if !ok {
+		return Payment{}, ErrTxNotFound
+	}
+	amount, ok := tx.outputs[address]
+	if !ok {
+		return Payment{}, ErrNoOutput
+	}
+	p := Payment{TxID: txid, Address: address, Amount: amount}
+	if tx.minedAt > 0 {
+		p.Confirmations = c.height - tx.minedAt + 1
+	}
+	return p, nil
+}
@@ -0,0 +1,62 @@
+package bitcoin
+
+import (
+	"context"
+	"testing"
+
+	"license_keys_shop/internal/money"
+)
+
+func TestFakeChainConfirmations(t *testing.T) {
+	ctx := context.Background()
+	chain := NewFakeChain()
+	const addr = "bcrt1qdeposit"
+	amount := money.MustParse("0.0015", money.BTC)
+
+	if _, err := chain.PaymentTo(ctx, "tx1", addr); err != ErrTxNotFound {
+		t.Fatalf("unknown tx: err = %v, want ErrTxNotFound", err)
+	}
+
+	chain.Send("tx1", addr, amount)
+	p, err := chain.PaymentTo(ctx, "tx1", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Amount.Equal(amount) || p.Confirmations != 0 || p.Confirmed(1) {
+		t.Fatalf("in mempool: got %+v, want %s unconfirmed", p, amount.Format())
+	}
+
+	chain.Mine(1)
+	if p, _ = chain.PaymentTo(ctx, "tx1", addr); p.Confirmations != 1 || p.Confirmed(2) {
+		t.Fatalf("after one block: %d confirmations", p.Confirmations)
+	}
+
+	// Transactions sent later start counting from their own block
+	chain.Send("tx2", addr, amount)
+	chain.Mine(2)
+	if p, _ = chain.PaymentTo(ctx, "tx1", addr); p.Confirmations != 3 || !p.Confirmed(2) {
+		t.Errorf("tx1: %d confirmations, want 3", p.Confirmations)
+	}
+	if p, _ = chain.PaymentTo(ctx, "tx2", addr); p.Confirmations != 2 || !p.Confirmed(2) {
+		t.Errorf("tx2: %d confirmations, want 2", p.Confirmations)
+	}
+}
+
+func TestFakeChainOutputs(t *testing.T) {
+	ctx := context.Background()
+	chain := NewFakeChain()
+	chain.Send("tx1", "addr1", money.MustParse("0.001", money.BTC))
+	chain.Send("tx1", "addr1", money.MustParse("0.0005", money.BTC))
+	chain.Send("tx1", "addr2", money.MustParse("0.002", money.BTC))
+
+	p, err := chain.PaymentTo(ctx, "tx1", "addr1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := money.MustParse("0.0015", money.BTC); !p.Amount.Equal(want) {
+		t.Errorf("addr1 received %s, want %s", p.Amount.Format(), want.Format())
+	}
+	if _, err := chain.PaymentTo(ctx, "tx1", "addr3"); err != ErrNoOutput {
+		t.Errorf("addr3: err = %v, want ErrNoOutput", err)
+	}
+}
@@ -0,0 +1,160 @@
+package bitcoin
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+var (
+	ErrInvalidXPub   = errors.New("invalid extended public key")
+	ErrHardenedChild = errors.New("hardened children can't be derived from a public key")
+)
+
+// hardenedOffset is the first hardened BIP32 child index.
+const hardenedOffset = 1 << 31
+
+// ExtendedKey is a BIP32 extended public key. The shop only ever holds the
+// account xpub; the private keys stay in the merchant's wallet.
+type ExtendedKey struct {
+	version   [4]byte
+	depth     byte
+	parentFP  [4]byte
+	index     uint32
+	chainCode []byte
+	pub       point
+}
+
+// ParseExtendedKey reads a base58check xpub/tpub (or the zpub/vpub variants
+// wallets export for native segwit accounts; only the key material is used).
+func ParseExtendedKey(s string) (*ExtendedKey, error) {
+	raw, err := base58CheckDecode(strings.TrimSpace(s))
+	if err != nil || len(raw) != 78 {
+		return nil, ErrInvalidXPub
+	}
+	pub, err := decompress(raw[45:78])
+	if err != nil {
+		return nil, ErrInvalidXPub
+	}
+	k := &ExtendedKey{
+		depth:     raw[4],
+		index:     binary.BigEndian.Uint32(raw[9:13]),
+		chainCode: append([]byte(nil), raw[13:45]...),
+		pub:       pub,
+	}
+	copy(k.version[:], raw[0:4])
+	copy(k.parentFP[:], raw[5:9])
+	return k, nil
+}
+
+// Child derives the non-hardened child key at index (BIP32 CKDpub).
+func (k *ExtendedKey) Child(index uint32) (*ExtendedKey, error) {
+	if index >= hardenedOffset {
+		return nil, ErrHardenedChild
+	}
+	pub := k.pub.compress()
+
+	mac := hmac.New(sha512.New, k.chainCode)
+	mac.Write(pub)
+	binary.Write(mac, binary.BigEndian, index)
+	sum := mac.Sum(nil)
+
+	il := new(big.Int).SetBytes(sum[:32])
+	if il.Cmp(curveN) >= 0 {
+		return nil, fmt.Errorf("bip32: child %d is invalid, use the next index", index)
+	}
+	child := addPoints(scalarBaseMult(il), k.pub)
+	if child.isInfinity() {
+		return nil, fmt.Errorf("bip32: child %d is invalid, use the next index", index)
+	}
+
+	c := &ExtendedKey{
+		version:   k.version,
+		depth:     k.depth + 1,
+		index:     index,
+		chainCode: sum[32:],
+		pub:       child,
+	}
+	copy(c.parentFP[:], hash160(pub)[:4])
+	return c, nil
+}
+
+// PublicKey is the compressed public key.
+func (k *ExtendedKey) PublicKey() []byte {
+	return k.pub.compress()
+}
+
+// String serialises the key back to base58check.
+func (k *ExtendedKey) String() string {
+	var buf bytes.Buffer
+	buf.Write(k.version[:])
+	buf.WriteByte(k.depth)
+	buf.Write(k.parentFP[:])
+	binary.Write(&buf, binary.BigEndian, k.index)
+	buf.Write(k.chainCode)
+	buf.Write(k.pub.compress())
+	return base58CheckEncode(buf.Bytes())
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func base58CheckDecode(s string) ([]byte, error) {
+	n := new(big.Int)
+	for _, r := range s {
+		i := strings.IndexRune(base58Alphabet, r)
+		if i < 0 {
+			return nil, ErrInvalidXPub
+		}
+		n.Mul(n, big.NewInt(58))
+		n.Add(n, big.NewInt(int64(i)))
+	}
+	raw := n.Bytes()
+	for _, r := range s {
+		if r != '1' {
+			break
+		}
+		raw = append([]byte{0}, raw...)
+	}
+	if len(raw) < 4 {
+		return nil, ErrInvalidXPub
+	}
+	payload, check := raw[:len(raw)-4], raw[len(raw)-4:]
+	if !bytes.Equal(doubleSHA256(payload)[:4], check) {
+		return nil, ErrInvalidXPub
+	}
+	return payload, nil
+}
+
+func base58CheckEncode(payload []byte) string {
+	raw := append(append([]byte(nil), payload...), doubleSHA256(payload)[:4]...)
+	n := new(big.Int).SetBytes(raw)
+	var out []byte
+	rem := new(big.Int)
+	base := big.NewInt(58)
+	for n.Sign() > 0 {
+		n.QuoRem(n, base, rem)
+		out = append(out, base58Alphabet[rem.Int64()])
+	}
+	for _, b := range raw {
+		if b != 0 {
+			break
+		}
+		out = append(out, '1')
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+func doubleSHA256(b []byte) []byte {
+	first := sha256.Sum256(b)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
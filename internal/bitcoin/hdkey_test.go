@@ -0,0 +1,74 @@
+package bitcoin
+
+import "testing"
+
+// BIP32 test vector 1 (seed 000102030405060708090a0b0c0d0e0f): each step
+// derives a non-hardened child from the public key of the previous row.
+func TestChildBIP32Vector1(t *testing.T) {
+	tests := []struct {
+		path   string
+		parent string
+		index  uint32
+		want   string
+	}{
+		{
+			path:   "m/0'/1",
+			parent: "xpub68Gmy5EdvgibQVfPdqkBBCHxA5htiqg55crXYuXoQRKfDBFA1WEjWgP6LHhwBZeNK1VTsfTFUHCdrfp1bgwQ9xv5ski8PX9rL2dZXvgGDnw",
+			index:  1,
+			want:   "xpub6ASuArnXKPbfEwhqN6e3mwBcDTgzisQN1wXN9BJcM47sSikHjJf3UFHKkNAWbWMiGj7Wf5uMash7SyYq527Hqck2AxYysAA7xmALppuCkwQ",
+		},
+		{
+			path:   "m/0'/1/2'/2",
+			parent: "xpub6D4BDPcP2GT577Vvch3R8wDkScZWzQzMMUm3PWbmWvVJrZwQY4VUNgqFJPMM3No2dFDFGTsxxpG5uJh7n7epu4trkrX7x7DogT5Uv6fcLW5",
+			index:  2,
+			want:   "xpub6FHa3pjLCk84BayeJxFW2SP4XRrFd1JYnxeLeU8EqN3vDfZmbqBqaGJAyiLjTAwm6ZLRQUMv1ZACTj37sR62cfN7fe5JnJ7dh8zL4fiyLHV",
+		},
+		{
+			path:   "m/0'/1/2'/2/1000000000",
+			parent: "xpub6FHa3pjLCk84BayeJxFW2SP4XRrFd1JYnxeLeU8EqN3vDfZmbqBqaGJAyiLjTAwm6ZLRQUMv1ZACTj37sR62cfN7fe5JnJ7dh8zL4fiyLHV",
+			index:  1000000000,
+			want:   "xpub6H1LXWLaKsWFhvm6RVpEL9P4KfRZSW7abD2ttkWP3SSQvnyA8FSVqNTEcYFgJS2UaFcxupHiYkro49S8yGasTvXEYBVPamhGW6cFJodrTHy",
+		},
+	}
+	for _, tt := range tests {
+		parent, err := ParseExtendedKey(tt.parent)
+		if err != nil {
+			t.Fatalf("%s: parsing parent: %v", tt.path, err)
+		}
+		child, err := parent.Child(tt.index)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		if got := child.String(); got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestParseExtendedKeyRoundTrip(t *testing.T) {
+	const xpub = "xpub661MyMwAqRbcFtXgS5sYJABqqG9YLmC4Q1Rdap9gSE8NqtwybGhePY2gZ29ESFjqJoCu1Rupje8YtGqsefD265TMg7usUDFdp6W1EGMcet8"
+	k, err := ParseExtendedKey(xpub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := k.String(); got != xpub {
+		t.Errorf("String() = %s, want %s", got, xpub)
+	}
+}
+
+func TestParseExtendedKeyRejectsBadChecksum(t *testing.T) {
+	const xpub = "xpub661MyMwAqRbcFtXgS5sYJABqqG9YLmC4Q1Rdap9gSE8NqtwybGhePY2gZ29ESFjqJoCu1Rupje8YtGqsefD265TMg7usUDFdp6W1EGMcet9"
+	if _, err := ParseExtendedKey(xpub); err != ErrInvalidXPub {
+		t.Errorf("err = %v, want ErrInvalidXPub", err)
+	}
+}
+
+func TestChildRejectsHardenedIndex(t *testing.T) {
+	k, err := ParseExtendedKey("xpub661MyMwAqRbcFtXgS5sYJABqqG9YLmC4Q1Rdap9gSE8NqtwybGhePY2gZ29ESFjqJoCu1Rupje8YtGqsefD265TMg7usUDFdp6W1EGMcet8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.Child(hardenedOffset); err != ErrHardenedChild {
+		t.Errorf("err = %v, want ErrHardenedChild", err)
+	}
+}
@@ -0,0 +1,122 @@
+package bitcoin
+
+import (
+	"errors"
+	"math/big"
+)
+
+// Just enough secp256k1 for public key derivation: affine point addition,
+// scalar multiplication and SEC1 compressed encoding. Nothing here handles
+// private keys, so constant-time arithmetic is not a concern.
+
+var (
+	curveP, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEFFFFFC2F", 16)
+	curveN, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEBAAEDCE6AF48A03BBFD25E8CD0364141", 16)
+	curveGx, _ = new(big.Int).SetString("79BE667EF9DCBBAC55A06295CE870B07029BFCDB2DCE28D959F2815B16F81798", 16)
+	curveGy, _ = new(big.Int).SetString("483ADA7726A3C4655DA4FBFC0E1108A8FD17B448A68554199C47D08FFB10D4B8", 16)
+	curveB     = big.NewInt(7)
+)
+
+var errInvalidPoint = errors.New("invalid secp256k1 point")
+
+// point is an affine curve point; a nil x is the point at infinity.
+type point struct {
+	x, y *big.Int
+}
+
+func (p point) isInfinity() bool {
+	return p.x == nil
+}
+
+func mod(v *big.Int) *big.Int {
+	return v.Mod(v, curveP)
+}
+
+func addPoints(a, b point) point {
+	if a.isInfinity() {
+		return b
+	}
+	if b.isInfinity() {
+		return a
+	}
+	if a.x.Cmp(b.x) == 0 {
+		if mod(new(big.Int).Add(a.y, b.y)).Sign() == 0 {
+			return point{}
+		}
+		return doublePoint(a)
+	}
+	// λ = (y2 - y1) / (x2 - x1)
+	num := mod(new(big.Int).Sub(b.y, a.y))
+	den := new(big.Int).ModInverse(mod(new(big.Int).Sub(b.x, a.x)), curveP)
+	return lineThrough(a, b.x, mod(num.Mul(num, den)))
+}
+
+func doublePoint(a point) point {
+	if a.isInfinity() || a.y.Sign() == 0 {
+		return point{}
+	}
+	// λ = 3x² / 2y
+	num := new(big.Int).Mul(a.x, a.x)
+	num.Mul(num, big.NewInt(3))
+	den := new(big.Int).ModInverse(mod(new(big.Int).Lsh(a.y, 1)), curveP)
+	return lineThrough(a, a.x, mod(num.Mul(num, den)))
+}
+
+// lineThrough returns the third intersection of the line with slope lambda
+// through a (and a point with x coordinate bx), reflected over the x axis.
+func lineThrough(a point, bx, lambda *big.Int) point {
+	x := new(big.Int).Mul(lambda, lambda)
+	x.Sub(x, a.x)
+	x.Sub(x, bx)
+	mod(x)
+	y := new(big.Int).Sub(a.x, x)
+	y.Mul(y, lambda)
+	y.Sub(y, a.y)
+	return point{x: x, y: mod(y)}
+}
+
+func scalarMult(k *big.Int, p point) point {
+	var r point
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		r = doublePoint(r)
+		if k.Bit(i) == 1 {
+			r = addPoints(r, p)
+		}
+	}
+	return r
+}
+
+func scalarBaseMult(k *big.Int) point {
+	return scalarMult(k, point{x: curveGx, y: curveGy})
+}
+
+// compress encodes p in 33-byte SEC1 compressed form.
+func (p point) compress() []byte {
+	out := make([]byte, 33)
+	out[0] = 0x02 + byte(p.y.Bit(0))
+	p.x.FillBytes(out[1:])
+	return out
+}
+
+func decompress(b []byte) (point, error) {
+	if len(b) != 33 || (b[0] != 0x02 && b[0] != 0x03) {
+		return point{}, errInvalidPoint
+	}
+	x := new(big.Int).SetBytes(b[1:])
+	if x.Cmp(curveP) >= 0 {
+		return point{}, errInvalidPoint
+	}
+	// y² = x³ + 7; p ≡ 3 (mod 4), so y = (y²)^((p+1)/4)
+	y2 := new(big.Int).Exp(x, big.NewInt(3), curveP)
+	mod(y2.Add(y2, curveB))
+	exp := new(big.Int).Add(curveP, big.NewInt(1))
+	exp.Rsh(exp, 2)
+	y := new(big.Int).Exp(y2, exp, curveP)
+	if new(big.Int).Exp(y, big.NewInt(2), curveP).Cmp(y2) != 0 {
+		return point{}, errInvalidPoint
+	}
+	if y.Bit(0) != uint(b[0]&1) {
+		y.Sub(curveP, y)
+	}
+	return point{x: x, y: y}, nil
+}
@@ -0,0 +1,35 @@
+package bitcoin
+
+import (
+	"context"
+	"errors"
+
+	"license_keys_shop/internal/money"
+)
+
+var (
+	ErrTxNotFound = errors.New("transaction not found")
+	ErrNoOutput   = errors.New("transaction does not pay the deposit address")
+)
+
+// Payment is what a transaction pays to one address.
+type Payment struct {
+	TxID          string      `json:"txid"`
+	Address       string      `json:"address"`
+	Amount        money.Money `json:"amount"`
+	Confirmations int         `json:"confirmations"`
+}
+
+// ChainVerifier looks transactions up on the chain instead of trusting what
+// the buyer claims to have sent.
+type ChainVerifier interface {
+	// PaymentTo sums the outputs of txid paying address. It returns
+	// ErrTxNotFound for unknown transactions and ErrNoOutput when the
+	// transaction exists but pays nothing to address.
+	PaymentTo(ctx context.Context, txid, address string) (Payment, error)
+}
+
+// Confirmed reports whether p has at least required confirmations.
+func (p Payment) Confirmed(required int) bool {
+	return p.Confirmations >= required
+}
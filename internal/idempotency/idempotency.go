@@ -0,0 +1,184 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Header is the request header carrying the client's key. HTML forms,
+// which can't set headers, send it in FormField instead.
+const (
+	Header    = "Idempotency-Key"
+	FormField = "idempotency_key"
+)
+
+// TTL is how long a key and its response are kept.
+const TTL = 24 * time.Hour
+
+// lockTimeout is after how long an unfinished request is treated as
+// abandoned (e.g. the server died mid-request) and may be retried.
+const lockTimeout = 2 * time.Minute
+
+const maxKeyLength = 255
+
+var (
+	ErrInProgress = errors.New("a request with this idempotency key is still in progress")
+	ErrMismatch   = errors.New("idempotency key was already used for a different request")
+)
+
+// Response is a stored result, replayed for retries.
+type Response struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+}
+
+// Store keeps keys per scope (usually the user), so two users can't see
+// each other's responses by guessing keys.
+type Store interface {
+	// Reserve claims scope/key for a request with the given fingerprint.
+	// It returns (nil, nil) when the caller should run the request, the
+	// stored response for a completed one, ErrInProgress while another
+	// request holds the key, and ErrMismatch if the fingerprint differs.
+	Reserve(ctx context.Context, scope, key, fingerprint string) (*Response, error)
+	Complete(ctx context.Context, scope, key string, resp Response) error
+	// Release forgets a reservation so the request can be retried.
+	Release(ctx context.Context, scope, key string) error
+}
+
+// replayedHeaders are the response headers worth replaying.
+var replayedHeaders = []string{"Content-Type", "Location"}
+
+// Handle runs next at most once per scope and Idempotency-Key; requests
+// without a key run as usual, and keyed requests with an empty scope are
+// refused. Server errors are not stored, so a retry after one runs the
+// request again.
+func Handle(store Store, scope string, w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	key := requestKey(r, body)
+	if key == "" {
+		next(w, r)
+		return
+	}
+	if len(key) > maxKeyLength {
+		http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+		return
+	}
+	if scope == "" {
+		// Clients without a session would all share one scope and could
+		// get each other's responses replayed
+		http.Error(w, "Idempotency-Key requires a session", http.StatusUnauthorized)
+		return
+	}
+
+	ctx := r.Context()
+	stored, err := store.Reserve(ctx, scope, key, fingerprint(r, body))
+	switch {
+	case errors.Is(err, ErrInProgress):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, ErrMismatch):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		http.Error(w, "Idempotency store unavailable", http.StatusServiceUnavailable)
+		return
+	case stored != nil:
+		for _, name := range replayedHeaders {
+			if v := stored.Header.Get(name); v != "" {
+				w.Header().Set(name, v)
+			}
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(stored.StatusCode)
+		w.Write(stored.Body)
+		return
+	}
+
+	rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+	defer func() {
+		// Finish with a fresh context: the client may be gone already
+		bg := context.Background()
+		if p := recover(); p != nil {
+			store.Release(bg, scope, key)
+			panic(p)
+		}
+		if rec.status >= 500 {
+			store.Release(bg, scope, key)
+			return
+		}
+		resp := Response{StatusCode: rec.status, Header: http.Header{}, Body: rec.body.Bytes()}
+		for _, name := range replayedHeaders {
+			if v := w.Header().Get(name); v != "" {
+				resp.Header.Set(name, v)
+			}
+		}
+		store.Complete(bg, scope, key, resp)
+	}()
+	next(rec, r)
+}
+
+// Middleware applies Handle to every request, scoped by scope(r), which
+// must return "" for requests without a session.
+func Middleware(store Store, scope func(*http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Handle(store, scope(r), w, r, next.ServeHTTP)
+		})
+	}
+}
+
+func requestKey(r *http.Request, body []byte) string {
+	if key := r.Header.Get(Header); key != "" {
+		return key
+	}
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "application/x-www-form-urlencoded" {
+		if form, err := url.ParseQuery(string(body)); err == nil {
+			return form.Get(FormField)
+		}
+	}
+	return r.URL.Query().Get(FormField)
+}
+
+// fingerprint identifies "the same request": method, path, query and body.
+func fingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"?"+r.URL.RawQuery+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type recorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
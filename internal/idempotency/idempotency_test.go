@@ -0,0 +1,53 @@
+package idempotency
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleReplaysResponse(t *testing.T) {
+	store := NewMemoryStore()
+	calls := 0
+	next := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"order_id":1}`))
+	}
+
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/checkout", strings.NewReader("payment_method=mir"))
+		r.Header.Set(Header, "key-1")
+		w := httptest.NewRecorder()
+		Handle(store, "user:1", w, r, next)
+		if w.Code != http.StatusCreated || w.Body.String() != `{"order_id":1}` {
+			t.Fatalf("request %d: %d %s", i+1, w.Code, w.Body.String())
+		}
+	}
+	if calls != 1 {
+		t.Errorf("handler ran %d times, want 1", calls)
+	}
+}
+
+func TestHandleRejectsKeyWithoutScope(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/checkout", nil)
+	r.Header.Set(Header, "key-1")
+	w := httptest.NewRecorder()
+	Handle(NewMemoryStore(), "", w, r, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler ran for a keyed request without a session")
+	})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestHandleWithoutKeyRunsWithoutScope(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/checkout", nil)
+	w := httptest.NewRecorder()
+	ran := false
+	Handle(NewMemoryStore(), "", w, r, func(w http.ResponseWriter, r *http.Request) { ran = true })
+	if !ran {
+		t.Error("handler did not run for a request without a key")
+	}
+}
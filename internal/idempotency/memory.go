@@ -0,0 +1,73 @@
+package idempotency
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps keys in process memory, for single-instance services.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+}
+
+type memoryEntry struct {
+	fingerprint string
+	response    *Response
+	lockedAt    time.Time
+	expiresAt   time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]*memoryEntry)}
+}
+
+func (s *MemoryStore) Reserve(ctx context.Context, scope, key, fingerprint string) (*Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.purge(now)
+
+	id := scope + "\x00" + key
+	e, ok := s.entries[id]
+	if !ok {
+		s.entries[id] = &memoryEntry{fingerprint: fingerprint, lockedAt: now, expiresAt: now.Add(TTL)}
+		return nil, nil
+	}
+	if e.fingerprint != fingerprint {
+		return nil, ErrMismatch
+	}
+	if e.response != nil {
+		return e.response, nil
+	}
+	if now.Sub(e.lockedAt) < lockTimeout {
+		return nil, ErrInProgress
+	}
+	e.lockedAt = now
+	return nil, nil
+}
+
+func (s *MemoryStore) Complete(ctx context.Context, scope, key string, resp Response) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[scope+"\x00"+key]; ok {
+		e.response = &resp
+	}
+	return nil
+}
+
+func (s *MemoryStore) Release(ctx context.Context, scope, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, scope+"\x00"+key)
+	return nil
+}
+
+func (s *MemoryStore) purge(now time.Time) {
+	for id, e := range s.entries {
+		if now.After(e.expiresAt) {
+			delete(s.entries, id)
+		}
+	}
+}
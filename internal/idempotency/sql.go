@@ -0,0 +1,106 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// DB is what SQLStore needs from the database handle.
+type DB interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// SQLStore keeps keys in the idempotency_keys table, so retries are
+// recognised across restarts and instances.
+type SQLStore struct {
+	db DB
+}
+
+func NewSQLStore(db DB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+func (s *SQLStore) Reserve(ctx context.Context, scope, key, fingerprint string) (*Response, error) {
+	if _, err := s.db.Exec(
+		"DELETE FROM idempotency_keys WHERE expires_at < CURRENT_TIMESTAMP"); err != nil {
+		return nil, err
+	}
+
+	res, err := s.db.Exec(fmt.Sprintf(`
+		INSERT INTO idempotency_keys (scope, key, fingerprint, locked_at, expires_at)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP + INTERVAL '%d seconds')
+		ON CONFLICT (scope, key) DO NOTHING`, int(TTL.Seconds())),
+		scope, key, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return nil, nil
+	}
+
+	var stored string
+	var status sql.NullInt64
+	var header, body []byte
+	err = s.db.QueryRow(`
+		SELECT fingerprint, status_code, response_header, response_body
+		FROM idempotency_keys WHERE scope = $1 AND key = $2`,
+		scope, key).Scan(&stored, &status, &header, &body)
+	if err == sql.ErrNoRows {
+		// Expired and removed between the two statements; try again
+		return s.Reserve(ctx, scope, key, fingerprint)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stored != fingerprint {
+		return nil, ErrMismatch
+	}
+
+	if !status.Valid {
+		// Take over a request abandoned mid-way
+		res, err := s.db.Exec(fmt.Sprintf(`
+			UPDATE idempotency_keys SET locked_at = CURRENT_TIMESTAMP
+			WHERE scope = $1 AND key = $2 AND status_code IS NULL
+			  AND locked_at < CURRENT_TIMESTAMP - INTERVAL '%d seconds'`, int(lockTimeout.Seconds())),
+			scope, key)
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := res.RowsAffected(); n == 1 {
+			return nil, nil
+		}
+		return nil, ErrInProgress
+	}
+
+	resp := &Response{StatusCode: int(status.Int64), Header: http.Header{}, Body: body}
+	if len(header) > 0 {
+		if err := json.Unmarshal(header, &resp.Header); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+func (s *SQLStore) Complete(ctx context.Context, scope, key string, resp Response) error {
+	header, err := json.Marshal(resp.Header)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+		UPDATE idempotency_keys
+		SET status_code = $1, response_header = $2, response_body = $3
+		WHERE scope = $4 AND key = $5`,
+		resp.StatusCode, string(header), resp.Body, scope, key)
+	return err
+}
+
+func (s *SQLStore) Release(ctx context.Context, scope, key string) error {
+	_, err := s.db.Exec(
+		"DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2 AND status_code IS NULL",
+		scope, key)
+	return err
+}
@@ -0,0 +1,67 @@
+package ids
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// IDs are ULIDs: a 48-bit millisecond timestamp followed by 80 random bits
+// from crypto/rand, written as 26 characters of Crockford base32. They sort
+// by creation millisecond; IDs made in the same millisecond are in no
+// particular order. An ID names a row, it doesn't prove anything: anything
+// that grants access (tokens, challenges, links) uses its own secret instead.
+
+const encoding = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// Length is the length of an ID without prefix.
+const Length = 26
+
+// New returns a fresh ID.
+func New() string {
+	return encode(next(time.Now()))
+}
+
+// WithPrefix returns prefix_ID, e.g. "txn_01J9Z3...", for identifiers that
+// are read by people as well as programs.
+func WithPrefix(prefix string) string {
+	return prefix + "_" + New()
+}
+
+func next(now time.Time) [16]byte {
+	var id [16]byte
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(now.UnixMilli()))
+	copy(id[:6], ts[2:])
+	if _, err := rand.Read(id[6:]); err != nil {
+		panic("ids: crypto/rand failed: " + err.Error())
+	}
+	return id
+}
+
+func encode(id [16]byte) string {
+	// 128 bits as 26 five-bit groups, the first group holding the top 3 bits
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	out := make([]byte, Length)
+	for i := Length - 1; i >= 0; i-- {
+		out[i] = encoding[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
+
+// Valid reports whether s looks like an ID made by New.
+func Valid(s string) bool {
+	if len(s) != Length || s[0] > '7' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !strings.ContainsRune(encoding, rune(s[i])) {
+			return false
+		}
+	}
+	return true
+}
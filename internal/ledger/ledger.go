@@ -0,0 +1,246 @@
+package ledger
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"license_keys_shop/internal/money"
+)
+
+// Kind says why money moved; the names match balance_transactions in the
+// storefront schema.
+type Kind string
+
+const (
+	Deposit    Kind = "deposit"
+	Withdrawal Kind = "withdrawal"
+	Purchase   Kind = "purchase"
+	Refund     Kind = "refund"
+	Opening    Kind = "opening"
+)
+
+// System accounts, created by the migration. They may go negative: they
+// mirror money held outside the shop or earned by it.
+const (
+	ExternalPayments = "external:payments"
+	SalesRevenue     = "revenue:sales"
+)
+
+var (
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrUnbalanced        = errors.New("ledger transaction does not balance")
+	ErrAccountNotFound   = errors.New("ledger account not found")
+)
+
+// Querier is satisfied by both *sql.DB and *sql.Tx.
+type Querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type Entry struct {
+	AccountID int
+	Amount    money.Money
+}
+
+type Transaction struct {
+	ID          int
+	Kind        Kind
+	Description string
+	OrderID     *int
+	Reference   string
+	Entries     []Entry
+	CreatedAt   time.Time
+}
+
+func (t Transaction) validate() error {
+	if len(t.Entries) < 2 {
+		return fmt.Errorf("%w: needs at least two entries", ErrUnbalanced)
+	}
+	sum := money.Zero(money.Base)
+	for _, e := range t.Entries {
+		if e.Amount.IsZero() {
+			return fmt.Errorf("%w: zero entry for account %d", ErrUnbalanced, e.AccountID)
+		}
+		if e.Amount.Currency() != money.Base {
+			return fmt.Errorf("%w: entries must be in %s", ErrUnbalanced, money.Base)
+		}
+		sum = sum.Add(e.Amount)
+	}
+	if !sum.IsZero() {
+		return fmt.Errorf("%w: entries sum to %s", ErrUnbalanced, sum.Format())
+	}
+	return nil
+}
+
+// Post records t inside the caller's transaction. The affected accounts are
+// locked in id order, so concurrent postings on one wallet serialise and
+// the second purchase sees what the first one left; an account that isn't
+// allowed to go negative fails with ErrInsufficientFunds.
+func Post(tx *sql.Tx, t Transaction) (int, error) {
+	if err := t.validate(); err != nil {
+		return 0, err
+	}
+
+	deltas := make(map[int]money.Money)
+	var ids []int
+	for _, e := range t.Entries {
+		if _, ok := deltas[e.AccountID]; !ok {
+			ids = append(ids, e.AccountID)
+		}
+		deltas[e.AccountID] = deltas[e.AccountID].Add(e.Amount)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		var balance money.Money
+		var allowNegative bool
+		var userID sql.NullInt64
+		err := tx.QueryRow(`
+			SELECT balance, allow_negative, user_id FROM ledger_accounts
+			WHERE id = $1 FOR UPDATE`, id).Scan(&balance, &allowNegative, &userID)
+		if err == sql.ErrNoRows {
+			return 0, fmt.Errorf("%w: %d", ErrAccountNotFound, id)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		next := balance.Add(deltas[id])
+		if !allowNegative && next.IsNegative() {
+			return 0, ErrInsufficientFunds
+		}
+
+		if _, err := tx.Exec("UPDATE ledger_accounts SET balance = $1 WHERE id = $2", next, id); err != nil {
+			return 0, err
+		}
+		if userID.Valid {
+			if _, err := tx.Exec("UPDATE users SET balance = $1 WHERE id = $2", next, userID.Int64); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	var reference sql.NullString
+	if t.Reference != "" {
+		reference = sql.NullString{String: t.Reference, Valid: true}
+	}
+	var txID int
+	err := tx.QueryRow(`
+		INSERT INTO ledger_transactions (kind, description, order_id, reference)
+		VALUES ($1, $2, $3, $4) RETURNING id`,
+		string(t.Kind), t.Description, t.OrderID, reference).Scan(&txID)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, e := range t.Entries {
+		_, err := tx.Exec(`
+			INSERT INTO ledger_entries (transaction_id, account_id, amount)
+			VALUES ($1, $2, $3)`, txID, e.AccountID, e.Amount)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return txID, nil
+}
+
+// AccountID looks up a system account by code.
+func AccountID(q Querier, code string) (int, error) {
+	var id int
+	err := q.QueryRow("SELECT id FROM ledger_accounts WHERE code = $1", code).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%w: %s", ErrAccountNotFound, code)
+	}
+	return id, err
+}
+
+// WalletAccount returns the user's wallet account, opening it on first use.
+func WalletAccount(tx *sql.Tx, userID int) (int, error) {
+	_, err := tx.Exec(`
+		INSERT INTO ledger_accounts (code, user_id) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`, fmt.Sprintf("wallet:%d", userID), userID)
+	if err != nil {
+		return 0, err
+	}
+	var id int
+	err = tx.QueryRow("SELECT id FROM ledger_accounts WHERE user_id = $1", userID).Scan(&id)
+	return id, err
+}
+
+// UserBalance is the user's wallet balance; users without a wallet have none.
+func UserBalance(q Querier, userID int) (money.Money, error) {
+	var balance money.Money
+	err := q.QueryRow("SELECT balance FROM ledger_accounts WHERE user_id = $1", userID).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return money.Zero(money.Base), nil
+	}
+	return balance, err
+}
+
+// HistoryEntry is one movement on a user's wallet.
+type HistoryEntry struct {
+	TransactionID int         `json:"transaction_id"`
+	Type          string      `json:"type"`
+	Amount        money.Money `json:"amount"`
+	BalanceAfter  money.Money `json:"balance_after"`
+	Description   string      `json:"description"`
+	OrderID       *int        `json:"order_id,omitempty"`
+	CreatedAt     time.Time   `json:"created_at"`
+}
+
+// History lists the newest wallet movements first.
+func History(q Querier, userID, limit, offset int) ([]HistoryEntry, error) {
+	rows, err := q.Query(`
+		SELECT t.id, t.kind, t.description, t.order_id, e.amount, e.balance_after, t.created_at
+		FROM (
+			SELECT e.id, e.transaction_id, e.amount,
+			       SUM(e.amount) OVER (ORDER BY e.id) AS balance_after
+			FROM ledger_entries e
+			JOIN ledger_accounts a ON e.account_id = a.id
+			WHERE a.user_id = $1
+		) e
+		JOIN ledger_transactions t ON e.transaction_id = t.id
+		ORDER BY e.id DESC
+		LIMIT $2 OFFSET $3`, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []HistoryEntry{}
+	for rows.Next() {
+		var h HistoryEntry
+		var kind string
+		var orderID sql.NullInt64
+		if err := rows.Scan(&h.TransactionID, &kind, &h.Description, &orderID,
+			&h.Amount, &h.BalanceAfter, &h.CreatedAt); err != nil {
+			return nil, err
+		}
+		h.Type = typeName(Kind(kind))
+		if orderID.Valid {
+			id := int(orderID.Int64)
+			h.OrderID = &id
+		}
+		history = append(history, h)
+	}
+	return history, rows.Err()
+}
+
+// typeName maps a kind to the BalanceTransactionType enum of the storefront.
+func typeName(k Kind) string {
+	switch k {
+	case Deposit:
+		return "DEPOSIT"
+	case Withdrawal:
+		return "WITHDRAWAL"
+	case Purchase:
+		return "PURCHASE"
+	case Refund:
+		return "REFUND"
+	}
+	return "DEPOSIT"
+}
@@ -0,0 +1,70 @@
+package ledger
+
+import "fmt"
+
+// Violation is a broken ledger invariant.
+type Violation struct {
+	Check   string `json:"check"`
+	ID      int    `json:"id"`
+	Message string `json:"message"`
+}
+
+var checks = []struct {
+	name    string
+	query   string
+	message string
+}{
+	{
+		name: "unbalanced_transaction",
+		query: `
+			SELECT transaction_id FROM ledger_entries
+			GROUP BY transaction_id HAVING SUM(amount) <> 0`,
+		message: "entries of transaction %d do not sum to zero",
+	},
+	{
+		name: "balance_mismatch",
+		query: `
+			SELECT a.id FROM ledger_accounts a
+			LEFT JOIN (SELECT account_id, SUM(amount) AS total FROM ledger_entries GROUP BY account_id) e
+			       ON e.account_id = a.id
+			WHERE a.balance <> COALESCE(e.total, 0)`,
+		message: "cached balance of account %d differs from its entries",
+	},
+	{
+		name: "negative_balance",
+		query: `
+			SELECT id FROM ledger_accounts
+			WHERE NOT allow_negative AND balance < 0`,
+		message: "account %d is overdrawn",
+	},
+	{
+		name: "user_balance_mismatch",
+		query: `
+			SELECT u.id FROM users u
+			JOIN ledger_accounts a ON a.user_id = u.id
+			WHERE u.balance <> a.balance`,
+		message: "users.balance of user %d differs from the wallet account",
+	},
+}
+
+// Verify runs the ledger invariants over the whole database and lists
+// every violation found; an empty list means the books are consistent.
+func Verify(q Querier) ([]Violation, error) {
+	violations := []Violation{}
+	for _, c := range checks {
+		rows, err := q.Query(c.query)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			violations = append(violations, Violation{Check: c.name, ID: id, Message: fmt.Sprintf(c.message, id)})
+		}
+		rows.Close()
+	}
+	return violations, nil
+}
@@ -0,0 +1,56 @@
+package ledger
+
+import (
+	"database/sql"
+	"fmt"
+
+	"license_keys_shop/internal/money"
+)
+
+// TopUp credits money that came in through a payment provider.
+func TopUp(tx *sql.Tx, userID int, amount money.Money, description, reference string) (int, error) {
+	return move(tx, userID, ExternalPayments, amount, Transaction{
+		Kind:        Deposit,
+		Description: description,
+		Reference:   reference,
+	})
+}
+
+// PayOrder debits the user's wallet for an order.
+func PayOrder(tx *sql.Tx, userID, orderID int, amount money.Money) (int, error) {
+	return move(tx, userID, SalesRevenue, amount.Neg(), Transaction{
+		Kind:        Purchase,
+		Description: fmt.Sprintf("Payment for order #%d", orderID),
+		OrderID:     &orderID,
+	})
+}
+
+// RefundOrder gives money for an order back to the user's wallet.
+func RefundOrder(tx *sql.Tx, userID, orderID int, amount money.Money, description string) (int, error) {
+	return move(tx, userID, SalesRevenue, amount, Transaction{
+		Kind:        Refund,
+		Description: description,
+		OrderID:     &orderID,
+	})
+}
+
+// move posts amount to the user's wallet against a system account; a
+// negative amount leaves the wallet.
+func move(tx *sql.Tx, userID int, counterpart string, amount money.Money, t Transaction) (int, error) {
+	if amount.IsZero() {
+		return 0, fmt.Errorf("%w: zero amount", ErrUnbalanced)
+	}
+	wallet, err := WalletAccount(tx, userID)
+	if err != nil {
+		return 0, err
+	}
+	other, err := AccountID(tx, counterpart)
+	if err != nil {
+		return 0, err
+	}
+	t.Entries = []Entry{
+		{AccountID: wallet, Amount: amount},
+		{AccountID: other, Amount: amount.Neg()},
+	}
+	return Post(tx, t)
+}
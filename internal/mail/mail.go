@@ -0,0 +1,86 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"license_keys_shop/internal/ids"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends messages to users.
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// FromEnv picks the mailer: a FileMailer when MAIL_DIR is set, a LogMailer
+// otherwise.
+func FromEnv() (Mailer, error) {
+	if dir := os.Getenv("MAIL_DIR"); dir != "" {
+		return NewFileMailer(dir, os.Getenv("MAIL_FROM"))
+	}
+	return LogMailer{}, nil
+}
+
+// LogMailer writes messages to the log instead of sending them, for
+// development and setups without a mail server.
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, m Message) error {
+	log.Printf("mail to %s: %s\n%s", m.To, m.Subject, m.Body)
+	return nil
+}
+
+const defaultFrom = "KeyShop <noreply@keyshop.local>"
+
+// FileMailer writes every message as an .eml file into a directory, where
+// a mail client or a test can pick it up.
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+func NewFileMailer(dir, from string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	if from == "" {
+		from = defaultFrom
+	}
+	return &FileMailer{dir: dir, from: from}, nil
+}
+
+func (f *FileMailer) Send(ctx context.Context, m Message) error {
+	if strings.ContainsAny(m.To+m.Subject, "\r\n") {
+		return fmt.Errorf("mail: header contains a line break")
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", f.from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+
+	// Write under a temporary name so readers never see half a message
+	name := filepath.Join(f.dir, ids.New()+".eml")
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
@@ -0,0 +1,18 @@
+package models
+
+import "license_keys_shop/internal/money"
+
+// CatalogProduct is a product as shown to buyers: Price is the price
+// currently charged in Currency, DisplayPrice is that price in the buyer's
+// chosen currency, Sale is set while a sale is running and Components lists
+// what a bundle contains. Price is exact and shadows the float Price of the
+// embedded Product, which nothing in the shop reads or writes any more.
+type CatalogProduct struct {
+	Product
+	Price        money.Money      `json:"price"`
+	Currency     money.Currency   `json:"currency"`
+	DisplayPrice *Price           `json:"display_price,omitempty"`
+	Sale         *ProductSale     `json:"sale,omitempty"`
+	IsBundle     bool             `json:"is_bundle"`
+	Components   []CatalogProduct `json:"components,omitempty"`
+}
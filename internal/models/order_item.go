@@ -0,0 +1,43 @@
+package models
+
+import (
+	"time"
+
+	"license_keys_shop/internal/money"
+)
+
+type CartItem struct {
+	ID        int             `json:"id"`
+	UserID    int             `json:"user_id"`
+	ProductID int             `json:"product_id"`
+	Quantity  int             `json:"quantity"`
+	UnitPrice money.Money     `json:"unit_price"`
+	CreatedAt time.Time       `json:"created_at"`
+	Product   *CatalogProduct `json:"product,omitempty"`
+}
+
+type OrderItem struct {
+	ID        int             `json:"id"`
+	OrderID   int             `json:"order_id"`
+	ProductID int             `json:"product_id"`
+	UnitPrice money.Money     `json:"unit_price"`
+	Quantity  int             `json:"quantity"`
+	Product   *CatalogProduct `json:"product,omitempty"`
+}
+
+// OrderDetails is an order together with its line items. Its amounts are
+// exact and shadow the float TotalAmount of the embedded Order; they are in
+// money.Base, and Charged is what the buyer pays at ExchangeRate.
+type OrderDetails struct {
+	Order
+	Reference      string      `json:"reference"`
+	SubtotalAmount money.Money `json:"subtotal_amount"`
+	DiscountAmount money.Money `json:"discount_amount"`
+	TotalAmount    money.Money `json:"total_amount"`
+	RefundedAmount money.Money `json:"refunded_amount"`
+	Charged        *Price      `json:"charged"`
+	ExchangeRate   string      `json:"exchange_rate"`
+	PromoCode      string      `json:"promo_code,omitempty"`
+	Items          []OrderItem `json:"items"`
+	Refunds        []Refund    `json:"refunds,omitempty"`
+}
@@ -0,0 +1,14 @@
+package models
+
+import "license_keys_shop/internal/money"
+
+// Price is an amount together with its currency, for values that are not in
+// the base currency.
+type Price struct {
+	Amount   money.Money    `json:"amount"`
+	Currency money.Currency `json:"currency"`
+}
+
+func NewPrice(m money.Money) *Price {
+	return &Price{Amount: m, Currency: m.Currency()}
+}
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+
+	"license_keys_shop/internal/money"
+)
+
+// Refund gives back part or all of an order's total. Amount is in
+// money.Base; Charged is the same refund in the currency the order was paid in.
+type Refund struct {
+	ID          int           `json:"id"`
+	OrderID     int           `json:"order_id"`
+	Amount      money.Money   `json:"amount"`
+	Charged     *Price        `json:"charged"`
+	Destination string        `json:"destination"`
+	Reference   string        `json:"reference,omitempty"`
+	Reason      string        `json:"reason"`
+	Keys        []RefundedKey `json:"keys,omitempty"`
+	CreatedAt   time.Time     `json:"created_at"`
+}
+
+// RefundedKey is a delivered key taken back by a refund: "returned" to
+// inventory if the buyer never saw it, "revoked" otherwise.
+type RefundedKey struct {
+	ProductID int    `json:"product_id"`
+	Title     string `json:"title"`
+	Action    string `json:"action"`
+}
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+
+	"license_keys_shop/internal/money"
+)
+
+type ProductSale struct {
+	ID              int         `json:"id"`
+	ProductID       int         `json:"product_id"`
+	OldPrice        money.Money `json:"old_price"`
+	SalePrice       money.Money `json:"sale_price"`
+	DiscountPercent int         `json:"discount_percent"`
+	StartsAt        time.Time   `json:"starts_at"`
+	EndsAt          time.Time   `json:"ends_at"`
+}
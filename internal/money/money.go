@@ -0,0 +1,396 @@
+package money
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+type Currency string
+
+const (
+	RUB Currency = "RUB"
+	USD Currency = "USD"
+	EUR Currency = "EUR"
+	BTC Currency = "BTC"
+)
+
+// Base is the currency prices are stored in.
+const Base = RUB
+
+var decimals = map[Currency]int{
+	RUB: 2,
+	USD: 2,
+	EUR: 2,
+	BTC: 8,
+}
+
+var (
+	ErrInvalidAmount    = errors.New("invalid money amount")
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+)
+
+// ParseCurrency accepts a known currency code in any case.
+func ParseCurrency(code string) (Currency, bool) {
+	c := Currency(strings.ToUpper(strings.TrimSpace(code)))
+	_, ok := decimals[c]
+	return c, ok
+}
+
+// Decimals is the number of minor-unit digits of the currency.
+func (c Currency) Decimals() int {
+	if d, ok := decimals[c]; ok {
+		return d
+	}
+	return 2
+}
+
+func (c Currency) scale() int64 {
+	return int64(math.Pow10(c.Decimals()))
+}
+
+// Money is an exact amount in minor units (kopecks, cents) of a currency.
+// The zero value is zero in no particular currency and combines with any
+// currency, so `var total money.Money` works as an accumulator.
+type Money struct {
+	minor    int64
+	currency Currency
+}
+
+func New(minor int64, currency Currency) Money {
+	return Money{minor: minor, currency: currency}
+}
+
+func Zero(currency Currency) Money {
+	return Money{currency: currency}
+}
+
+// FromFloat converts a float amount, rounding half away from zero to the
+// nearest minor unit. Use it only at boundaries that still deal in floats.
+func FromFloat(amount float64, currency Currency) Money {
+	return Money{minor: int64(math.Round(amount * float64(currency.scale()))), currency: currency}
+}
+
+// Parse reads a decimal string such as "1499.90" exactly. Digits beyond the
+// currency precision are rounded half away from zero.
+func Parse(s string, currency Currency) (Money, error) {
+	s = strings.TrimSpace(s)
+	r, ok := new(big.Rat).SetString(s)
+	if !ok || strings.ContainsAny(s, "/eE") {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+	r.Mul(r, new(big.Rat).SetInt64(currency.scale()))
+	minor, err := roundRat(r)
+	if err != nil {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+	return Money{minor: minor, currency: currency}, nil
+}
+
+func MustParse(s string, currency Currency) Money {
+	m, err := Parse(s, currency)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// roundRat rounds half away from zero to an int64.
+func roundRat(r *big.Rat) (int64, error) {
+	num := new(big.Int).Set(r.Num())
+	den := r.Denom()
+	neg := num.Sign() < 0
+	num.Abs(num)
+
+	q, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Mul(rem, big.NewInt(2)).Cmp(den) >= 0 {
+		q.Add(q, big.NewInt(1))
+	}
+	if neg {
+		q.Neg(q)
+	}
+	if !q.IsInt64() {
+		return 0, ErrInvalidAmount
+	}
+	return q.Int64(), nil
+}
+
+func (m Money) Minor() int64 {
+	return m.minor
+}
+
+func (m Money) Currency() Currency {
+	if m.currency == "" {
+		return Base
+	}
+	return m.currency
+}
+
+// Float64 is for display and legacy float fields only, never for arithmetic.
+func (m Money) Float64() float64 {
+	return float64(m.minor) / float64(m.Currency().scale())
+}
+
+// String formats the amount as a plain decimal, e.g. "1499.90".
+func (m Money) String() string {
+	d := m.Currency().Decimals()
+	sign := ""
+	minor := m.minor
+	if minor < 0 {
+		sign = "-"
+		minor = -minor
+	}
+	s := strconv.FormatInt(minor, 10)
+	if d == 0 {
+		return sign + s
+	}
+	if len(s) <= d {
+		s = strings.Repeat("0", d-len(s)+1) + s
+	}
+	return sign + s[:len(s)-d] + "." + s[len(s)-d:]
+}
+
+// Format is String with the currency code, e.g. "1499.90 RUB".
+func (m Money) Format() string {
+	return m.String() + " " + string(m.Currency())
+}
+
+func (m Money) IsZero() bool {
+	return m.minor == 0
+}
+
+func (m Money) IsNegative() bool {
+	return m.minor < 0
+}
+
+func (m Money) IsPositive() bool {
+	return m.minor > 0
+}
+
+func (m Money) currencyWith(o Money) Currency {
+	switch {
+	case m.currency == "":
+		return o.currency
+	case o.currency == "" || o.currency == m.currency:
+		return m.currency
+	}
+	panic(fmt.Sprintf("%v: %s and %s", ErrCurrencyMismatch, m.currency, o.currency))
+}
+
+func (m Money) Add(o Money) Money {
+	return Money{minor: m.minor + o.minor, currency: m.currencyWith(o)}
+}
+
+func (m Money) Sub(o Money) Money {
+	return Money{minor: m.minor - o.minor, currency: m.currencyWith(o)}
+}
+
+func (m Money) Neg() Money {
+	return Money{minor: -m.minor, currency: m.currency}
+}
+
+func (m Money) Mul(n int64) Money {
+	return Money{minor: m.minor * n, currency: m.currency}
+}
+
+// Percent returns p percent of m, rounded half away from zero. p is read as
+// a plain decimal, so an amount of 12.50 means 12.5%.
+func (m Money) Percent(p Money) Money {
+	r := new(big.Rat).SetInt64(m.minor)
+	r.Mul(r, big.NewRat(p.minor, p.Currency().scale()))
+	r.Quo(r, big.NewRat(100, 1))
+	minor, _ := roundRat(r)
+	return Money{minor: minor, currency: m.currency}
+}
+
+// Convert exchanges m into currency to at rate (units of to per one unit of
+// m's currency), rounding half away from zero to to's minor unit.
+func (m Money) Convert(to Currency, rate *big.Rat) Money {
+	from := m.Currency()
+	if from == to {
+		return Money{minor: m.minor, currency: to}
+	}
+	r := new(big.Rat).SetFrac(big.NewInt(m.minor), big.NewInt(from.scale()))
+	r.Mul(r, rate)
+	r.Mul(r, new(big.Rat).SetInt64(to.scale()))
+	minor, _ := roundRat(r)
+	return Money{minor: minor, currency: to}
+}
+
+// Cmp returns -1, 0 or 1 like strings.Compare.
+func (m Money) Cmp(o Money) int {
+	m.currencyWith(o)
+	switch {
+	case m.minor < o.minor:
+		return -1
+	case m.minor > o.minor:
+		return 1
+	}
+	return 0
+}
+
+func (m Money) LessThan(o Money) bool {
+	return m.Cmp(o) < 0
+}
+
+func (m Money) Equal(o Money) bool {
+	return m.Cmp(o) == 0
+}
+
+func Min(a, b Money) Money {
+	if b.LessThan(a) {
+		return b
+	}
+	return a
+}
+
+func Max(a, b Money) Money {
+	if a.LessThan(b) {
+		return b
+	}
+	return a
+}
+
+// Allocate splits m proportionally to weights without losing a minor
+// unit: leftovers from rounding down go to the largest remainders first.
+func (m Money) Allocate(weights []int64) []Money {
+	parts := make([]Money, len(weights))
+	var total int64
+	for _, w := range weights {
+		total += w
+	}
+	for i := range parts {
+		parts[i] = Money{currency: m.currency}
+	}
+	if total <= 0 {
+		return parts
+	}
+
+	type rem struct {
+		index int
+		value int64
+	}
+	rems := make([]rem, len(weights))
+	var allocated int64
+	for i, w := range weights {
+		share := new(big.Int).Mul(big.NewInt(m.minor), big.NewInt(w))
+		q, r := new(big.Int).QuoRem(share, big.NewInt(total), new(big.Int))
+		parts[i].minor = q.Int64()
+		allocated += q.Int64()
+		rems[i] = rem{index: i, value: r.Int64()}
+	}
+
+	left := m.minor - allocated
+	step := int64(1)
+	if left < 0 {
+		step = -1
+		left = -left
+	}
+	for ; left > 0; left-- {
+		best := 0
+		for i := range rems {
+			if abs(rems[i].value) > abs(rems[best].value) {
+				best = i
+			}
+		}
+		parts[rems[best].index].minor += step
+		rems[best].value = 0
+	}
+	return parts
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// MarshalJSON encodes the amount as a bare JSON number ("49.99"), the same
+// shape the API used when prices were float64.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts a JSON number or a numeric string in Base currency.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "null" || s == "" {
+		*m = Money{currency: Base}
+		return nil
+	}
+	// Exponent notation is valid JSON; normalise it before the exact parse
+	if strings.ContainsAny(s, "eE") {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidAmount, s)
+		}
+		s = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	v, err := Parse(s, Base)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+// Scan reads DECIMAL columns exactly; amounts are stored in Base currency.
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*m = Money{currency: Base}
+		return nil
+	case []byte:
+		return m.scanString(string(v))
+	case string:
+		return m.scanString(v)
+	case int64:
+		*m = Money{minor: v * Base.scale(), currency: Base}
+		return nil
+	case float64:
+		*m = FromFloat(v, Base)
+		return nil
+	}
+	return fmt.Errorf("money: cannot scan %T", src)
+}
+
+func (m *Money) scanString(s string) error {
+	v, err := Parse(s, Base)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+// Value stores the amount as a decimal string so DECIMAL columns stay exact.
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+// NullMoney is Money that may be NULL, like sql.NullFloat64.
+type NullMoney struct {
+	Money Money
+	Valid bool
+}
+
+func (n *NullMoney) Scan(src interface{}) error {
+	if src == nil {
+		n.Money, n.Valid = Money{}, false
+		return nil
+	}
+	n.Valid = true
+	return n.Money.Scan(src)
+}
+
+func (n NullMoney) Value() (driver.Value, error) {
+	if !n.Valid {
+		return nil, nil
+	}
+	return n.Money.Value()
+}
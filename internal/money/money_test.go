@@ -0,0 +1,314 @@
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+// jpy has no minor unit. No configured currency is like that, so the tests
+// add one to cover scale 0.
+const jpy Currency = "JPY"
+
+func init() {
+	decimals[jpy] = 0
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in       string
+		currency Currency
+		want     int64
+	}{
+		{"1499.90", RUB, 149990},
+		{" 12 ", RUB, 1200},
+		{"0", RUB, 0},
+		{"0.005", RUB, 1},
+		{"0.0049", RUB, 0},
+		{"-0.005", RUB, -1},
+		{"-1.015", RUB, -102},
+		{"2.675", RUB, 268}, // exact; as a float it is 2.67499... and would round down
+		{"0.000000015", BTC, 2},
+		{"0.00000001", BTC, 1},
+		{"150", jpy, 150},
+		{"150.5", jpy, 151},
+		{"-150.5", jpy, -151},
+		{"150.49", jpy, 150},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in, tt.currency)
+		if err != nil {
+			t.Errorf("Parse(%q, %s): %v", tt.in, tt.currency, err)
+			continue
+		}
+		if got.Minor() != tt.want || got.Currency() != tt.currency {
+			t.Errorf("Parse(%q, %s) = %d %s, want %d", tt.in, tt.currency, got.Minor(), got.Currency(), tt.want)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, in := range []string{"", "abc", "1e3", "1/2", "1,50", "99999999999999999999"} {
+		if _, err := Parse(in, RUB); !errors.Is(err, ErrInvalidAmount) {
+			t.Errorf("Parse(%q) error = %v, want ErrInvalidAmount", in, err)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{New(149990, RUB), "1499.90"},
+		{New(5, RUB), "0.05"},
+		{New(-5, RUB), "-0.05"},
+		{New(0, RUB), "0.00"},
+		{New(100000000, BTC), "1.00000000"},
+		{New(-1, BTC), "-0.00000001"},
+		{New(150, jpy), "150"},
+		{New(-150, jpy), "-150"},
+		{Money{minor: 100}, "1.00"},
+	}
+	for _, tt := range tests {
+		if got := tt.m.String(); got != tt.want {
+			t.Errorf("%#v.String() = %q, want %q", tt.m, got, tt.want)
+		}
+	}
+}
+
+func TestPercent(t *testing.T) {
+	tests := []struct {
+		amount, percent string
+		want            int64
+	}{
+		{"1000.00", "12.50", 12500},
+		{"1000.00", "100", 100000},
+		{"0.05", "10", 1},   // 0.5 kopeck rounds up
+		{"-0.05", "10", -1}, // and away from zero when negative
+		{"0.04", "10", 0},
+		{"333.33", "33.33", 11110},
+		{"100.00", "0", 0},
+	}
+	for _, tt := range tests {
+		got := MustParse(tt.amount, RUB).Percent(MustParse(tt.percent, Base))
+		if got.Minor() != tt.want {
+			t.Errorf("%s%% of %s = %d, want %d", tt.percent, tt.amount, got.Minor(), tt.want)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		amount Money
+		to     Currency
+		rate   string
+		want   int64
+	}{
+		{New(10000, RUB), USD, "1/90", 111},
+		{New(1, RUB), USD, "1/2", 1},   // half a cent rounds up
+		{New(-1, RUB), USD, "1/2", -1}, // and away from zero when negative
+		{New(100000, RUB), BTC, "1/5000000", 20000},
+		{New(10000, USD), jpy, "150.5", 15050},
+		{New(1, USD), jpy, "50", 1}, // 0.5 yen
+		{New(151, jpy), RUB, "0.6", 9060},
+		{New(4999, RUB), RUB, "2", 4999}, // same currency ignores the rate
+	}
+	for _, tt := range tests {
+		rate, ok := new(big.Rat).SetString(tt.rate)
+		if !ok {
+			t.Fatalf("bad rate %q", tt.rate)
+		}
+		got := tt.amount.Convert(tt.to, rate)
+		if got.Minor() != tt.want || got.Currency() != tt.to {
+			t.Errorf("%s at %s = %s, want %d %s", tt.amount.Format(), tt.rate, got.Format(), tt.want, tt.to)
+		}
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		total   int64
+		weights []int64
+		want    []int64
+	}{
+		{100, []int64{1, 1, 1}, []int64{34, 33, 33}},
+		{-100, []int64{1, 1, 1}, []int64{-34, -33, -33}},
+		{1000, []int64{1, 2, 3, 4}, []int64{100, 200, 300, 400}},
+		{5, []int64{1, 1}, []int64{3, 2}},
+		{7, []int64{0, 1, 2}, []int64{0, 2, 5}},
+		{1, []int64{3, 3, 3}, []int64{1, 0, 0}},
+		{100, []int64{0, 0}, []int64{0, 0}},
+		{0, []int64{1, 2}, []int64{0, 0}},
+		{149990, []int64{49990, 99990, 1}, []int64{49993, 99996, 1}},
+	}
+	for _, tt := range tests {
+		parts := New(tt.total, RUB).Allocate(tt.weights)
+		if len(parts) != len(tt.weights) {
+			t.Fatalf("Allocate(%d, %v) returned %d parts", tt.total, tt.weights, len(parts))
+		}
+		var sum int64
+		for i, p := range parts {
+			sum += p.Minor()
+			if p.Minor() != tt.want[i] || p.Currency() != RUB {
+				t.Errorf("Allocate(%d, %v)[%d] = %s, want %d", tt.total, tt.weights, i, p.Format(), tt.want[i])
+			}
+		}
+		if hasWeight(tt.weights) && sum != tt.total {
+			t.Errorf("Allocate(%d, %v) sums to %d", tt.total, tt.weights, sum)
+		}
+	}
+}
+
+func hasWeight(weights []int64) bool {
+	for _, w := range weights {
+		if w > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestJSON(t *testing.T) {
+	data, err := json.Marshal(struct {
+		Price Money `json:"price"`
+	}{New(4999, RUB)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"price":49.99}` {
+		t.Errorf("Marshal = %s", data)
+	}
+
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{`49.99`, 4999},
+		{`"49.99"`, 4999},
+		{`4.999e1`, 4999},
+		{`49.999`, 5000},
+		{`-0.005`, -1},
+		{`0.30000000000000004`, 30},
+		{`null`, 0},
+	}
+	for _, tt := range tests {
+		var m Money
+		if err := json.Unmarshal([]byte(tt.in), &m); err != nil {
+			t.Errorf("Unmarshal(%s): %v", tt.in, err)
+			continue
+		}
+		if m.Minor() != tt.want || m.Currency() != Base {
+			t.Errorf("Unmarshal(%s) = %s, want %d", tt.in, m.Format(), tt.want)
+		}
+	}
+
+	var m Money
+	if err := json.Unmarshal([]byte(`"abc"`), &m); err == nil {
+		t.Error(`Unmarshal("abc") succeeded`)
+	}
+}
+
+// Clients written against the float64 API must read and write the same
+// documents as before.
+func TestJSONFloatCompat(t *testing.T) {
+	type floatPrice struct {
+		Price float64 `json:"price"`
+	}
+	type moneyPrice struct {
+		Price Money `json:"price"`
+	}
+
+	for _, f := range []float64{0, 49.99, 0.1 + 0.2, 1499.9, 100, -12.5} {
+		data, err := json.Marshal(floatPrice{f})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m moneyPrice
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Errorf("float document %s: %v", data, err)
+			continue
+		}
+		if want := FromFloat(f, Base); !m.Price.Equal(want) {
+			t.Errorf("float document %s read as %s, want %s", data, m.Price, want)
+		}
+
+		data, err = json.Marshal(moneyPrice{m.Price})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var back floatPrice
+		if err := json.Unmarshal(data, &back); err != nil {
+			t.Errorf("money document %s: %v", data, err)
+			continue
+		}
+		if back.Price != m.Price.Float64() {
+			t.Errorf("money document %s read as float %v, want %v", data, back.Price, m.Price.Float64())
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	tests := []struct {
+		src  interface{}
+		want int64
+	}{
+		{[]byte("1499.90"), 149990},
+		{"0.10", 10},
+		{int64(5), 500},
+		{0.1 + 0.2, 30},
+		{nil, 0},
+	}
+	for _, tt := range tests {
+		var m Money
+		if err := m.Scan(tt.src); err != nil {
+			t.Errorf("Scan(%#v): %v", tt.src, err)
+			continue
+		}
+		if m.Minor() != tt.want || m.Currency() != Base {
+			t.Errorf("Scan(%#v) = %s, want %d", tt.src, m.Format(), tt.want)
+		}
+	}
+
+	var m Money
+	if err := m.Scan(true); err == nil {
+		t.Error("Scan(true) succeeded")
+	}
+}
+
+func TestValueRoundTrip(t *testing.T) {
+	for _, want := range []Money{New(149990, RUB), New(-1, RUB), New(0, RUB)} {
+		v, err := want.Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Money
+		if err := got.Scan(v); err != nil {
+			t.Fatalf("Scan(%v): %v", v, err)
+		}
+		if !got.Equal(want) {
+			t.Errorf("round trip of %s gave %s", want, got)
+		}
+	}
+
+	var n NullMoney
+	if err := n.Scan(nil); err != nil || n.Valid {
+		t.Errorf("NullMoney.Scan(nil) = %+v, %v", n, err)
+	}
+	if v, _ := n.Value(); v != nil {
+		t.Errorf("invalid NullMoney stored as %v", v)
+	}
+	if err := n.Scan("12.34"); err != nil || !n.Valid || n.Money.Minor() != 1234 {
+		t.Errorf("NullMoney.Scan(12.34) = %+v, %v", n, err)
+	}
+}
+
+func TestMismatchedCurrenciesPanic(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("adding RUB and USD didn't panic")
+		}
+	}()
+	New(1, RUB).Add(New(1, USD))
+}
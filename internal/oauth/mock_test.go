@@ -0,0 +1,165 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"license_keys_shop/internal/oauth/mockidp"
+)
+
+const callbackURL = "http://shop.test/auth/oauth/mock/callback"
+
+// startMock serves a mock provider and returns it with a client for it.
+func startMock(t *testing.T) (*mockidp.Server, Provider) {
+	t.Helper()
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	idp := mockidp.New(srv.URL, "mock", "mock-secret")
+	mux.Handle("/", idp)
+	return idp, NewMock(srv.URL, "mock", "mock-secret")
+}
+
+// follow requests u and returns the query of the redirect back to the shop.
+func follow(t *testing.T, method, u string, form url.Values) url.Values {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	req, err := http.NewRequest(method, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("%s %s: status %d, want a redirect", method, u, resp.StatusCode)
+	}
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(loc.String(), callbackURL+"?") {
+		t.Fatalf("redirected to %s, want the callback", loc)
+	}
+	return loc.Query()
+}
+
+func TestMockRoundTrip(t *testing.T) {
+	idp, provider := startMock(t)
+	idp.Auto = &mockidp.User{Subject: "mock-user-1", Email: "player@example.com", EmailVerified: true, Name: "Mock Player"}
+
+	a, err := NewAttempt(callbackURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback := follow(t, http.MethodGet, provider.AuthURL(a), nil)
+
+	id, err := provider.Complete(context.Background(), a, callback)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	want := Identity{Provider: "mock", Subject: "mock-user-1", Email: "player@example.com", EmailVerified: true, Name: "Mock Player"}
+	if id != want {
+		t.Errorf("identity = %+v, want %+v", id, want)
+	}
+
+	// The code was spent by the first exchange
+	if _, err := provider.Complete(context.Background(), a, callback); err == nil {
+		t.Error("second exchange of the same code succeeded")
+	}
+}
+
+func TestMockFormSignIn(t *testing.T) {
+	_, provider := startMock(t)
+	a, err := NewAttempt(callbackURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := url.Parse(provider.AuthURL(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := auth.Query()
+	form.Set("decision", "approve")
+	form.Set("sub", "mock-user-2")
+	form.Set("email", "unverified@example.com")
+	form.Set("name", "Second Player")
+	auth.RawQuery = ""
+	callback := follow(t, http.MethodPost, auth.String(), form)
+
+	id, err := provider.Complete(context.Background(), a, callback)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if id.Subject != "mock-user-2" || id.EmailVerified {
+		t.Errorf("identity = %+v, want mock-user-2 with an unverified email", id)
+	}
+}
+
+func TestMockRejectsForeignAttempt(t *testing.T) {
+	idp, provider := startMock(t)
+	idp.Auto = &mockidp.User{Subject: "mock-user-1"}
+
+	a, err := NewAttempt(callbackURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback := follow(t, http.MethodGet, provider.AuthURL(a), nil)
+
+	// Same state, but another attempt's PKCE verifier and nonce
+	other, err := NewAttempt(callbackURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.State = a.State
+	if _, err := provider.Complete(context.Background(), other, callback); err == nil {
+		t.Error("code exchanged with another attempt's verifier")
+	}
+}
+
+func TestMockDenied(t *testing.T) {
+	_, provider := startMock(t)
+	a, err := NewAttempt(callbackURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := url.Parse(provider.AuthURL(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := auth.Query()
+	form.Set("decision", "deny")
+	auth.RawQuery = ""
+	callback := follow(t, http.MethodPost, auth.String(), form)
+
+	if _, err := provider.Complete(context.Background(), a, callback); !errors.Is(err, ErrDenied) {
+		t.Errorf("Complete = %v, want ErrDenied", err)
+	}
+}
+
+func TestFromEnvMockNeedsFlag(t *testing.T) {
+	t.Setenv("OAUTH_MOCK_URL", "http://localhost:8080/mock-idp")
+	t.Setenv("OAUTH_MOCK_ENABLED", "")
+	if _, ok := FromEnv("http://shop.test")["mock"]; ok {
+		t.Error("mock provider enabled by OAUTH_MOCK_URL alone")
+	}
+
+	t.Setenv("OAUTH_MOCK_ENABLED", "true")
+	if _, ok := FromEnv("http://shop.test")["mock"]; !ok {
+		t.Error("mock provider missing with OAUTH_MOCK_ENABLED=true")
+	}
+}
@@ -0,0 +1,265 @@
+// Package mockidp is a minimal OpenID Connect provider for development and
+// tests, so sign-in can be tried without real Google or Yandex accounts.
+// It lets anyone sign in as anyone; never mount it in production.
+package mockidp
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const codeTTL = time.Minute
+
+// User is who a sign-in at the mock provider is for.
+type User struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+type grant struct {
+	user        User
+	redirectURI string
+	challenge   string
+	nonce       string
+	expires     time.Time
+}
+
+// Server serves /authorize, /token and /userinfo under Issuer, the URL it
+// is mounted at.
+type Server struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Auto approves every sign-in as this user without showing the form.
+	Auto *User
+
+	mu     sync.Mutex
+	codes  map[string]grant
+	tokens map[string]User
+}
+
+func New(issuer, clientID, clientSecret string) *Server {
+	return &Server{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		codes:        make(map[string]grant),
+		tokens:       make(map[string]User),
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/authorize"):
+		s.authorize(w, r)
+	case strings.HasSuffix(r.URL.Path, "/token"):
+		s.token(w, r)
+	case strings.HasSuffix(r.URL.Path, "/userinfo"):
+		s.userinfo(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+var form = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Mock identity provider</title></head>
+<body>
+<h1>Mock identity provider</h1>
+<form method="post">
+{{range $k, $v := .Params}}<input type="hidden" name="{{$k}}" value="{{index $v 0}}">
+{{end}}
+<p><label>Subject <input name="sub" value="mock-user-1" required></label></p>
+<p><label>Email <input name="email" value="player@example.com"></label></p>
+<p><label><input type="checkbox" name="email_verified" value="true" checked> Email verified</label></p>
+<p><label>Name <input name="name" value="Mock Player"></label></p>
+<button name="decision" value="approve">Sign in</button>
+<button name="decision" value="deny">Cancel</button>
+</form>
+</body></html>`))
+
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	q := r.Form
+	if q.Get("client_id") != s.ClientID || q.Get("response_type") != "code" || q.Get("redirect_uri") == "" {
+		http.Error(w, "Invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	if q.Get("code_challenge") != "" && q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "Only S256 code challenges are supported", http.StatusBadRequest)
+		return
+	}
+
+	var user User
+	switch {
+	case s.Auto != nil:
+		user = *s.Auto
+	case r.Method == http.MethodPost && q.Get("decision") == "deny":
+		s.redirect(w, r, q, url.Values{"error": {"access_denied"}})
+		return
+	case r.Method == http.MethodPost:
+		verified, _ := strconv.ParseBool(q.Get("email_verified"))
+		user = User{
+			Subject:       q.Get("sub"),
+			Email:         q.Get("email"),
+			EmailVerified: verified,
+			Name:          q.Get("name"),
+		}
+	default:
+		params := url.Values{}
+		for _, k := range []string{"client_id", "response_type", "redirect_uri", "state", "nonce", "scope", "code_challenge", "code_challenge_method"} {
+			if v := q.Get(k); v != "" {
+				params.Set(k, v)
+			}
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		form.Execute(w, map[string]interface{}{"Params": params})
+		return
+	}
+	if user.Subject == "" {
+		http.Error(w, "Subject is required", http.StatusBadRequest)
+		return
+	}
+
+	code := random()
+	s.mu.Lock()
+	s.codes[code] = grant{
+		user:        user,
+		redirectURI: q.Get("redirect_uri"),
+		challenge:   q.Get("code_challenge"),
+		nonce:       q.Get("nonce"),
+		expires:     time.Now().Add(codeTTL),
+	}
+	s.mu.Unlock()
+	s.redirect(w, r, q, url.Values{"code": {code}})
+}
+
+func (s *Server) redirect(w http.ResponseWriter, r *http.Request, q url.Values, params url.Values) {
+	if state := q.Get("state"); state != "" {
+		params.Set("state", state)
+	}
+	target := q.Get("redirect_uri")
+	sep := "?"
+	if strings.Contains(target, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, target+sep+params.Encode(), http.StatusFound)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request")
+		return
+	}
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != s.ClientID || secret != s.ClientSecret {
+		tokenError(w, "invalid_client")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type")
+		return
+	}
+
+	// Codes are spent on first use, good or bad
+	code := r.PostForm.Get("code")
+	s.mu.Lock()
+	g, found := s.codes[code]
+	delete(s.codes, code)
+	s.mu.Unlock()
+	if !found || time.Now().After(g.expires) || r.PostForm.Get("redirect_uri") != g.redirectURI {
+		tokenError(w, "invalid_grant")
+		return
+	}
+	if g.challenge != "" {
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+			tokenError(w, "invalid_grant")
+			return
+		}
+	}
+
+	now := time.Now()
+	idToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss":            s.Issuer,
+		"sub":            g.user.Subject,
+		"aud":            s.ClientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          g.nonce,
+		"email":          g.user.Email,
+		"email_verified": g.user.EmailVerified,
+		"name":           g.user.Name,
+	}).SignedString([]byte(s.ClientSecret))
+	if err != nil {
+		http.Error(w, "Failed to sign ID token", http.StatusInternalServerError)
+		return
+	}
+
+	access := random()
+	s.mu.Lock()
+	s.tokens[access] = g.user
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": access,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func (s *Server) userinfo(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	user, ok := s.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	s.mu.Unlock()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sub":            user.Subject,
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
+		"name":           user.Name,
+	})
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func random() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,130 @@
+// Package oauth signs users in with external identity providers: OpenID
+// Connect (Google), OAuth 2.0 with a profile API (Yandex, VK) and OpenID
+// 2.0 (Steam). A provider only establishes who the user is there; linking
+// that identity to a shop account is up to the caller.
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrDenied       = errors.New("sign-in was cancelled at the provider")
+	ErrInvalidReply = errors.New("provider sent an invalid response")
+)
+
+// Identity is a user as a provider knows them. Subject is stable per
+// provider; Email may be empty, and only a verified one says the user
+// owns the address.
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// Attempt is one sign-in in progress: the values the provider must echo
+// or prove, and where it sends the user back.
+type Attempt struct {
+	State       string
+	Nonce       string
+	Verifier    string
+	RedirectURI string
+}
+
+// NewAttempt starts a sign-in that returns to redirectURI.
+func NewAttempt(redirectURI string) (Attempt, error) {
+	a := Attempt{RedirectURI: redirectURI}
+	for _, v := range []*string{&a.State, &a.Nonce, &a.Verifier} {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return Attempt{}, err
+		}
+		*v = base64.RawURLEncoding.EncodeToString(b)
+	}
+	return a, nil
+}
+
+// challenge is the PKCE S256 code challenge of the attempt's verifier.
+func (a Attempt) challenge() string {
+	sum := sha256.Sum256([]byte(a.Verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Provider is one identity provider.
+type Provider interface {
+	Name() string
+	// AuthURL is where to send the user to sign in.
+	AuthURL(a Attempt) string
+	// Complete checks the provider's callback for a and returns who
+	// signed in.
+	Complete(ctx context.Context, a Attempt, callback url.Values) (Identity, error)
+}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// FromEnv returns the providers configured in the environment by name:
+// google, yandex and vk with OAUTH_<NAME>_CLIENT_ID and
+// OAUTH_<NAME>_CLIENT_SECRET, steam with OAUTH_STEAM_ENABLED (and
+// optionally OAUTH_STEAM_API_KEY for display names), and the mock
+// provider with OAUTH_MOCK_URL. realm is the site's base URL.
+//
+// The mock provider lets anyone sign in as anyone, so OAUTH_MOCK_URL is
+// ignored unless OAUTH_MOCK_ENABLED is true as well; set both only in
+// development.
+func FromEnv(realm string) map[string]Provider {
+	providers := make(map[string]Provider)
+	add := func(p Provider) { providers[p.Name()] = p }
+
+	if id, secret := credentials("GOOGLE"); id != "" {
+		add(NewGoogle(id, secret))
+	}
+	if id, secret := credentials("YANDEX"); id != "" {
+		add(NewYandex(id, secret))
+	}
+	if id, secret := credentials("VK"); id != "" {
+		add(NewVK(id, secret))
+	}
+	if on, _ := strconv.ParseBool(os.Getenv("OAUTH_STEAM_ENABLED")); on {
+		add(NewSteam(realm, os.Getenv("OAUTH_STEAM_API_KEY")))
+	}
+	mockEnabled, _ := strconv.ParseBool(os.Getenv("OAUTH_MOCK_ENABLED"))
+	switch base := os.Getenv("OAUTH_MOCK_URL"); {
+	case base == "":
+	case !mockEnabled:
+		log.Print("oauth: OAUTH_MOCK_URL is set without OAUTH_MOCK_ENABLED, mock sign-in disabled")
+	default:
+		id, secret := credentials("MOCK")
+		if id == "" {
+			id, secret = "mock", "mock-secret"
+		}
+		add(NewMock(base, id, secret))
+	}
+	return providers
+}
+
+func credentials(name string) (id, secret string) {
+	return os.Getenv("OAUTH_" + name + "_CLIENT_ID"), os.Getenv("OAUTH_" + name + "_CLIENT_SECRET")
+}
+
+// Names lists provider names in order.
+func Names(providers map[string]Provider) []string {
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
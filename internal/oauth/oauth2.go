@@ -0,0 +1,155 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// codeFlow is the OAuth 2.0 authorization code flow with PKCE. profile
+// turns the token response into an identity.
+type codeFlow struct {
+	name         string
+	authURL      string
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scopes       []string
+	extra        url.Values
+	// oidc flows send a nonce for the ID token to carry back
+	oidc    bool
+	profile func(ctx context.Context, a Attempt, t tokenResponse) (Identity, error)
+}
+
+// tokenResponse is a token endpoint reply. VK puts the user's ID and
+// email in it.
+type tokenResponse struct {
+	AccessToken      string      `json:"access_token"`
+	TokenType        string      `json:"token_type"`
+	IDToken          string      `json:"id_token"`
+	Error            string      `json:"error"`
+	ErrorDescription string      `json:"error_description"`
+	UserID           json.Number `json:"user_id"`
+	Email            string      `json:"email"`
+}
+
+func (f *codeFlow) Name() string {
+	return f.name
+}
+
+func (f *codeFlow) AuthURL(a Attempt) string {
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {f.clientID},
+		"redirect_uri":          {a.RedirectURI},
+		"state":                 {a.State},
+		"code_challenge":        {a.challenge()},
+		"code_challenge_method": {"S256"},
+	}
+	if f.oidc {
+		q.Set("nonce", a.Nonce)
+	}
+	if len(f.scopes) > 0 {
+		q.Set("scope", strings.Join(f.scopes, " "))
+	}
+	for k, v := range f.extra {
+		q[k] = v
+	}
+	return f.authURL + "?" + q.Encode()
+}
+
+func (f *codeFlow) Complete(ctx context.Context, a Attempt, callback url.Values) (Identity, error) {
+	if e := callback.Get("error"); e != "" {
+		if e == "access_denied" {
+			return Identity{}, ErrDenied
+		}
+		return Identity{}, fmt.Errorf("%s: %s", f.name, e)
+	}
+	if callback.Get("state") != a.State {
+		return Identity{}, ErrInvalidReply
+	}
+	code := callback.Get("code")
+	if code == "" {
+		return Identity{}, ErrInvalidReply
+	}
+
+	t, err := f.exchange(ctx, a, code)
+	if err != nil {
+		return Identity{}, err
+	}
+	id, err := f.profile(ctx, a, t)
+	if err != nil {
+		return Identity{}, err
+	}
+	if id.Subject == "" {
+		return Identity{}, ErrInvalidReply
+	}
+	id.Provider = f.name
+	return id, nil
+}
+
+func (f *codeFlow) exchange(ctx context.Context, a Attempt, code string) (tokenResponse, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {a.RedirectURI},
+		"client_id":     {f.clientID},
+		"client_secret": {f.clientSecret},
+		"code_verifier": {a.Verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var t tokenResponse
+	if err := doJSON(req, &t); err != nil {
+		return tokenResponse{}, fmt.Errorf("%s token: %w", f.name, err)
+	}
+	if t.Error != "" {
+		return tokenResponse{}, fmt.Errorf("%s token: %s %s", f.name, t.Error, t.ErrorDescription)
+	}
+	if t.AccessToken == "" {
+		return tokenResponse{}, fmt.Errorf("%s token: %w", f.name, ErrInvalidReply)
+	}
+	return t, nil
+}
+
+// getJSON fetches a profile API with the access token in an Authorization
+// header of the given scheme ("Bearer", or "OAuth" for Yandex).
+func getJSON(ctx context.Context, endpoint, scheme, token string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", scheme+" "+token)
+	req.Header.Set("Accept", "application/json")
+	return doJSON(req, v)
+}
+
+func doJSON(req *http.Request, v interface{}) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	// Token endpoints answer errors with 400 and a JSON body
+	if resp.StatusCode >= 500 || (resp.StatusCode >= 300 && !json.Valid(body)) {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidReply, err)
+	}
+	return nil
+}
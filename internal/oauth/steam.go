@@ -0,0 +1,144 @@
+package oauth
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	steamLogin      = "https://steamcommunity.com/openid/login"
+	openIDNamespace = "http://specs.openid.net/auth/2.0"
+	openIDSelect    = "http://specs.openid.net/auth/2.0/identifier_select"
+)
+
+var steamClaimedID = regexp.MustCompile(`^https://steamcommunity\.com/openid/id/([0-9]{17})$`)
+
+// steam signs in with Steam, which speaks OpenID 2.0 rather than OAuth:
+// the callback is checked by asking Steam whether it sent it. Steam shares
+// no email, only the SteamID.
+type steam struct {
+	realm  string
+	apiKey string
+}
+
+// NewSteam signs in with Steam for the site at realm. With a Web API key
+// the Steam display name is fetched too.
+func NewSteam(realm, apiKey string) Provider {
+	return &steam{realm: realm, apiKey: apiKey}
+}
+
+func (s *steam) Name() string {
+	return "steam"
+}
+
+// returnTo carries the state, which OpenID 2.0 has no parameter for.
+func (s *steam) returnTo(a Attempt) string {
+	return a.RedirectURI + "?state=" + url.QueryEscape(a.State)
+}
+
+func (s *steam) AuthURL(a Attempt) string {
+	q := url.Values{
+		"openid.ns":         {openIDNamespace},
+		"openid.mode":       {"checkid_setup"},
+		"openid.return_to":  {s.returnTo(a)},
+		"openid.realm":      {s.realm},
+		"openid.identity":   {openIDSelect},
+		"openid.claimed_id": {openIDSelect},
+	}
+	return steamLogin + "?" + q.Encode()
+}
+
+func (s *steam) Complete(ctx context.Context, a Attempt, callback url.Values) (Identity, error) {
+	switch callback.Get("openid.mode") {
+	case "cancel":
+		return Identity{}, ErrDenied
+	case "id_res":
+	default:
+		return Identity{}, ErrInvalidReply
+	}
+	if callback.Get("openid.return_to") != s.returnTo(a) || callback.Get("openid.op_endpoint") != steamLogin {
+		return Identity{}, ErrInvalidReply
+	}
+	m := steamClaimedID.FindStringSubmatch(callback.Get("openid.claimed_id"))
+	if m == nil {
+		return Identity{}, ErrInvalidReply
+	}
+
+	valid, err := s.verify(ctx, callback)
+	if err != nil {
+		return Identity{}, fmt.Errorf("steam: %w", err)
+	}
+	if !valid {
+		return Identity{}, ErrInvalidReply
+	}
+
+	id := Identity{Provider: s.Name(), Subject: m[1]}
+	if s.apiKey != "" {
+		id.Name = s.personaName(ctx, m[1])
+	}
+	return id, nil
+}
+
+// verify asks Steam whether it signed the callback.
+func (s *steam) verify(ctx context.Context, callback url.Values) (bool, error) {
+	form := url.Values{}
+	for k, v := range callback {
+		if strings.HasPrefix(k, "openid.") {
+			form[k] = v
+		}
+	}
+	form.Set("openid.mode", "check_authentication")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, steamLogin, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("check_authentication: HTTP %d", resp.StatusCode)
+	}
+
+	// Key-value form: one "key:value" per line
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "is_valid:true" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// personaName is the Steam display name, or empty when it can't be had.
+func (s *steam) personaName(ctx context.Context, steamID string) string {
+	endpoint := "https://api.steampowered.com/ISteamUser/GetPlayerSummaries/v2/?" + url.Values{
+		"key":      {s.apiKey},
+		"steamids": {steamID},
+	}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return ""
+	}
+
+	var summaries struct {
+		Response struct {
+			Players []struct {
+				PersonaName string `json:"personaname"`
+			} `json:"players"`
+		} `json:"response"`
+	}
+	if err := doJSON(req, &summaries); err != nil || len(summaries.Response.Players) == 0 {
+		return ""
+	}
+	return summaries.Response.Players[0].PersonaName
+}
@@ -0,0 +1,44 @@
+package oauth
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const vkAPIVersion = "5.199"
+
+// NewVK signs in with VK. VK returns the user's ID and email with the
+// token; it doesn't say whether the email was confirmed, so it isn't
+// trusted for linking accounts.
+func NewVK(clientID, clientSecret string) Provider {
+	return &codeFlow{
+		name:         "vk",
+		authURL:      "https://oauth.vk.com/authorize",
+		tokenURL:     "https://oauth.vk.com/access_token",
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		scopes:       []string{"email"},
+		extra:        url.Values{"v": {vkAPIVersion}, "display": {"page"}},
+		profile: func(ctx context.Context, a Attempt, t tokenResponse) (Identity, error) {
+			id := Identity{Subject: t.UserID.String(), Email: t.Email}
+
+			var users struct {
+				Response []struct {
+					FirstName string `json:"first_name"`
+					LastName  string `json:"last_name"`
+				} `json:"response"`
+			}
+			endpoint := "https://api.vk.com/method/users.get?v=" + vkAPIVersion
+			if err := getJSON(ctx, endpoint, "Bearer", t.AccessToken, &users); err != nil {
+				return Identity{}, fmt.Errorf("vk profile: %w", err)
+			}
+			if len(users.Response) > 0 {
+				u := users.Response[0]
+				id.Name = strings.TrimSpace(u.FirstName + " " + u.LastName)
+			}
+			return id, nil
+		},
+	}
+}
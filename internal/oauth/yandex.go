@@ -0,0 +1,40 @@
+package oauth
+
+import (
+	"context"
+	"fmt"
+)
+
+// NewYandex signs in with Yandex ID. Yandex only hands out addresses it
+// has confirmed, so the email counts as verified.
+func NewYandex(clientID, clientSecret string) Provider {
+	return &codeFlow{
+		name:         "yandex",
+		authURL:      "https://oauth.yandex.ru/authorize",
+		tokenURL:     "https://oauth.yandex.ru/token",
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		scopes:       []string{"login:email", "login:info"},
+		profile: func(ctx context.Context, a Attempt, t tokenResponse) (Identity, error) {
+			var info struct {
+				ID           string `json:"id"`
+				Login        string `json:"login"`
+				DefaultEmail string `json:"default_email"`
+				RealName     string `json:"real_name"`
+			}
+			if err := getJSON(ctx, "https://login.yandex.ru/info?format=json", "OAuth", t.AccessToken, &info); err != nil {
+				return Identity{}, fmt.Errorf("yandex profile: %w", err)
+			}
+			name := info.RealName
+			if name == "" {
+				name = info.Login
+			}
+			return Identity{
+				Subject:       info.ID,
+				Email:         info.DefaultEmail,
+				EmailVerified: info.DefaultEmail != "",
+				Name:          name,
+			}, nil
+		},
+	}
+}
@@ -0,0 +1,77 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The breached-password list is a local file named by
+// BREACHED_PASSWORDS_FILE, one entry per line: either the password itself
+// or its SHA-1 in hex, optionally followed by ":count" as in the Have I
+// Been Pwned downloads. Lines starting with # are comments.
+var (
+	breachedOnce sync.Once
+	breached     map[[sha1.Size]byte]struct{}
+)
+
+// Breached reports whether password is on the breached-password list.
+func Breached(password string) bool {
+	breachedOnce.Do(loadBreached)
+	_, ok := breached[sha1.Sum([]byte(password))]
+	return ok
+}
+
+func loadBreached() {
+	path := os.Getenv("BREACHED_PASSWORDS_FILE")
+	if path == "" {
+		return
+	}
+	list, err := readBreached(path)
+	if err != nil {
+		log.Printf("password: breached list not loaded: %v", err)
+		return
+	}
+	breached = list
+	log.Printf("password: loaded %d breached passwords from %s", len(list), path)
+}
+
+func readBreached(path string) (map[[sha1.Size]byte]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	list := make(map[[sha1.Size]byte]struct{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		list[breachedKey(line)] = struct{}{}
+	}
+	return list, scanner.Err()
+}
+
+// breachedKey reads a line as a SHA-1 when it looks like one and hashes it
+// as a password otherwise.
+func breachedKey(line string) [sha1.Size]byte {
+	hash := line
+	if i := strings.IndexByte(line, ':'); i == 2*sha1.Size {
+		hash = line[:i]
+	}
+	var key [sha1.Size]byte
+	if len(hash) == 2*sha1.Size {
+		if b, err := hex.DecodeString(hash); err == nil {
+			copy(key[:], b)
+			return key
+		}
+	}
+	return sha1.Sum([]byte(line))
+}
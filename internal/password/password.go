@@ -0,0 +1,86 @@
+package password
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	MinLength = 8
+	// MaxBytes is where bcrypt stops reading.
+	MaxBytes = 72
+)
+
+var (
+	ErrTooShort     = errors.New("password must be at least 8 characters")
+	ErrTooLong      = errors.New("password must be at most 72 bytes")
+	ErrTooSimple    = errors.New("password must contain both letters and digits")
+	ErrTooCommon    = errors.New("password is too common")
+	ErrContainsName = errors.New("password must not contain the username or email")
+	ErrBreached     = errors.New("password has appeared in a data breach, choose another")
+)
+
+// common are passwords that pass the other rules but are tried first by
+// anyone guessing.
+var common = map[string]bool{
+	"password1": true, "password123": true, "qwerty123": true, "qwerty12345": true,
+	"1q2w3e4r": true, "1q2w3e4r5t": true, "abc12345": true, "abcd1234": true,
+	"admin123": true, "letmein1": true, "welcome1": true, "iloveyou1": true,
+	"zaq12wsx": true, "passw0rd": true, "p@ssw0rd": true, "123qweasd": true,
+}
+
+// Validate checks password against the policy. personal holds the user's
+// own details (username, email), which the password must not contain.
+func Validate(password string, personal ...string) error {
+	if utf8.RuneCountInString(password) < MinLength {
+		return ErrTooShort
+	}
+	if len(password) > MaxBytes {
+		return ErrTooLong
+	}
+
+	var letter, digit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			letter = true
+		case unicode.IsDigit(r):
+			digit = true
+		}
+	}
+	if !letter || !digit {
+		return ErrTooSimple
+	}
+
+	lower := strings.ToLower(password)
+	if common[lower] {
+		return ErrTooCommon
+	}
+	if Breached(password) {
+		return ErrBreached
+	}
+	for _, p := range personal {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if i := strings.IndexByte(p, '@'); i > 0 {
+			// For emails the local part is what people reuse
+			p = p[:i]
+		}
+		if len(p) >= 3 && strings.Contains(lower, p) {
+			return ErrContainsName
+		}
+	}
+	return nil
+}
+
+// Hash hashes a password for storage.
+func Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
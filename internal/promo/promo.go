@@ -0,0 +1,200 @@
+package promo
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"license_keys_shop/internal/money"
+)
+
+type DiscountType string
+
+const (
+	Percent DiscountType = "percent"
+	Fixed   DiscountType = "fixed"
+)
+
+var (
+	ErrNotFound      = errors.New("promo code not found")
+	ErrInactive      = errors.New("promo code is not active")
+	ErrNotStarted    = errors.New("promo code is not valid yet")
+	ErrExpired       = errors.New("promo code has expired")
+	ErrUsageLimit    = errors.New("promo code usage limit reached")
+	ErrUserLimit     = errors.New("promo code already used the maximum number of times")
+	ErrMinTotal      = errors.New("cart total is below the promo code minimum")
+	ErrNotApplicable = errors.New("promo code does not apply to any item in the cart")
+	ErrNotStackable  = errors.New("promo code cannot be combined with other codes")
+	ErrDuplicate     = errors.New("promo code already applied")
+)
+
+// Code is a promo code definition. Value is a percentage for Percent codes
+// and an amount in money.Base for Fixed ones. Empty ProductID/CategoryID
+// mean the code applies to the whole cart; nil limits and dates mean
+// "unlimited".
+type Code struct {
+	ID             int          `json:"id"`
+	Code           string       `json:"code"`
+	Type           DiscountType `json:"discount_type"`
+	Value          money.Money  `json:"value"`
+	MinTotal       money.Money  `json:"min_total"`
+	ProductID      string       `json:"product_id,omitempty"`
+	CategoryID     string       `json:"category_id,omitempty"`
+	MaxUses        *int         `json:"max_uses,omitempty"`
+	MaxUsesPerUser *int         `json:"max_uses_per_user,omitempty"`
+	UsedCount      int          `json:"used_count"`
+	Stackable      bool         `json:"stackable"`
+	StartsAt       *time.Time   `json:"starts_at,omitempty"`
+	EndsAt         *time.Time   `json:"ends_at,omitempty"`
+	IsActive       bool         `json:"is_active"`
+}
+
+type Line struct {
+	ProductID  string
+	CategoryID string
+	UnitPrice  money.Money
+	Quantity   int
+}
+
+func (l Line) amount() money.Money {
+	return l.UnitPrice.Mul(int64(l.Quantity))
+}
+
+type Discount struct {
+	Code   string      `json:"code"`
+	Amount money.Money `json:"amount"`
+}
+
+type Breakdown struct {
+	Subtotal  money.Money `json:"subtotal"`
+	Discounts []Discount  `json:"discounts"`
+	Discount  money.Money `json:"discount"`
+	Total     money.Money `json:"total"`
+}
+
+// Normalize makes user-entered codes case and whitespace insensitive.
+func Normalize(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func (c Code) appliesTo(l Line) bool {
+	if c.ProductID != "" && c.ProductID != l.ProductID {
+		return false
+	}
+	if c.CategoryID != "" && c.CategoryID != l.CategoryID {
+		return false
+	}
+	return true
+}
+
+// Validate checks everything about a code that does not depend on other
+// codes: activity, validity window, usage limits, minimum total and scope.
+func Validate(c Code, lines []Line, userUses int, now time.Time) error {
+	if !c.IsActive {
+		return ErrInactive
+	}
+	if c.StartsAt != nil && now.Before(*c.StartsAt) {
+		return ErrNotStarted
+	}
+	if c.EndsAt != nil && !now.Before(*c.EndsAt) {
+		return ErrExpired
+	}
+	if c.MaxUses != nil && c.UsedCount >= *c.MaxUses {
+		return ErrUsageLimit
+	}
+	if c.MaxUsesPerUser != nil && userUses >= *c.MaxUsesPerUser {
+		return ErrUserLimit
+	}
+	if subtotal(lines).LessThan(c.MinTotal) {
+		return ErrMinTotal
+	}
+
+	for _, l := range lines {
+		if c.appliesTo(l) {
+			return nil
+		}
+	}
+	return ErrNotApplicable
+}
+
+// CheckStacking enforces that several codes are only combined when every
+// one of them allows stacking.
+func CheckStacking(codes []Code) error {
+	seen := make(map[string]bool)
+	for _, c := range codes {
+		key := Normalize(c.Code)
+		if seen[key] {
+			return ErrDuplicate
+		}
+		seen[key] = true
+	}
+	if len(codes) < 2 {
+		return nil
+	}
+	for _, c := range codes {
+		if !c.Stackable {
+			return ErrNotStackable
+		}
+	}
+	return nil
+}
+
+// Apply computes the price breakdown for lines with the given codes. The
+// codes are applied in order, each one to what is left of the lines it
+// covers, so stacked discounts can never push the total below zero.
+// Discounts has exactly one entry per code, in the same order.
+func Apply(lines []Line, codes []Code) (Breakdown, error) {
+	b := Breakdown{Subtotal: subtotal(lines), Discounts: []Discount{}}
+	b.Discount = money.Zero(b.Subtotal.Currency())
+	b.Total = b.Subtotal
+	if err := CheckStacking(codes); err != nil {
+		return b, err
+	}
+
+	remaining := make([]money.Money, len(lines))
+	for i, l := range lines {
+		remaining[i] = l.amount()
+	}
+
+	for _, c := range codes {
+		eligible := money.Zero(b.Subtotal.Currency())
+		weights := make([]int64, len(lines))
+		for i, l := range lines {
+			if c.appliesTo(l) {
+				eligible = eligible.Add(remaining[i])
+				weights[i] = remaining[i].Minor()
+			}
+		}
+
+		// Every code gets an entry, even if earlier codes left nothing to discount
+		amount := money.Zero(eligible.Currency())
+		if eligible.IsPositive() {
+			switch c.Type {
+			case Percent:
+				amount = eligible.Percent(c.Value)
+			case Fixed:
+				amount = c.Value
+			}
+			amount = money.Min(amount, eligible)
+
+			// Spread the discount over the covered lines proportionally
+			for i, share := range amount.Allocate(weights) {
+				remaining[i] = remaining[i].Sub(share)
+			}
+		}
+
+		b.Discounts = append(b.Discounts, Discount{Code: c.Code, Amount: amount})
+		b.Discount = b.Discount.Add(amount)
+	}
+
+	b.Total = money.Max(b.Subtotal.Sub(b.Discount), money.Zero(b.Subtotal.Currency()))
+	return b, nil
+}
+
+func subtotal(lines []Line) money.Money {
+	var total money.Money
+	for _, l := range lines {
+		total = total.Add(l.amount())
+	}
+	return total
+}
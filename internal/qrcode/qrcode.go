@@ -0,0 +1,43 @@
+package qrcode
+
+import (
+	"fmt"
+	"strings"
+
+	qr "github.com/skip2/go-qrcode"
+)
+
+// PNG renders payload as a QR code image size pixels wide.
+func PNG(payload string, size int) ([]byte, error) {
+	return qr.Encode(payload, qr.Medium, size)
+}
+
+// SVG renders payload as a QR code in SVG, one unit per module, so it
+// scales to any size without blurring.
+func SVG(payload string) (string, error) {
+	q, err := qr.New(payload, qr.Medium)
+	if err != nil {
+		return "", err
+	}
+	bitmap := q.Bitmap()
+	n := len(bitmap)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, n, n)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, n, n)
+	for y, row := range bitmap {
+		for x := 0; x < len(row); x++ {
+			if !row[x] {
+				continue
+			}
+			// Draw each horizontal run of dark modules as one rectangle
+			start := x
+			for x < len(row) && row[x] {
+				x++
+			}
+			fmt.Fprintf(&b, "M%d %dh%dv1h-%dz", start, y, x-start, x-start)
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.String(), nil
+}
@@ -0,0 +1,62 @@
+package rates
+
+import (
+	"sync"
+	"time"
+
+	"license_keys_shop/internal/money"
+)
+
+type cacheKey struct {
+	from, to money.Currency
+}
+
+type cacheEntry struct {
+	rate    Rate
+	expires time.Time
+}
+
+// Cache keeps rates from another provider for ttl. If the provider fails
+// after a rate expired, the stale rate is served for up to maxStale longer.
+type Cache struct {
+	next     ExchangeRateProvider
+	ttl      time.Duration
+	maxStale time.Duration
+
+	mu      sync.Mutex
+	entries map[cacheKey]cacheEntry
+}
+
+func NewCache(next ExchangeRateProvider, ttl, maxStale time.Duration) *Cache {
+	return &Cache{
+		next:     next,
+		ttl:      ttl,
+		maxStale: maxStale,
+		entries:  make(map[cacheKey]cacheEntry),
+	}
+}
+
+func (c *Cache) Rate(from, to money.Currency) (Rate, error) {
+	key := cacheKey{from, to}
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.rate, nil
+	}
+
+	rate, err := c.next.Rate(from, to)
+	if err != nil {
+		if ok && now.Before(entry.expires.Add(c.maxStale)) {
+			return entry.rate, nil
+		}
+		return Rate{}, err
+	}
+
+	c.mu.Lock()
+	c.entries[key] = cacheEntry{rate: rate, expires: now.Add(c.ttl)}
+	c.mu.Unlock()
+	return rate, nil
+}
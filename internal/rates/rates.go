@@ -0,0 +1,134 @@
+package rates
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"license_keys_shop/internal/money"
+)
+
+var ErrUnknownCurrency = errors.New("no exchange rate for currency")
+
+// Rate says how many units of To one unit of From buys.
+type Rate struct {
+	From  money.Currency
+	To    money.Currency
+	Value *big.Rat
+	AsOf  time.Time
+}
+
+// String is the rate as a decimal with enough digits to store and audit.
+func (r Rate) String() string {
+	return r.Value.FloatString(12)
+}
+
+func (r Rate) Convert(m money.Money) money.Money {
+	return m.Convert(r.To, r.Value)
+}
+
+type ExchangeRateProvider interface {
+	Rate(from, to money.Currency) (Rate, error)
+}
+
+// Table is a set of rates quoted against one base currency: one unit of
+// Base buys Rates[c] units of c. Cross rates go through the base.
+type Table struct {
+	Base  money.Currency
+	Rates map[money.Currency]*big.Rat
+	AsOf  time.Time
+}
+
+func (t Table) quote(c money.Currency) (*big.Rat, error) {
+	if c == t.Base {
+		return big.NewRat(1, 1), nil
+	}
+	r, ok := t.Rates[c]
+	if !ok || r.Sign() <= 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCurrency, c)
+	}
+	return r, nil
+}
+
+func (t Table) Rate(from, to money.Currency) (Rate, error) {
+	fromQuote, err := t.quote(from)
+	if err != nil {
+		return Rate{}, err
+	}
+	toQuote, err := t.quote(to)
+	if err != nil {
+		return Rate{}, err
+	}
+	value := new(big.Rat).Quo(toQuote, fromQuote)
+	return Rate{From: from, To: to, Value: value, AsOf: t.AsOf}, nil
+}
+
+// StaticProvider serves a fixed table. It is the stand-in used until a real
+// rates feed is configured.
+type StaticProvider struct {
+	table Table
+}
+
+func NewStaticProvider(base money.Currency, quotes map[money.Currency]string) (*StaticProvider, error) {
+	t := Table{Base: base, Rates: make(map[money.Currency]*big.Rat), AsOf: time.Now()}
+	for c, q := range quotes {
+		r, ok := new(big.Rat).SetString(q)
+		if !ok {
+			return nil, fmt.Errorf("invalid rate %q for %s", q, c)
+		}
+		t.Rates[c] = r
+	}
+	return &StaticProvider{table: t}, nil
+}
+
+// DefaultProvider returns approximate RUB quotes for development.
+func DefaultProvider() *StaticProvider {
+	p, _ := NewStaticProvider(money.RUB, map[money.Currency]string{
+		money.USD: "0.0108",
+		money.EUR: "0.0100",
+		money.BTC: "0.000000105",
+	})
+	return p
+}
+
+func (p *StaticProvider) Rate(from, to money.Currency) (Rate, error) {
+	return p.table.Rate(from, to)
+}
+
+// FileProvider reads a JSON rates file on every call, so an external job can
+// refresh it without restarting the shop. Wrap it in a Cache. Format:
+//
+//	{"base": "RUB", "updated_at": "2025-01-01T00:00:00Z", "rates": {"USD": "0.0108"}}
+type FileProvider struct {
+	path string
+}
+
+func NewFileProvider(path string) *FileProvider {
+	return &FileProvider{path: path}
+}
+
+func (p *FileProvider) Rate(from, to money.Currency) (Rate, error) {
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return Rate{}, err
+	}
+
+	var file struct {
+		Base      money.Currency            `json:"base"`
+		UpdatedAt time.Time                 `json:"updated_at"`
+		Rates     map[money.Currency]string `json:"rates"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return Rate{}, fmt.Errorf("rates file %s: %w", p.path, err)
+	}
+
+	static, err := NewStaticProvider(file.Base, file.Rates)
+	if err != nil {
+		return Rate{}, fmt.Errorf("rates file %s: %w", p.path, err)
+	}
+	static.table.AsOf = file.UpdatedAt
+	return static.Rate(from, to)
+}
@@ -0,0 +1,143 @@
+// Package rbac maps staff roles to what they may do. Roles are stored per
+// user; the permissions of each role are fixed here, so granting a role is
+// a data change and changing what a role allows is a code review.
+package rbac
+
+import (
+	"database/sql"
+	"sort"
+)
+
+type Role string
+
+const (
+	RoleAdmin          Role = "admin"
+	RoleContentManager Role = "content_manager"
+	RoleSupport        Role = "support"
+	RoleFinance        Role = "finance"
+)
+
+type Permission string
+
+const (
+	PermProductsManage   Permission = "products.manage"
+	PermPromoManage      Permission = "promo.manage"
+	PermOrdersView       Permission = "orders.view"
+	PermKeysResend       Permission = "keys.resend"
+	PermRefundsIssue     Permission = "refunds.issue"
+	PermFinanceReconcile Permission = "finance.reconcile"
+	PermPaymentsSimulate Permission = "payments.simulate"
+	PermUsersManage      Permission = "users.manage"
+)
+
+// grants lists what each role may do besides admin, which may do anything.
+var grants = map[Role][]Permission{
+	RoleContentManager: {PermProductsManage, PermPromoManage},
+	RoleSupport:        {PermOrdersView, PermKeysResend},
+	RoleFinance:        {PermOrdersView, PermRefundsIssue, PermFinanceReconcile},
+}
+
+var allPermissions = []Permission{
+	PermProductsManage, PermPromoManage, PermOrdersView, PermKeysResend,
+	PermRefundsIssue, PermFinanceReconcile, PermPaymentsSimulate, PermUsersManage,
+}
+
+// Roles lists every role.
+func Roles() []Role {
+	return []Role{RoleAdmin, RoleContentManager, RoleSupport, RoleFinance}
+}
+
+// ParseRole accepts the name of a known role.
+func ParseRole(name string) (Role, bool) {
+	for _, r := range Roles() {
+		if string(r) == name {
+			return r, true
+		}
+	}
+	return "", false
+}
+
+// Permissions lists what r may do.
+func (r Role) Permissions() []Permission {
+	if r == RoleAdmin {
+		return append([]Permission(nil), allPermissions...)
+	}
+	return append([]Permission(nil), grants[r]...)
+}
+
+// Allows reports whether any of roles grants p.
+func Allows(roles []Role, p Permission) bool {
+	for _, r := range roles {
+		if r == RoleAdmin {
+			return true
+		}
+		for _, g := range grants[r] {
+			if g == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PermissionsOf lists what roles together may do, sorted.
+func PermissionsOf(roles []Role) []Permission {
+	seen := make(map[Permission]bool)
+	var perms []Permission
+	for _, r := range roles {
+		for _, p := range r.Permissions() {
+			if !seen[p] {
+				seen[p] = true
+				perms = append(perms, p)
+			}
+		}
+	}
+	sort.Slice(perms, func(i, j int) bool { return perms[i] < perms[j] })
+	return perms
+}
+
+// DB is what Store needs from the database handle.
+type DB interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Store reads the roles of users.
+type Store struct {
+	db DB
+}
+
+func NewStore(db DB) *Store {
+	return &Store{db: db}
+}
+
+// Roles returns the roles of a user, none for regular buyers.
+func (s *Store) Roles(userID int) ([]Role, error) {
+	rows, err := s.db.Query(`
+		SELECT role FROM user_roles WHERE user_id = $1 ORDER BY role`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []Role
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		// Roles dropped from the code grant nothing
+		if r, ok := ParseRole(name); ok {
+			roles = append(roles, r)
+		}
+	}
+	return roles, rows.Err()
+}
+
+// Can reports whether a user holds permission p.
+func (s *Store) Can(userID int, p Permission) (bool, error) {
+	roles, err := s.Roles(userID)
+	if err != nil {
+		return false, err
+	}
+	return Allows(roles, p), nil
+}
@@ -0,0 +1,174 @@
+package reconcile
+
+import (
+	"sort"
+
+	"license_keys_shop/internal/money"
+)
+
+// Record is a payment or refund as our database has it.
+type Record struct {
+	Kind          Kind
+	OrderID       int
+	Reference     string // public order reference
+	TransactionID string
+	Amount        money.Money // in the currency the provider handled
+	Status        string      // order payment_status; empty for refunds
+}
+
+// Settled reports whether the provider should have the money: refunds
+// always, payments once the order was paid.
+func (r Record) Settled() bool {
+	switch r.Status {
+	case "", "completed", "partially_refunded", "refunded":
+		return true
+	}
+	return false
+}
+
+// Problem names what is wrong with a Discrepancy.
+type Problem string
+
+const (
+	// We have it as settled, the statement doesn't.
+	NotOnStatement Problem = "not_on_statement"
+	// Both sides have it, with different amounts or currencies.
+	AmountMismatch Problem = "amount_mismatch"
+	// The provider settled it but our order isn't paid.
+	StatusMismatch Problem = "status_mismatch"
+	// The statement lists the transaction more than once.
+	Duplicate Problem = "duplicate"
+	// A payment on the statement is a refund for us, or the other way round.
+	KindMismatch Problem = "kind_mismatch"
+	// The statement has it, we have no such transaction.
+	UnknownTransaction Problem = "unknown_transaction"
+)
+
+// Discrepancy is one transaction the two sides disagree on. Expected is
+// our amount, Actual the statement's.
+type Discrepancy struct {
+	Problem       Problem      `json:"problem"`
+	Kind          Kind         `json:"type"`
+	TransactionID string       `json:"transaction_id"`
+	OrderID       int          `json:"order_id,omitempty"`
+	Reference     string       `json:"order_ref,omitempty"`
+	Status        string       `json:"status,omitempty"`
+	Expected      *money.Money `json:"expected,omitempty"`
+	Actual        *money.Money `json:"actual,omitempty"`
+	Currency      string       `json:"currency,omitempty"`
+	Line          int          `json:"line,omitempty"`
+}
+
+// Report sorts every transaction into matched or one of three lists:
+// Missing (ours only), Mismatched (both, disagreeing) and Orphaned
+// (statement only).
+type Report struct {
+	Entries    int           `json:"entries"`
+	Records    int           `json:"records"`
+	Matched    int           `json:"matched"`
+	Missing    []Discrepancy `json:"missing"`
+	Mismatched []Discrepancy `json:"mismatched"`
+	Orphaned   []Discrepancy `json:"orphaned"`
+}
+
+// Clean reports whether the two sides agree completely.
+func (r *Report) Clean() bool {
+	return len(r.Missing) == 0 && len(r.Mismatched) == 0 && len(r.Orphaned) == 0
+}
+
+// Reconcile matches statement entries to records by transaction ID and
+// compares amounts exactly. Records that aren't settled, such as failed or
+// expired orders, are only reported when the statement has them.
+func Reconcile(records []Record, entries []Entry) *Report {
+	report := &Report{
+		Entries:    len(entries),
+		Records:    len(records),
+		Missing:    []Discrepancy{},
+		Mismatched: []Discrepancy{},
+		Orphaned:   []Discrepancy{},
+	}
+
+	byID := make(map[string]Record, len(records))
+	for _, rec := range records {
+		byID[rec.TransactionID] = rec
+	}
+
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		rec, ok := byID[e.TransactionID]
+		if !ok {
+			report.Orphaned = append(report.Orphaned, entryDiscrepancy(UnknownTransaction, e))
+			continue
+		}
+		if seen[e.TransactionID] {
+			d := recordDiscrepancy(Duplicate, rec)
+			d.Actual, d.Line = amountPtr(e.Amount), e.Line
+			report.Mismatched = append(report.Mismatched, d)
+			continue
+		}
+		seen[e.TransactionID] = true
+
+		var problem Problem
+		switch {
+		case rec.Kind != e.Kind:
+			problem = KindMismatch
+		case !rec.Settled():
+			problem = StatusMismatch
+		case !sameAmount(rec.Amount, e.Amount):
+			problem = AmountMismatch
+		}
+		if problem == "" {
+			report.Matched++
+			continue
+		}
+		d := recordDiscrepancy(problem, rec)
+		d.Actual, d.Line = amountPtr(e.Amount), e.Line
+		if rec.Amount.Currency() != e.Amount.Currency() {
+			d.Currency = string(rec.Amount.Currency()) + "/" + string(e.Amount.Currency())
+		}
+		report.Mismatched = append(report.Mismatched, d)
+	}
+
+	for _, rec := range records {
+		if !seen[rec.TransactionID] && rec.Settled() {
+			report.Missing = append(report.Missing, recordDiscrepancy(NotOnStatement, rec))
+		}
+	}
+
+	sort.SliceStable(report.Missing, func(i, j int) bool {
+		return report.Missing[i].OrderID < report.Missing[j].OrderID
+	})
+	return report
+}
+
+func sameAmount(a, b money.Money) bool {
+	return a.Currency() == b.Currency() && a.Minor() == b.Minor()
+}
+
+func amountPtr(m money.Money) *money.Money {
+	return &m
+}
+
+func recordDiscrepancy(p Problem, rec Record) Discrepancy {
+	return Discrepancy{
+		Problem:       p,
+		Kind:          rec.Kind,
+		TransactionID: rec.TransactionID,
+		OrderID:       rec.OrderID,
+		Reference:     rec.Reference,
+		Status:        rec.Status,
+		Expected:      amountPtr(rec.Amount),
+		Currency:      string(rec.Amount.Currency()),
+	}
+}
+
+func entryDiscrepancy(p Problem, e Entry) Discrepancy {
+	return Discrepancy{
+		Problem:       p,
+		Kind:          e.Kind,
+		TransactionID: e.TransactionID,
+		Actual:        amountPtr(e.Amount),
+		Currency:      e.Currency,
+		Line:          e.Line,
+	}
+}
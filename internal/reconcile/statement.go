@@ -0,0 +1,222 @@
+package reconcile
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"license_keys_shop/internal/money"
+)
+
+// Format is the file format of a provider statement.
+type Format string
+
+const (
+	CSV  Format = "csv"
+	JSON Format = "json"
+)
+
+// Kind tells payments and refunds apart on a statement.
+type Kind string
+
+const (
+	Payment Kind = "payment"
+	Refund  Kind = "refund"
+)
+
+var ErrInvalidStatement = errors.New("invalid statement")
+
+// Entry is one settled transaction on a provider statement. TransactionID
+// is our transaction_id for payments and the provider reference for refunds.
+type Entry struct {
+	Line          int         `json:"line"`
+	TransactionID string      `json:"transaction_id"`
+	Kind          Kind        `json:"type"`
+	Amount        money.Money `json:"amount"`
+	Currency      string      `json:"currency"`
+	SettledAt     *time.Time  `json:"settled_at,omitempty"`
+}
+
+// ParseFormat accepts "csv" or "json" in any case.
+func ParseFormat(s string) (Format, bool) {
+	switch f := Format(strings.ToLower(strings.TrimSpace(s))); f {
+	case CSV, JSON:
+		return f, true
+	}
+	return "", false
+}
+
+// DetectFormat guesses the format from a file name, then from the first
+// non-blank byte of the content.
+func DetectFormat(name string, head []byte) Format {
+	if f, ok := ParseFormat(strings.TrimPrefix(filepath.Ext(name), ".")); ok {
+		return f
+	}
+	for _, b := range head {
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '[', '{':
+			return JSON
+		}
+		return CSV
+	}
+	return CSV
+}
+
+// Parse reads a statement. CSV needs a header row naming at least the
+// transaction_id, amount and currency columns; type (payment or refund,
+// default payment) and settled_at (RFC 3339 or YYYY-MM-DD) are optional.
+// JSON is an array of objects with the same fields, or an object holding
+// that array under "entries".
+func Parse(r io.Reader, format Format) ([]Entry, error) {
+	switch format {
+	case CSV:
+		return parseCSV(r)
+	case JSON:
+		return parseJSON(r)
+	}
+	return nil, fmt.Errorf("%w: unknown format %q", ErrInvalidStatement, format)
+}
+
+type rawEntry struct {
+	TransactionID string          `json:"transaction_id"`
+	Type          string          `json:"type"`
+	Amount        json.RawMessage `json:"amount"`
+	Currency      string          `json:"currency"`
+	SettledAt     string          `json:"settled_at"`
+}
+
+func parseCSV(r io.Reader) ([]Entry, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%w: empty file", ErrInvalidStatement)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidStatement, err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	for _, name := range []string{"transaction_id", "amount", "currency"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("%w: missing column %s", ErrInvalidStatement, name)
+		}
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var entries []Entry
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidStatement, err)
+		}
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		e, err := newEntry(line, rawEntry{
+			TransactionID: field(record, "transaction_id"),
+			Type:          field(record, "type"),
+			Amount:        json.RawMessage(field(record, "amount")),
+			Currency:      field(record, "currency"),
+			SettledAt:     field(record, "settled_at"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+}
+
+func parseJSON(r io.Reader) ([]Entry, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw []rawEntry
+	if err := json.Unmarshal(data, &raw); err != nil {
+		var wrapped struct {
+			Entries []rawEntry `json:"entries"`
+		}
+		if err := json.Unmarshal(data, &wrapped); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidStatement, err)
+		}
+		raw = wrapped.Entries
+	}
+
+	entries := make([]Entry, 0, len(raw))
+	for i, re := range raw {
+		e, err := newEntry(i+1, re)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func newEntry(line int, raw rawEntry) (Entry, error) {
+	fail := func(format string, args ...interface{}) (Entry, error) {
+		return Entry{}, fmt.Errorf("%w: entry %d: %s", ErrInvalidStatement, line, fmt.Sprintf(format, args...))
+	}
+
+	e := Entry{Line: line, TransactionID: strings.TrimSpace(raw.TransactionID), Kind: Payment}
+	if e.TransactionID == "" {
+		return fail("transaction_id is required")
+	}
+
+	switch Kind(strings.ToLower(strings.TrimSpace(raw.Type))) {
+	case "", Payment:
+	case Refund:
+		e.Kind = Refund
+	default:
+		return fail("unknown type %q", raw.Type)
+	}
+
+	currency, ok := money.ParseCurrency(raw.Currency)
+	if !ok {
+		return fail("unknown currency %q", raw.Currency)
+	}
+	e.Currency = string(currency)
+
+	amount, err := money.Parse(strings.Trim(string(raw.Amount), `"`), currency)
+	if err != nil {
+		return fail("invalid amount %s", raw.Amount)
+	}
+	if amount.IsNegative() {
+		// Some providers sign refunds; the type already says which it is
+		amount = amount.Neg()
+	}
+	e.Amount = amount
+
+	if s := strings.TrimSpace(raw.SettledAt); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t, err = time.Parse("2006-01-02", s)
+		}
+		if err != nil {
+			return fail("invalid settled_at %q", s)
+		}
+		e.SettledAt = &t
+	}
+	return e, nil
+}
@@ -0,0 +1,142 @@
+package sbp
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"license_keys_shop/internal/ids"
+	"license_keys_shop/internal/money"
+)
+
+// DefaultBankID is the SBP member ID the stand-in bank uses.
+const DefaultBankID = "100000000111"
+
+// FakeBank is an in-memory stand-in for the bank's SBP API. QR codes are
+// paid or rejected by calling Pay and Reject, and expire on their own.
+type FakeBank struct {
+	mu     sync.Mutex
+	bankID string
+	qrs    map[string]*fakeQR
+}
+
+type fakeQR struct {
+	QR
+	amount      money.Money
+	refunded    money.Money
+	status      Status
+	operationID string
+}
+
+func NewFakeBank(bankID string) *FakeBank {
+	if bankID == "" {
+		bankID = DefaultBankID
+	}
+	return &FakeBank{bankID: bankID, qrs: make(map[string]*fakeQR)}
+}
+
+func (b *FakeBank) RegisterQR(ctx context.Context, req QRRequest) (QR, error) {
+	if req.Amount.Currency() != money.RUB {
+		return QR{}, ErrNotRubles
+	}
+	id := "AS" + ids.New()
+	payload, err := Payload(id, b.bankID, req.Amount)
+	if err != nil {
+		return QR{}, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	qr := QR{ID: id, Payload: payload, ExpiresAt: req.ExpiresAt}
+	b.qrs[id] = &fakeQR{QR: qr, amount: req.Amount, refunded: money.Zero(money.RUB), status: Pending}
+	return qr, nil
+}
+
+func (b *FakeBank) Status(ctx context.Context, qrcID string) (PaymentStatus, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, err := b.lookup(qrcID)
+	if err != nil {
+		return PaymentStatus{}, err
+	}
+	return PaymentStatus{Status: q.status, OperationID: q.operationID}, nil
+}
+
+func (b *FakeBank) CancelQR(ctx context.Context, qrcID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, err := b.lookup(qrcID)
+	if err != nil {
+		return err
+	}
+	if q.status == Accepted {
+		return ErrAlreadyPaid
+	}
+	if q.status == Pending {
+		q.status = Expired
+	}
+	return nil
+}
+
+func (b *FakeBank) Refund(ctx context.Context, qrcID string, amount money.Money) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, err := b.lookup(qrcID)
+	if err != nil {
+		return "", err
+	}
+	if q.status != Accepted {
+		return "", ErrNotPaid
+	}
+	if amount.Currency() != money.RUB {
+		return "", ErrNotRubles
+	}
+	if q.amount.LessThan(q.refunded.Add(amount)) {
+		return "", ErrRefundTooLarge
+	}
+	q.refunded = q.refunded.Add(amount)
+	return "B" + ids.New(), nil
+}
+
+// Pay has the buyer pay a pending QR code.
+func (b *FakeBank) Pay(qrcID string) error {
+	return b.finish(qrcID, Accepted)
+}
+
+// Reject has the buyer's bank decline a pending QR code.
+func (b *FakeBank) Reject(qrcID string) error {
+	return b.finish(qrcID, Rejected)
+}
+
+func (b *FakeBank) finish(qrcID string, status Status) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, err := b.lookup(qrcID)
+	if err != nil {
+		return err
+	}
+	switch q.status {
+	case Pending:
+	case Accepted:
+		return ErrAlreadyPaid
+	default:
+		return ErrQRClosed
+	}
+	q.status = status
+	if status == Accepted {
+		q.operationID = "A" + ids.New()
+	}
+	return nil
+}
+
+// lookup finds a QR code and expires it if its time is up. b.mu is held.
+func (b *FakeBank) lookup(qrcID string) (*fakeQR, error) {
+	q, ok := b.qrs[qrcID]
+	if !ok {
+		return nil, ErrQRNotFound
+	}
+	if q.status == Pending && time.Now().After(q.ExpiresAt) {
+		q.status = Expired
+	}
+	return q, nil
+}
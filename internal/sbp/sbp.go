@@ -0,0 +1,100 @@
+package sbp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"license_keys_shop/internal/money"
+)
+
+// Status is where an SBP payment stands at the bank.
+type Status string
+
+const (
+	Pending  Status = "pending"
+	Accepted Status = "accepted"
+	Rejected Status = "rejected"
+	Expired  Status = "expired"
+)
+
+var (
+	ErrNotRubles      = errors.New("SBP payments are in rubles only")
+	ErrQRNotFound     = errors.New("SBP QR code not found")
+	ErrAlreadyPaid    = errors.New("SBP QR code is already paid")
+	ErrQRClosed       = errors.New("SBP QR code is expired or rejected")
+	ErrNotPaid        = errors.New("SBP QR code was not paid")
+	ErrRefundTooLarge = errors.New("refund exceeds the SBP payment")
+)
+
+// QRRequest asks the bank for a one-time QR code over Amount.
+type QRRequest struct {
+	Amount    money.Money
+	Purpose   string
+	ExpiresAt time.Time
+}
+
+// QR is a registered dynamic QR code. Payload is the link encoded in the
+// image; banking apps open it to pay.
+type QR struct {
+	ID        string
+	Payload   string
+	ExpiresAt time.Time
+}
+
+// PaymentStatus is the bank's answer about a QR code. OperationID is the
+// SBP operation of an accepted payment.
+type PaymentStatus struct {
+	Status      Status
+	OperationID string
+}
+
+// Bank is the acquiring bank's SBP API.
+type Bank interface {
+	RegisterQR(ctx context.Context, req QRRequest) (QR, error)
+	Status(ctx context.Context, qrcID string) (PaymentStatus, error)
+	// CancelQR stops a QR code from being paid. It fails with
+	// ErrAlreadyPaid if the buyer got there first.
+	CancelQR(ctx context.Context, qrcID string) error
+	// Refund returns amount of a paid QR code and gives the refund's
+	// operation ID.
+	Refund(ctx context.Context, qrcID string, amount money.Money) (string, error)
+}
+
+// Payload builds the NSPK link for a dynamic QR code (type 02): the amount
+// in kopecks and a CRC-16/CCITT-FALSE of the link without its crc parameter.
+func Payload(qrcID, bankID string, amount money.Money) (string, error) {
+	if amount.Currency() != money.RUB {
+		return "", ErrNotRubles
+	}
+	link := fmt.Sprintf("https://qr.nspk.ru/%s?type=02&bank=%s&sum=%d&cur=RUB",
+		url.PathEscape(qrcID), url.QueryEscape(bankID), amount.Minor())
+	return fmt.Sprintf("%s&crc=%04X", link, crc16(link)), nil
+}
+
+// ValidPayload checks the crc of a link made by Payload.
+func ValidPayload(payload string) bool {
+	i := strings.LastIndex(payload, "&crc=")
+	if i < 0 {
+		return false
+	}
+	return strings.EqualFold(payload[i+len("&crc="):], fmt.Sprintf("%04X", crc16(payload[:i])))
+}
+
+func crc16(s string) uint16 {
+	crc := uint16(0xFFFF)
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
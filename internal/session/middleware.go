@@ -0,0 +1,205 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"license_keys_shop/internal/signing"
+)
+
+// Cookie names. AccessCookie is the cookie the site has always used.
+const (
+	AccessCookie  = "auth_token"
+	RefreshCookie = "refresh_token"
+)
+
+type contextKey string
+
+const claimsKey contextKey = "session_claims"
+
+// ClaimsFromContext returns the verified access token claims Middleware
+// put into the request context.
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	c, ok := ctx.Value(claimsKey).(*Claims)
+	return c, ok
+}
+
+// NewContext returns ctx carrying claims, for middleware that
+// authenticates a request some other way, like an API token.
+func NewContext(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey, claims)
+}
+
+// UserFromContext returns the user the request is authenticated as.
+func UserFromContext(ctx context.Context) (User, bool) {
+	c, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return User{}, false
+	}
+	return User{ID: c.UserID, Username: c.Username, Email: c.Email, IsAdmin: c.IsAdmin}, true
+}
+
+// Middleware authenticates requests. It verifies the access token against
+// the key set, drops tokens whose session was revoked, so the request is
+// anonymous, and puts the claims of a live one into the request context.
+// A missing or expired access token is renewed from the refresh cookie, so
+// browsers stay logged in without a client-side refresh call.
+func (m *Manager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if otherBearer(r) {
+			// An API token; its own middleware deals with it
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, fromHeader := accessToken(r)
+		if token != "" {
+			claims, err := m.ParseAccess(token)
+			if err == nil {
+				active, dbErr := m.Active(claims.SessionID)
+				if dbErr != nil {
+					log.Printf("checking session %s: %v", claims.SessionID, dbErr)
+					http.Error(w, "Session store unavailable", http.StatusServiceUnavailable)
+					return
+				}
+				if active {
+					next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), claims)))
+					return
+				}
+				err = ErrSessionRevoked
+			}
+			r = withoutAccessToken(r)
+			if fromHeader {
+				// API clients refresh explicitly
+				next.ServeHTTP(w, r)
+				return
+			}
+			// A token signed with a retired key is renewed like an expired one
+			if !errors.Is(err, ErrSessionRevoked) && !errors.Is(err, jwt.ErrTokenExpired) &&
+				!errors.Is(err, signing.ErrUnknownKey) {
+				ClearCookies(w)
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		cookie, err := r.Cookie(RefreshCookie)
+		if err != nil || cookie.Value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tokens, err := m.Refresh(cookie.Value, ClientOf(r))
+		switch {
+		case err == nil:
+			SetCookies(w, tokens)
+			r = withAccessToken(r, tokens.AccessToken)
+			if claims, err := m.ParseAccess(tokens.AccessToken); err == nil {
+				r = r.WithContext(NewContext(r.Context(), claims))
+			}
+			next.ServeHTTP(w, r)
+		case errors.Is(err, ErrConcurrentRefresh):
+			// Another request is setting the new cookies right now
+			next.ServeHTTP(w, r)
+		case errors.Is(err, ErrInvalidToken), errors.Is(err, ErrSessionRevoked), errors.Is(err, ErrTokenReused):
+			if errors.Is(err, ErrTokenReused) {
+				log.Printf("refresh token reuse from %s, session revoked", ClientOf(r).IP)
+			}
+			ClearCookies(w)
+			next.ServeHTTP(w, r)
+		default:
+			log.Printf("refreshing session: %v", err)
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// SetCookies stores both tokens in HttpOnly cookies.
+func SetCookies(w http.ResponseWriter, t Tokens) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     AccessCookie,
+		Value:    t.AccessToken,
+		Expires:  t.AccessExpiresAt,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     RefreshCookie,
+		Value:    t.RefreshToken,
+		Expires:  t.RefreshExpiresAt,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+	})
+}
+
+func ClearCookies(w http.ResponseWriter) {
+	for _, name := range []string{AccessCookie, RefreshCookie} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			Expires:  time.Now().Add(-time.Hour),
+			HttpOnly: true,
+			Path:     "/",
+		})
+	}
+}
+
+// ClientOf describes the client of r for the session list.
+func ClientOf(r *http.Request) Client {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return Client{UserAgent: r.UserAgent(), IP: ip}
+}
+
+// accessToken finds the access token in the Authorization header or the
+// auth cookie.
+func accessToken(r *http.Request) (token string, fromHeader bool) {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer "), true
+	}
+	if c, err := r.Cookie(AccessCookie); err == nil {
+		return c.Value, false
+	}
+	return "", false
+}
+
+// otherBearer reports whether r carries a bearer token that isn't one of
+// our JWTs.
+func otherBearer(r *http.Request) bool {
+	h := r.Header.Get("Authorization")
+	return strings.HasPrefix(h, "Bearer ") && strings.Count(h, ".") != 2
+}
+
+// withoutAccessToken returns a copy of r without its access token.
+func withoutAccessToken(r *http.Request) *http.Request {
+	r = r.Clone(r.Context())
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		r.Header.Del("Authorization")
+	}
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != AccessCookie {
+			r.AddCookie(c)
+		}
+	}
+	return r
+}
+
+// withAccessToken returns a copy of r carrying token as its auth cookie.
+func withAccessToken(r *http.Request, token string) *http.Request {
+	r = withoutAccessToken(r)
+	r.AddCookie(&http.Cookie{Name: AccessCookie, Value: token})
+	return r
+}
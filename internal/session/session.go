@@ -0,0 +1,367 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"license_keys_shop/internal/ids"
+	"license_keys_shop/internal/signing"
+)
+
+// Sessions pair a short-lived access token (a JWT the existing middleware
+// understands, plus the session ID) with a refresh token kept server-side.
+// Every refresh replaces the refresh token; presenting a replaced one again
+// means it was copied, and the whole session (the token family) is revoked.
+
+const (
+	DefaultAccessTTL  = 15 * time.Minute
+	DefaultRefreshTTL = 30 * 24 * time.Hour
+
+	// reuseGrace lets two requests that raced to refresh the same token,
+	// e.g. from two browser tabs, both through without a revocation.
+	reuseGrace = 10 * time.Second
+)
+
+// Reasons stored with a revocation.
+const (
+	ReasonLogout           = "logout"
+	ReasonLogoutEverywhere = "logout_everywhere"
+	ReasonAdmin            = "admin"
+	ReasonTokenReuse       = "refresh_token_reuse"
+	ReasonPasswordChange   = "password_change"
+	ReasonTwoFactorChange  = "two_factor_change"
+	ReasonRoleChange       = "role_change"
+)
+
+var (
+	ErrInvalidToken      = errors.New("invalid or expired refresh token")
+	ErrTokenReused       = errors.New("refresh token reuse detected, session revoked")
+	ErrConcurrentRefresh = errors.New("refresh token was just rotated by another request")
+	ErrSessionRevoked    = errors.New("session revoked")
+	ErrSessionNotFound   = errors.New("session not found")
+)
+
+// DB is what Manager needs from the database handle.
+type DB interface {
+	Begin() (*sql.Tx, error)
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// User is what goes into an access token.
+type User struct {
+	ID       int
+	Username string
+	Email    string
+	IsAdmin  bool
+}
+
+// Session is one login on one device.
+type Session struct {
+	ID         string     `json:"id"`
+	UserID     int        `json:"user_id"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt time.Time  `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	Current    bool       `json:"current"`
+}
+
+// Tokens is what a login or refresh hands to the client.
+type Tokens struct {
+	SessionID        string
+	AccessToken      string
+	AccessExpiresAt  time.Time
+	RefreshToken     string
+	RefreshExpiresAt time.Time
+}
+
+// Client describes where a request came from.
+type Client struct {
+	UserAgent string
+	IP        string
+}
+
+type Manager struct {
+	db         DB
+	keys       *signing.KeySet
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+// NewManager signs access tokens with the keys signing.FromEnv configures,
+// by default HS256 with secret. ACCESS_TOKEN_TTL and REFRESH_TOKEN_TTL
+// (Go durations) override the 15 minute and 30 day defaults.
+func NewManager(db DB, secret string) *Manager {
+	keys, err := signing.FromEnv(secret)
+	if err != nil {
+		log.Printf("session: signing keys: %v; signing with HS256 instead", err)
+		hmac := signing.NewHMAC(signing.HMACKeyID, []byte(secret))
+		keys, _ = signing.NewKeySet(hmac)
+		keys.AcceptUnkeyed(hmac)
+	}
+	log.Printf("session: signing access tokens with key %s (%s)", keys.Active().ID, keys.Active().Algorithm)
+
+	m := &Manager{
+		db:         db,
+		keys:       keys,
+		accessTTL:  DefaultAccessTTL,
+		refreshTTL: DefaultRefreshTTL,
+	}
+	if d, err := time.ParseDuration(os.Getenv("ACCESS_TOKEN_TTL")); err == nil && d > 0 {
+		m.accessTTL = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("REFRESH_TOKEN_TTL")); err == nil && d > 0 {
+		m.refreshTTL = d
+	}
+	return m
+}
+
+// Login starts a session for u.
+func (m *Manager) Login(u User, c Client) (Tokens, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return Tokens{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	sessionID := ids.New()
+	_, err = tx.Exec(`
+		INSERT INTO sessions (id, user_id, user_agent, ip, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		sessionID, u.ID, truncate(c.UserAgent, 255), truncate(c.IP, 64), now.Add(m.refreshTTL))
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	refresh, err := m.newRefreshToken(tx, sessionID, now)
+	if err != nil {
+		return Tokens{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Tokens{}, err
+	}
+	return m.tokens(u, sessionID, refresh, now)
+}
+
+// Refresh trades a refresh token for a new pair. A token that was already
+// traded revokes its session and returns ErrTokenReused.
+func (m *Manager) Refresh(refreshToken string, c Client) (Tokens, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return Tokens{}, err
+	}
+	defer tx.Rollback()
+
+	var tokenID int
+	var sessionID string
+	var usedAt, revokedAt sql.NullTime
+	var expiresAt, sessionExpiresAt time.Time
+	var u User
+	err = tx.QueryRow(`
+		SELECT rt.id, rt.session_id, rt.used_at, rt.expires_at,
+		       s.revoked_at, s.expires_at, u.id, u.username, u.email, u.is_admin
+		FROM refresh_tokens rt
+		JOIN sessions s ON rt.session_id = s.id
+		JOIN users u ON s.user_id = u.id
+		WHERE rt.token_hash = $1
+		FOR UPDATE OF rt, s`, hashToken(refreshToken)).Scan(
+		&tokenID, &sessionID, &usedAt, &expiresAt,
+		&revokedAt, &sessionExpiresAt, &u.ID, &u.Username, &u.Email, &u.IsAdmin)
+	if err == sql.ErrNoRows {
+		return Tokens{}, ErrInvalidToken
+	}
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	now := time.Now()
+	switch {
+	case revokedAt.Valid:
+		return Tokens{}, ErrSessionRevoked
+	case usedAt.Valid && now.Sub(usedAt.Time) < reuseGrace:
+		return Tokens{}, ErrConcurrentRefresh
+	case usedAt.Valid:
+		if err := revoke(tx, sessionID, ReasonTokenReuse); err != nil {
+			return Tokens{}, err
+		}
+		if err := tx.Commit(); err != nil {
+			return Tokens{}, err
+		}
+		return Tokens{}, ErrTokenReused
+	case now.After(expiresAt) || now.After(sessionExpiresAt):
+		return Tokens{}, ErrInvalidToken
+	}
+
+	if _, err := tx.Exec("UPDATE refresh_tokens SET used_at = $1 WHERE id = $2", now, tokenID); err != nil {
+		return Tokens{}, err
+	}
+	_, err = tx.Exec(`
+		UPDATE sessions SET last_used_at = $1, user_agent = $2, ip = $3
+		WHERE id = $4`, now, truncate(c.UserAgent, 255), truncate(c.IP, 64), sessionID)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	refresh, err := m.newRefreshToken(tx, sessionID, now)
+	if err != nil {
+		return Tokens{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Tokens{}, err
+	}
+	return m.tokens(u, sessionID, refresh, now)
+}
+
+// RevokeToken ends the session a refresh token belongs to, for logging
+// out after the access token already expired.
+func (m *Manager) RevokeToken(refreshToken, reason string) error {
+	res, err := m.db.Exec(`
+		UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP, revoke_reason = $1
+		WHERE id = (SELECT session_id FROM refresh_tokens WHERE token_hash = $2)
+		  AND revoked_at IS NULL`, reason, hashToken(refreshToken))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// Revoke ends one of userID's sessions.
+func (m *Manager) Revoke(userID int, sessionID, reason string) error {
+	res, err := m.db.Exec(`
+		UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP, revoke_reason = $1
+		WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL`, reason, sessionID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeAll ends every session of userID except keep (if not empty) and
+// returns how many it ended.
+func (m *Manager) RevokeAll(userID int, keep, reason string) (int, error) {
+	res, err := m.db.Exec(`
+		UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP, revoke_reason = $1
+		WHERE user_id = $2 AND id <> $3 AND revoked_at IS NULL`, reason, userID, keep)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+// Active reports whether a session may still be used.
+func (m *Manager) Active(sessionID string) (bool, error) {
+	var active bool
+	err := m.db.QueryRow(`
+		SELECT revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		FROM sessions WHERE id = $1`, sessionID).Scan(&active)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return active, err
+}
+
+// List returns userID's live sessions, most recently used first.
+func (m *Manager) List(userID int) ([]Session, error) {
+	rows, err := m.db.Query(`
+		SELECT id, user_id, user_agent, ip, created_at, last_used_at, expires_at
+		FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		ORDER BY last_used_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// Cleanup deletes sessions that ended more than a day ago.
+func (m *Manager) Cleanup() (int, error) {
+	res, err := m.db.Exec(`
+		DELETE FROM sessions
+		WHERE expires_at < CURRENT_TIMESTAMP - INTERVAL '1 day'
+		   OR revoked_at < CURRENT_TIMESTAMP - INTERVAL '1 day'`)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+func revoke(tx *sql.Tx, sessionID, reason string) error {
+	_, err := tx.Exec(`
+		UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP, revoke_reason = $1
+		WHERE id = $2 AND revoked_at IS NULL`, reason, sessionID)
+	return err
+}
+
+func (m *Manager) newRefreshToken(tx *sql.Tx, sessionID string, now time.Time) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	_, err := tx.Exec(`
+		INSERT INTO refresh_tokens (session_id, token_hash, expires_at)
+		VALUES ($1, $2, $3)`, sessionID, hashToken(token), now.Add(m.refreshTTL))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (m *Manager) tokens(u User, sessionID, refresh string, now time.Time) (Tokens, error) {
+	access, err := m.signAccess(u, sessionID, now)
+	if err != nil {
+		return Tokens{}, err
+	}
+	return Tokens{
+		SessionID:        sessionID,
+		AccessToken:      access,
+		AccessExpiresAt:  now.Add(m.accessTTL),
+		RefreshToken:     refresh,
+		RefreshExpiresAt: now.Add(m.refreshTTL),
+	}, nil
+}
+
+// Refresh tokens are only stored hashed, so a database leak can't be
+// replayed.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,79 @@
+package session
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"license_keys_shop/internal/ids"
+	"license_keys_shop/internal/signing"
+)
+
+// Claims are the access token's claims: the fields the site has always put
+// into its JWTs plus the session ID.
+type Claims struct {
+	UserID    int    `json:"user_id"`
+	Username  string `json:"username"`
+	Email     string `json:"email"`
+	IsAdmin   bool   `json:"is_admin"`
+	SessionID string `json:"sid"`
+	// TokenID is set instead of SessionID when an API token authorized the
+	// request.
+	TokenID string `json:"tid,omitempty"`
+	jwt.RegisteredClaims
+}
+
+var errNoSession = errors.New("access token has no session")
+
+func (m *Manager) signAccess(u User, sessionID string, now time.Time) (string, error) {
+	claims := Claims{
+		UserID:    u.ID,
+		Username:  u.Username,
+		Email:     u.Email,
+		IsAdmin:   u.IsAdmin,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        ids.New(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(m.accessTTL)),
+		},
+	}
+	return m.keys.Sign(claims)
+}
+
+// ParseAccess checks an access token's signature and expiry. It does not
+// look at the revocation list; Verify does.
+func (m *Manager) ParseAccess(token string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, m.keys.Keyfunc)
+	if err != nil {
+		return nil, err
+	}
+	if claims.SessionID == "" {
+		// Issued before sessions existed and so can't be revoked
+		return nil, errNoSession
+	}
+	return claims, nil
+}
+
+// JWKS is the public keys other services verify access tokens with.
+func (m *Manager) JWKS() signing.JWKS {
+	return m.keys.JWKS()
+}
+
+// Verify parses an access token and checks its session is still active.
+func (m *Manager) Verify(token string) (*Claims, error) {
+	claims, err := m.ParseAccess(token)
+	if err != nil {
+		return nil, err
+	}
+	active, err := m.Active(claims.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if !active {
+		return nil, ErrSessionRevoked
+	}
+	return claims, nil
+}
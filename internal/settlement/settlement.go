@@ -0,0 +1,58 @@
+package settlement
+
+import (
+	"time"
+
+	"license_keys_shop/internal/money"
+)
+
+// Outcome compares what arrived for an order with what was due.
+type Outcome string
+
+const (
+	Unpaid    Outcome = "unpaid"
+	Underpaid Outcome = "underpaid"
+	Exact     Outcome = "exact"
+	Overpaid  Outcome = "overpaid"
+)
+
+// Result carries the exact amounts behind an Outcome, all in the payment
+// currency. Shortfall is what is still missing, Excess what was sent on top.
+type Result struct {
+	Outcome   Outcome     `json:"outcome"`
+	Due       money.Money `json:"due"`
+	Received  money.Money `json:"received"`
+	Shortfall money.Money `json:"shortfall"`
+	Excess    money.Money `json:"excess"`
+}
+
+func Evaluate(due, received money.Money) Result {
+	r := Result{
+		Due:       due,
+		Received:  received,
+		Shortfall: money.Zero(due.Currency()),
+		Excess:    money.Zero(due.Currency()),
+	}
+	switch c := received.Cmp(due); {
+	case !received.IsPositive():
+		r.Outcome = Unpaid
+		r.Shortfall = due
+	case c < 0:
+		r.Outcome = Underpaid
+		r.Shortfall = due.Sub(received)
+	case c > 0:
+		r.Outcome = Overpaid
+		r.Excess = received.Sub(due)
+	default:
+		r.Outcome = Exact
+	}
+	return r
+}
+
+// Settled is true once the order has been paid in full.
+func (r Result) Settled() bool {
+	return r.Outcome == Exact || r.Outcome == Overpaid
+}
+
+// DefaultTopUpWindow is how long an underpaid order waits for the rest.
+const DefaultTopUpWindow = 24 * time.Hour
@@ -0,0 +1,246 @@
+// Package signing holds the keys access tokens are signed with. One key
+// signs; the others only verify, so tokens issued before a rotation stay
+// valid until they expire. Tokens name their key in the kid header.
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	EdDSA = "EdDSA"
+)
+
+// HMACKeyID names the shared-secret key.
+const HMACKeyID = "hs256"
+
+var (
+	ErrUnknownKey     = errors.New("token is signed with an unknown key")
+	ErrWrongAlgorithm = errors.New("token algorithm doesn't match its key")
+	ErrCannotSign     = errors.New("key has no private part")
+)
+
+// Key is a signing or verification key.
+type Key struct {
+	ID        string
+	Algorithm string
+	private   interface{}
+	public    interface{}
+}
+
+// NewHMAC is a shared-secret HS256 key.
+func NewHMAC(id string, secret []byte) *Key {
+	return &Key{ID: id, Algorithm: HS256, private: secret, public: secret}
+}
+
+// ParsePEM reads an RSA or Ed25519 key: a private key (PKCS #1 or PKCS #8)
+// can sign and verify, a public key (PKIX) only verify.
+func ParsePEM(id string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("key %s: no PEM data", id)
+	}
+
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("key %s: unsupported PEM block %q", id, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", id, err)
+	}
+
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("key %s: RSA keys must be at least 2048 bits", id)
+		}
+		return &Key{ID: id, Algorithm: RS256, private: k, public: &k.PublicKey}, nil
+	case *rsa.PublicKey:
+		return &Key{ID: id, Algorithm: RS256, public: k}, nil
+	case ed25519.PrivateKey:
+		return &Key{ID: id, Algorithm: EdDSA, private: k, public: k.Public()}, nil
+	case ed25519.PublicKey:
+		return &Key{ID: id, Algorithm: EdDSA, public: k}, nil
+	}
+	return nil, fmt.Errorf("key %s: unsupported key type %T", id, parsed)
+}
+
+// CanSign reports whether k has its private part.
+func (k *Key) CanSign() bool {
+	return k.private != nil
+}
+
+func (k *Key) method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+// KeySet is the active signing key and every key still accepted.
+type KeySet struct {
+	active  *Key
+	keys    map[string]*Key
+	unkeyed *Key
+}
+
+// NewKeySet signs with active and verifies with it and others.
+func NewKeySet(active *Key, others ...*Key) (*KeySet, error) {
+	if !active.CanSign() {
+		return nil, fmt.Errorf("key %s: %w", active.ID, ErrCannotSign)
+	}
+	s := &KeySet{active: active, keys: map[string]*Key{active.ID: active}}
+	for _, k := range others {
+		if _, dup := s.keys[k.ID]; dup {
+			return nil, fmt.Errorf("duplicate key id %s", k.ID)
+		}
+		s.keys[k.ID] = k
+	}
+	return s, nil
+}
+
+// AcceptUnkeyed verifies tokens without a kid, issued before keys had
+// IDs, with k.
+func (s *KeySet) AcceptUnkeyed(k *Key) {
+	s.unkeyed = k
+}
+
+// Active is the key new tokens are signed with.
+func (s *KeySet) Active() *Key {
+	return s.active
+}
+
+// Sign signs claims with the active key and names it in the kid header.
+func (s *KeySet) Sign(claims jwt.Claims) (string, error) {
+	t := jwt.NewWithClaims(s.active.method(), claims)
+	t.Header["kid"] = s.active.ID
+	return t.SignedString(s.active.private)
+}
+
+// Keyfunc picks the key to verify t with, for jwt.Parse. The token's
+// algorithm has to be its key's, so a public key is never taken for an
+// HMAC secret.
+func (s *KeySet) Keyfunc(t *jwt.Token) (interface{}, error) {
+	k := s.unkeyed
+	if kid, ok := t.Header["kid"].(string); ok {
+		k = s.keys[kid]
+	}
+	if k == nil {
+		return nil, ErrUnknownKey
+	}
+	if t.Method.Alg() != k.Algorithm {
+		return nil, ErrWrongAlgorithm
+	}
+	return k.public, nil
+}
+
+// FromEnv builds the key set from the environment.
+//
+// Without JWT_KEYS_DIR tokens are signed with HS256 and secret, as they
+// always were. Otherwise every <kid>.pem in the directory is a key (a
+// public-only one verifies only) and JWT_ACTIVE_KID names the one that
+// signs. HS256 tokens keep verifying unless JWT_ACCEPT_HS256 is false.
+//
+// To rotate, add the new key to the directory and deploy, so services
+// reading the JWKS learn it; then point JWT_ACTIVE_KID at it and deploy;
+// once ACCESS_TOKEN_TTL has passed, remove the old key.
+func FromEnv(secret string) (*KeySet, error) {
+	hmac := NewHMAC(HMACKeyID, []byte(secret))
+
+	dir := os.Getenv("JWT_KEYS_DIR")
+	if dir == "" {
+		s, err := NewKeySet(hmac)
+		if err != nil {
+			return nil, err
+		}
+		s.AcceptUnkeyed(hmac)
+		return s, nil
+	}
+
+	keys, err := loadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	activeID := os.Getenv("JWT_ACTIVE_KID")
+	if activeID == "" {
+		return nil, errors.New("JWT_ACTIVE_KID is required with JWT_KEYS_DIR")
+	}
+
+	var active *Key
+	var others []*Key
+	for _, k := range keys {
+		if k.ID == activeID {
+			active = k
+		} else {
+			others = append(others, k)
+		}
+	}
+	if active == nil {
+		return nil, fmt.Errorf("active key %s not found in %s", activeID, dir)
+	}
+
+	acceptHMAC := true
+	if v, err := strconv.ParseBool(os.Getenv("JWT_ACCEPT_HS256")); err == nil {
+		acceptHMAC = v
+	}
+	if acceptHMAC {
+		others = append(others, hmac)
+	}
+
+	s, err := NewKeySet(active, others...)
+	if err != nil {
+		return nil, err
+	}
+	if acceptHMAC {
+		s.AcceptUnkeyed(hmac)
+	}
+	return s, nil
+}
+
+func loadDir(dir string) ([]*Key, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var keys []*Key
+	for _, path := range paths {
+		id := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(path), ".pem"), ".pub")
+		if id == HMACKeyID {
+			return nil, fmt.Errorf("key id %s is reserved", id)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		k, err := ParsePEM(id, data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys in %s", dir)
+	}
+	return keys, nil
+}
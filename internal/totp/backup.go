@@ -0,0 +1,53 @@
+package totp
+
+import (
+	"crypto/rand"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BackupCodeCount is how many backup codes a user gets at a time.
+const BackupCodeCount = 10
+
+// Backup codes avoid look-alike characters; ten of them give 50 bits.
+const backupAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// GenerateBackupCodes returns fresh one-time codes, formatted xxxxx-xxxxx,
+// with their hashes for storage.
+func GenerateBackupCodes() (codes, hashes []string, err error) {
+	for i := 0; i < BackupCodeCount; i++ {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		for j := range b {
+			// 256 % 31 != 0; the bias is negligible for one-time codes
+			b[j] = backupAlphabet[int(b[j])%len(backupAlphabet)]
+		}
+		code := string(b[:5]) + "-" + string(b[5:])
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, string(hash))
+	}
+	return codes, hashes, nil
+}
+
+// NormalizeBackupCode accepts a code typed in any case, with or without
+// the dash.
+func NormalizeBackupCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+	if len(code) != 10 {
+		return ""
+	}
+	return code[:5] + "-" + code[5:]
+}
+
+// MatchBackupCode reports whether code matches a stored hash.
+func MatchBackupCode(hash, code string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil
+}
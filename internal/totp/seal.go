@@ -0,0 +1,126 @@
+package totp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var ErrSealed = errors.New("totp: cannot open sealed secret")
+
+// Sealer encrypts secrets at rest with AES-GCM, so a database dump alone
+// doesn't give away anyone's second factor. A sealed secret is
+// "<kid>:<base64 nonce+ciphertext>", naming the key that sealed it, so
+// keys can be rotated without re-enrolling anyone.
+type Sealer struct {
+	activeID string
+	keys     map[string]cipher.AEAD
+}
+
+// NewSealer seals with the key activeID and opens secrets sealed with any
+// of keys. Keys are 32 bytes.
+func NewSealer(activeID string, keys map[string][]byte) (*Sealer, error) {
+	s := &Sealer{activeID: activeID, keys: make(map[string]cipher.AEAD)}
+	for id, key := range keys {
+		if id == "" || strings.ContainsRune(id, ':') {
+			return nil, fmt.Errorf("totp: invalid key id %q", id)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("totp: key %s is %d bytes, want 32", id, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		s.keys[id] = aead
+	}
+	if _, ok := s.keys[activeID]; !ok {
+		return nil, fmt.Errorf("totp: active key %s not given", activeID)
+	}
+	return s, nil
+}
+
+// SealerFromEnv reads the keys from the environment. TOTP_ENCRYPTION_KEY
+// is "<kid>:<base64 key>" and seals new secrets; TOTP_ENCRYPTION_OLD_KEYS
+// is a comma-separated list of the same, kept to open secrets sealed
+// before a rotation. Generate a key with `openssl rand -base64 32`.
+//
+// To rotate, move the current key to TOTP_ENCRYPTION_OLD_KEYS and set a
+// new TOTP_ENCRYPTION_KEY; an old key can go once no secret uses it.
+func SealerFromEnv() (*Sealer, error) {
+	active := os.Getenv("TOTP_ENCRYPTION_KEY")
+	if active == "" {
+		return nil, errors.New("TOTP_ENCRYPTION_KEY is required")
+	}
+	activeID, key, err := parseKey(active)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string][]byte{activeID: key}
+
+	if old := os.Getenv("TOTP_ENCRYPTION_OLD_KEYS"); old != "" {
+		for _, entry := range strings.Split(old, ",") {
+			id, key, err := parseKey(strings.TrimSpace(entry))
+			if err != nil {
+				return nil, err
+			}
+			if _, dup := keys[id]; dup {
+				return nil, fmt.Errorf("totp: key id %s given twice", id)
+			}
+			keys[id] = key
+		}
+	}
+	return NewSealer(activeID, keys)
+}
+
+func parseKey(s string) (string, []byte, error) {
+	id, encoded, ok := strings.Cut(s, ":")
+	if !ok || id == "" {
+		return "", nil, errors.New("totp: key must be <kid>:<base64 key>")
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, fmt.Errorf("totp: key %s: %v", id, err)
+	}
+	return id, key, nil
+}
+
+func (s *Sealer) Seal(secret string) (string, error) {
+	aead := s.keys[s.activeID]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(secret), nil)
+	return s.activeID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *Sealer) Open(sealed string) (string, error) {
+	id, encoded, ok := strings.Cut(sealed, ":")
+	if !ok {
+		return "", ErrSealed
+	}
+	aead, ok := s.keys[id]
+	if !ok {
+		return "", ErrSealed
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", ErrSealed
+	}
+	n := aead.NonceSize()
+	plain, err := aead.Open(nil, data[:n], data[n:], nil)
+	if err != nil {
+		return "", ErrSealed
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,135 @@
+// Package validation checks and normalizes account fields and collects
+// per-field errors for forms.
+package validation
+
+import (
+	"errors"
+	"net/mail"
+	"sort"
+	"strings"
+)
+
+const (
+	UsernameMinLength = 3
+	UsernameMaxLength = 32
+	EmailMaxLength    = 254
+)
+
+var (
+	ErrRequired         = errors.New("this field is required")
+	ErrEmailInvalid     = errors.New("enter a valid email address")
+	ErrEmailTooLong     = errors.New("email address is too long")
+	ErrUsernameLength   = errors.New("username must be 3 to 32 characters")
+	ErrUsernameChars    = errors.New("username may contain only latin letters, digits, '.', '_' and '-'")
+	ErrUsernameStart    = errors.New("username must start with a letter")
+	ErrUsernameReserved = errors.New("this username is reserved")
+)
+
+// reserved usernames could pass for the shop's own staff.
+var reserved = map[string]bool{
+	"admin": true, "administrator": true, "root": true, "support": true,
+	"help": true, "system": true, "moderator": true, "staff": true,
+	"security": true, "billing": true, "noreply": true, "no-reply": true,
+}
+
+// Errors maps form fields to what is wrong with them.
+type Errors map[string]string
+
+// Add records err for field unless the field already has an error.
+func (e Errors) Add(field string, err error) {
+	if err == nil {
+		return
+	}
+	if _, ok := e[field]; !ok {
+		e[field] = err.Error()
+	}
+}
+
+func (e Errors) Error() string {
+	fields := make([]string, 0, len(e))
+	for f := range e {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+
+	parts := make([]string, len(fields))
+	for i, f := range fields {
+		parts[i] = f + ": " + e[f]
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Email checks an address and returns it normalized: trimmed and lower
+// case, the form it is stored and compared in.
+func Email(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", ErrRequired
+	}
+	if len(s) > EmailMaxLength {
+		return "", ErrEmailTooLong
+	}
+
+	// A bare address only: no display names, comments or angle brackets
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Name != "" || addr.Address != s {
+		return "", ErrEmailInvalid
+	}
+	at := strings.LastIndexByte(s, '@')
+	local, domain := s[:at], s[at+1:]
+	if len(local) > 64 || strings.ContainsAny(s, "\"\\ ") {
+		return "", ErrEmailInvalid
+	}
+	if !validDomain(domain) {
+		return "", ErrEmailInvalid
+	}
+	return strings.ToLower(s), nil
+}
+
+// validDomain accepts dotted host names like mail.example.ru, including
+// IDN domains, but not bare hosts or address literals.
+func validDomain(domain string) bool {
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, l := range labels {
+		if l == "" || len(l) > 63 || strings.HasPrefix(l, "-") || strings.HasSuffix(l, "-") {
+			return false
+		}
+		for _, r := range l {
+			if r < 0x80 && !isASCIIAlnum(r) && r != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Username checks a username and returns it trimmed. Case is kept but two
+// usernames differing only in case are the same account.
+func Username(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", ErrRequired
+	}
+	for _, r := range s {
+		if !isASCIIAlnum(r) && r != '.' && r != '_' && r != '-' {
+			return "", ErrUsernameChars
+		}
+	}
+	if len(s) < UsernameMinLength || len(s) > UsernameMaxLength {
+		return "", ErrUsernameLength
+	}
+	if c := s[0]; !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+		return "", ErrUsernameStart
+	}
+	if reserved[strings.ToLower(s)] {
+		return "", ErrUsernameReserved
+	}
+	return s, nil
+}
+
+func isASCIIAlnum(r rune) bool {
+	return 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9'
+}
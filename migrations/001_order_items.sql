@@ -0,0 +1,31 @@
+-- Multi-item orders: a cart is converted into one order with line items.
+
+CREATE TABLE IF NOT EXISTS cart_items (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    quantity INTEGER NOT NULL DEFAULT 1 CHECK (quantity > 0),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, product_id)
+);
+
+CREATE TABLE IF NOT EXISTS order_items (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    product_id INTEGER NOT NULL REFERENCES products(id),
+    unit_price DECIMAL(10,2) NOT NULL,
+    quantity INTEGER NOT NULL DEFAULT 1 CHECK (quantity > 0),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_items_order_id ON order_items(order_id);
+
+-- orders.product_id is kept for old rows but is no longer required.
+ALTER TABLE orders ALTER COLUMN product_id DROP NOT NULL;
+
+-- Backfill line items for single-product orders created before this migration.
+INSERT INTO order_items (order_id, product_id, unit_price, quantity, created_at)
+SELECT o.id, o.product_id, o.total_amount, 1, o.created_at
+FROM orders o
+WHERE o.product_id IS NOT NULL
+  AND NOT EXISTS (SELECT 1 FROM order_items oi WHERE oi.order_id = o.id);
@@ -0,0 +1,18 @@
+-- Time-bounded sale prices. When several sales overlap the lowest price wins.
+
+CREATE TABLE IF NOT EXISTS product_sales (
+    id SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    old_price DECIMAL(10,2),
+    sale_price DECIMAL(10,2) NOT NULL CHECK (sale_price > 0),
+    starts_at TIMESTAMP NOT NULL,
+    ends_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK (ends_at > starts_at)
+);
+
+CREATE INDEX IF NOT EXISTS idx_product_sales_product_window ON product_sales(product_id, starts_at, ends_at);
+
+-- unit_price is what was charged; list_price is the regular price at the time.
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS list_price DECIMAL(10,2);
+UPDATE order_items SET list_price = unit_price WHERE list_price IS NULL;
@@ -0,0 +1,31 @@
+-- Bundles: a product whose keys come from its component products.
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS is_bundle BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS bundle_components (
+    bundle_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    component_id INTEGER NOT NULL REFERENCES products(id) ON DELETE RESTRICT,
+    position INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (bundle_id, component_id),
+    CHECK (bundle_id <> component_id)
+);
+
+-- Keys actually delivered for an order line. A bundle line gets one row per component.
+CREATE TABLE IF NOT EXISTS order_item_keys (
+    id SERIAL PRIMARY KEY,
+    order_item_id INTEGER NOT NULL REFERENCES order_items(id) ON DELETE CASCADE,
+    product_id INTEGER NOT NULL REFERENCES products(id),
+    license_key TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_item_keys_item ON order_item_keys(order_item_id);
+
+INSERT INTO order_item_keys (order_item_id, product_id, license_key)
+SELECT oi.id, oi.product_id, p.license_key
+FROM order_items oi
+JOIN orders o ON oi.order_id = o.id
+JOIN products p ON oi.product_id = p.id
+WHERE o.payment_status = 'completed'
+  AND p.license_key IS NOT NULL
+  AND NOT EXISTS (SELECT 1 FROM order_item_keys k WHERE k.order_item_id = oi.id);
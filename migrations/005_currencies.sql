@@ -0,0 +1,10 @@
+-- Multi-currency: prices stay in the base currency (RUB); orders also record
+-- what was charged in the buyer's currency and the rate used.
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS preferred_currency VARCHAR(3);
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS currency VARCHAR(3) NOT NULL DEFAULT 'RUB';
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS charged_amount DECIMAL(20,8);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS exchange_rate DECIMAL(24,12) NOT NULL DEFAULT 1;
+
+UPDATE orders SET charged_amount = total_amount WHERE charged_amount IS NULL;
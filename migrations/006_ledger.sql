@@ -0,0 +1,84 @@
+-- Balance wallet on a double-entry ledger. Every transaction moves money
+-- between accounts and its entries sum to zero; users.balance is kept as a
+-- cached copy of the user's wallet account for the storefront.
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS balance DECIMAL(12,2) NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS ledger_accounts (
+    id SERIAL PRIMARY KEY,
+    code VARCHAR(64) UNIQUE NOT NULL,
+    user_id INTEGER UNIQUE REFERENCES users(id) ON DELETE RESTRICT,
+    allow_negative BOOLEAN NOT NULL DEFAULT FALSE,
+    balance DECIMAL(12,2) NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT ledger_accounts_no_overdraft CHECK (allow_negative OR balance >= 0)
+);
+
+CREATE TABLE IF NOT EXISTS ledger_transactions (
+    id SERIAL PRIMARY KEY,
+    kind VARCHAR(16) NOT NULL CHECK (kind IN ('deposit', 'withdrawal', 'purchase', 'refund', 'opening')),
+    description TEXT NOT NULL DEFAULT '',
+    order_id INTEGER REFERENCES orders(id) ON DELETE SET NULL,
+    reference VARCHAR(255),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS ledger_entries (
+    id SERIAL PRIMARY KEY,
+    transaction_id INTEGER NOT NULL REFERENCES ledger_transactions(id) ON DELETE RESTRICT,
+    account_id INTEGER NOT NULL REFERENCES ledger_accounts(id) ON DELETE RESTRICT,
+    amount DECIMAL(12,2) NOT NULL CHECK (amount <> 0),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_ledger_entries_account ON ledger_entries(account_id, id);
+CREATE INDEX IF NOT EXISTS idx_ledger_entries_transaction ON ledger_entries(transaction_id);
+CREATE INDEX IF NOT EXISTS idx_ledger_transactions_order ON ledger_transactions(order_id);
+
+-- Checked at commit, so the entries of one transaction can be inserted one by one.
+CREATE OR REPLACE FUNCTION ledger_check_balanced() RETURNS trigger AS $$
+BEGIN
+    IF (SELECT COALESCE(SUM(amount), 0) FROM ledger_entries WHERE transaction_id = NEW.transaction_id) <> 0 THEN
+        RAISE EXCEPTION 'ledger transaction % does not balance', NEW.transaction_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS ledger_entries_balanced ON ledger_entries;
+CREATE CONSTRAINT TRIGGER ledger_entries_balanced
+    AFTER INSERT ON ledger_entries
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE FUNCTION ledger_check_balanced();
+
+INSERT INTO ledger_accounts (code, allow_negative) VALUES
+    ('external:payments', TRUE),
+    ('revenue:sales', TRUE),
+    ('equity:opening', TRUE)
+ON CONFLICT (code) DO NOTHING;
+
+-- Carry existing balances over as opening transactions.
+DO $$
+DECLARE
+    u RECORD;
+    wallet_id INTEGER;
+    opening_id INTEGER;
+    tx_id INTEGER;
+BEGIN
+    SELECT id INTO opening_id FROM ledger_accounts WHERE code = 'equity:opening';
+    FOR u IN
+        SELECT id, balance FROM users
+        WHERE balance > 0
+          AND NOT EXISTS (SELECT 1 FROM ledger_accounts a WHERE a.user_id = users.id)
+    LOOP
+        INSERT INTO ledger_accounts (code, user_id) VALUES ('wallet:' || u.id, u.id)
+        RETURNING id INTO wallet_id;
+        INSERT INTO ledger_transactions (kind, description) VALUES ('opening', 'Opening balance')
+        RETURNING id INTO tx_id;
+        INSERT INTO ledger_entries (transaction_id, account_id, amount) VALUES
+            (tx_id, opening_id, -u.balance),
+            (tx_id, wallet_id, u.balance);
+        UPDATE ledger_accounts SET balance = balance - u.balance WHERE id = opening_id;
+        UPDATE ledger_accounts SET balance = u.balance WHERE id = wallet_id;
+    END LOOP;
+END $$;
@@ -0,0 +1,35 @@
+-- Refunds. A refunded key the buyer never saw goes back to inventory; one
+-- they have seen is revoked and the product stays sold.
+
+ALTER TABLE order_item_keys ADD COLUMN IF NOT EXISTS status VARCHAR(16) NOT NULL DEFAULT 'delivered'
+    CHECK (status IN ('delivered', 'revoked', 'returned'));
+ALTER TABLE order_item_keys ADD COLUMN IF NOT EXISTS revealed_at TIMESTAMP;
+ALTER TABLE order_item_keys ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMP;
+
+-- Keys delivered before this migration may already have been seen
+UPDATE order_item_keys SET revealed_at = created_at WHERE revealed_at IS NULL;
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS refunded_amount DECIMAL(10,2) NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS refunds (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    admin_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    amount DECIMAL(10,2) NOT NULL CHECK (amount > 0),
+    currency VARCHAR(3) NOT NULL,
+    charged_amount DECIMAL(20,8) NOT NULL,
+    destination VARCHAR(16) NOT NULL CHECK (destination IN ('original', 'balance')),
+    payment_method VARCHAR(50) NOT NULL,
+    provider_reference VARCHAR(255),
+    reason TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_refunds_order ON refunds(order_id);
+
+CREATE TABLE IF NOT EXISTS refund_keys (
+    refund_id INTEGER NOT NULL REFERENCES refunds(id) ON DELETE CASCADE,
+    order_item_key_id INTEGER NOT NULL REFERENCES order_item_keys(id),
+    action VARCHAR(16) NOT NULL CHECK (action IN ('revoked', 'returned')),
+    PRIMARY KEY (refund_id, order_item_key_id)
+);
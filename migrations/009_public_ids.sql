@@ -0,0 +1,22 @@
+-- Orders get a public reference for URLs instead of their sequential id,
+-- and transaction ids become unique.
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS public_id VARCHAR(32);
+
+-- New orders get ULIDs from the application; existing ones a random UUID
+UPDATE orders SET public_id = replace(gen_random_uuid()::text, '-', '') WHERE public_id IS NULL;
+
+ALTER TABLE orders ALTER COLUMN public_id SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_orders_public_id ON orders(public_id);
+
+-- The old method_unixtime_rand ids could collide; keep the first and
+-- disambiguate the rest before enforcing uniqueness.
+UPDATE orders o SET transaction_id = o.transaction_id || '_' || o.id
+WHERE EXISTS (
+    SELECT 1 FROM orders d
+    WHERE d.transaction_id = o.transaction_id AND d.id < o.id
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_orders_transaction_id ON orders(transaction_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_refunds_provider_reference ON refunds(provider_reference);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_ledger_transactions_reference ON ledger_transactions(reference);
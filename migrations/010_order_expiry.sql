@@ -0,0 +1,7 @@
+-- Pending orders that were never paid are expired by a background job,
+-- which looks them up by status and age.
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS expired_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_orders_pending_created
+    ON orders(created_at) WHERE payment_status = 'pending';
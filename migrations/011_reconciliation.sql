@@ -0,0 +1,24 @@
+-- Reconciliation reports: a provider statement matched against our orders
+-- and refunds for the period it covers.
+
+CREATE TABLE IF NOT EXISTS reconciliation_reports (
+    id SERIAL PRIMARY KEY,
+    provider VARCHAR(50) NOT NULL,
+    source_name VARCHAR(255) NOT NULL,
+    period_from DATE NOT NULL,
+    period_to DATE NOT NULL, -- inclusive
+    entries_count INTEGER NOT NULL,
+    records_count INTEGER NOT NULL,
+    matched_count INTEGER NOT NULL,
+    missing_count INTEGER NOT NULL,
+    mismatched_count INTEGER NOT NULL,
+    orphaned_count INTEGER NOT NULL,
+    report JSONB NOT NULL,
+    admin_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_reconciliation_reports_provider
+    ON reconciliation_reports(provider, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_orders_method_created ON orders(payment_method, created_at);
+CREATE INDEX IF NOT EXISTS idx_refunds_method_created ON refunds(payment_method, created_at);
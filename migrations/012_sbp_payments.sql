@@ -0,0 +1,14 @@
+-- SBP (fast payment system) QR codes, one per order paid by SBP.
+
+CREATE TABLE IF NOT EXISTS sbp_payments (
+    order_id INTEGER PRIMARY KEY REFERENCES orders(id) ON DELETE CASCADE,
+    qrc_id VARCHAR(64) NOT NULL UNIQUE,
+    payload TEXT NOT NULL,
+    amount DECIMAL(10,2) NOT NULL CHECK (amount > 0),
+    status VARCHAR(16) NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'accepted', 'rejected', 'expired')),
+    operation_id VARCHAR(64),
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
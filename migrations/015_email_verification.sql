@@ -0,0 +1,11 @@
+-- Email verification. Accounts created before verification existed were
+-- usable all along and are treated as verified rather than locked out.
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_verified BOOLEAN;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS verified_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS verification_sent_at TIMESTAMP;
+
+UPDATE users SET is_verified = TRUE WHERE is_verified IS NULL;
+
+ALTER TABLE users ALTER COLUMN is_verified SET DEFAULT FALSE;
+ALTER TABLE users ALTER COLUMN is_verified SET NOT NULL;
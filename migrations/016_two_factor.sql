@@ -0,0 +1,34 @@
+-- TOTP two-factor authentication. The secret is stored encrypted; backup
+-- codes are bcrypt hashes. A login that needs a second factor first gets a
+-- short-lived challenge instead of a session.
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled_at TIMESTAMP;
+-- Last time step a code was accepted for, so a code can't be replayed
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS user_backup_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash VARCHAR(60) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_backup_codes_user ON user_backup_codes(user_id) WHERE used_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS login_challenges (
+    id VARCHAR(26) PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    purpose VARCHAR(16) NOT NULL CHECK (purpose IN ('verify', 'enroll')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+-- Admins logged in with just a password have to log in again and enroll
+UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP, revoke_reason = 'two_factor_required'
+WHERE revoked_at IS NULL
+  AND user_id IN (SELECT id FROM users WHERE is_admin AND NOT totp_enabled);
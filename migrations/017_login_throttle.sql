@@ -0,0 +1,15 @@
+-- Failed login counters for brute-force protection, per client IP and per
+-- account. Accounts unknown to the shop are counted by the name tried, so
+-- they are throttled exactly like real ones.
+
+CREATE TABLE IF NOT EXISTS login_throttles (
+    scope VARCHAR(10) NOT NULL CHECK (scope IN ('ip', 'account')),
+    key VARCHAR(255) NOT NULL,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    blocked_until TIMESTAMP,
+    PRIMARY KEY (scope, key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_throttles_last_failure
+    ON login_throttles(last_failure_at);
@@ -0,0 +1,21 @@
+-- Personal API tokens, stored hashed. window_start and window_count are
+-- the token's fixed one-minute rate-limit window.
+
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id VARCHAR(26) PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    hint VARCHAR(16) NOT NULL,
+    scopes VARCHAR(255) NOT NULL DEFAULT '',
+    rate_limit INTEGER NOT NULL DEFAULT 60 CHECK (rate_limit > 0),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    last_used_ip VARCHAR(64),
+    revoked_at TIMESTAMP,
+    window_start TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    window_count INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_tokens_user ON api_tokens(user_id) WHERE revoked_at IS NULL;
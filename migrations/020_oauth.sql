@@ -0,0 +1,44 @@
+-- Sign-in with external identity providers. An identity is linked to one
+-- account, and an account has at most one identity per provider. Accounts
+-- created through a provider have no password until one is set through
+-- password reset.
+
+CREATE TABLE IF NOT EXISTS user_identities (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider VARCHAR(32) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_login_at TIMESTAMP,
+    UNIQUE (provider, subject),
+    UNIQUE (user_id, provider)
+);
+
+-- Sign-ins in progress. The state is stored hashed and also kept in a
+-- cookie, so a callback only completes in the browser that started it.
+CREATE TABLE IF NOT EXISTS oauth_states (
+    state_hash CHAR(64) PRIMARY KEY,
+    provider VARCHAR(32) NOT NULL,
+    nonce VARCHAR(64) NOT NULL,
+    verifier VARCHAR(64) NOT NULL,
+    redirect_to VARCHAR(255) NOT NULL DEFAULT '/',
+    link_user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+-- First sign-ins that still need a username or email from the user.
+CREATE TABLE IF NOT EXISTS oauth_signups (
+    id VARCHAR(26) PRIMARY KEY,
+    provider VARCHAR(32) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL DEFAULT '',
+    email_verified BOOLEAN NOT NULL DEFAULT FALSE,
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    redirect_to VARCHAR(255) NOT NULL DEFAULT '/',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
@@ -0,0 +1,30 @@
+-- Bitcoin payments: a deposit address per order paid in BTC and the
+-- transactions buyers report for it. Amounts are in satoshis.
+
+-- Derivation index of the next deposit address. A sequence never hands out
+-- an index twice, across restarts and concurrent checkouts; indexes from
+-- 2^31 on are hardened and can't be derived from an xpub.
+CREATE SEQUENCE IF NOT EXISTS bitcoin_address_index MINVALUE 0 MAXVALUE 2147483647 START 0;
+
+CREATE TABLE IF NOT EXISTS bitcoin_payments (
+    order_id INTEGER PRIMARY KEY REFERENCES orders(id) ON DELETE CASCADE,
+    address_index INTEGER NOT NULL UNIQUE,
+    address VARCHAR(90) NOT NULL UNIQUE,
+    amount_due BIGINT NOT NULL CHECK (amount_due > 0),
+    status VARCHAR(16) NOT NULL DEFAULT 'awaiting_payment'
+        CHECK (status IN ('awaiting_payment', 'underpaid', 'confirming', 'paid', 'expired')),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- A transaction pays for one order only, so one payment can't settle two.
+CREATE TABLE IF NOT EXISTS bitcoin_transactions (
+    txid CHAR(64) PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES bitcoin_payments(order_id),
+    amount BIGINT NOT NULL CHECK (amount > 0),
+    confirmations INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_bitcoin_transactions_order ON bitcoin_transactions(order_id);
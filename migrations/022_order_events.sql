@@ -0,0 +1,20 @@
+-- Under- and overpaid Bitcoin orders: an underpaid order stays open for a
+-- top-up until top_up_by, and whatever ends up credited to the buyer's
+-- wallet (in the base currency) is recorded. order_events is the order
+-- timeline shown to the buyer.
+
+ALTER TABLE bitcoin_payments ADD COLUMN IF NOT EXISTS top_up_by TIMESTAMP;
+ALTER TABLE bitcoin_payments ADD COLUMN IF NOT EXISTS credited DECIMAL(12,2);
+
+CREATE TABLE IF NOT EXISTS order_events (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    type VARCHAR(32) NOT NULL,
+    amount DECIMAL(20,8),
+    currency VARCHAR(3),
+    txid VARCHAR(64),
+    message TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_events_order ON order_events(order_id, id);
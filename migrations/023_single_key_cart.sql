@@ -0,0 +1,7 @@
+-- cart_items is the only cart; the in-memory demo cart service is gone.
+-- Each product row is a single license key, so it is in a cart once.
+
+UPDATE cart_items SET quantity = 1 WHERE quantity > 1;
+
+ALTER TABLE cart_items DROP CONSTRAINT IF EXISTS cart_items_single_key;
+ALTER TABLE cart_items ADD CONSTRAINT cart_items_single_key CHECK (quantity = 1);
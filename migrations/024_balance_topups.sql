@@ -0,0 +1,17 @@
+-- Wallet top-ups wait for their payment: the ledger is credited only once
+-- the gateway settles, and a failed payment leaves the balance alone.
+
+CREATE TABLE IF NOT EXISTS balance_topups (
+    id SERIAL PRIMARY KEY,
+    reference VARCHAR(64) NOT NULL UNIQUE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    amount DECIMAL(12,2) NOT NULL CHECK (amount > 0),
+    payment_method VARCHAR(50) NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'completed', 'failed')),
+    ledger_transaction_id INTEGER REFERENCES ledger_transactions(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_balance_topups_user ON balance_topups(user_id, created_at);
@@ -0,0 +1,5 @@
+-- Login challenges and pending OAuth signups are named by a 32-byte random
+-- token rather than a ULID, which only has to be unique.
+
+ALTER TABLE login_challenges ALTER COLUMN id TYPE VARCHAR(64);
+ALTER TABLE oauth_signups ALTER COLUMN id TYPE VARCHAR(64);
@@ -0,0 +1,6 @@
+-- Usernames and emails are unique regardless of case, as registration and
+-- login already treat them. Accounts differing only in case must be merged
+-- or renamed before this runs, or the index creation fails.
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username_lower ON users (LOWER(username));
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_lower ON users (LOWER(email));